@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// audit events
+const (
+	auditAuthSuccess   = "auth_success"
+	auditAuthFailure   = "auth_failure"
+	auditPeerCreated   = "peer_created"
+	auditPeerRenewed   = "peer_renewed"
+	auditPeerRemoved   = "peer_removed"
+	auditDeviceRevoked = "device_revoked"
+)
+
+// auditServerKey is the detail of a peer_created entry for a device whose key
+// pair the server generated
+const auditServerKey = "server generated key"
+
+// AuditEntry is a record in the audit log. Entries are numbered from 1 and
+// each one's hash covers its fields and the previous entry's hash, so editing
+// or deleting an entry breaks the chain. The hashes are HMACs keyed with
+// auditKey, so the chain can't be rebuilt without it
+type AuditEntry struct {
+	Seq int64 `json:"seq"`
+	// Time is RFC 3339 in UTC
+	Time  string `json:"time"`
+	Event string `json:"event"`
+	// Actor is the sub of the token that caused the event, or watchdog
+	Actor    string `json:"actor"`
+	SourceIP string `json:"source_ip"`
+	// TokenID is the acting token's jti
+	TokenID string `json:"jti"`
+	// Subject is the peer's owner, or the token's sub for auth events
+	Subject   string `json:"sub"`
+	PublicKey string `json:"public_key"`
+	IP        string `json:"ip"`
+	// Detail is the error for failures, the reason for removals and notes that
+	// the server generated a created peer's key
+	Detail   string `json:"detail"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"-"`
+}
+
+const auditColumns = "seq, time, event, actor, source_ip, jti, sub, public_key, ip, detail, prev_hash, hash"
+
+// hash returns the entry's HMAC-SHA256 with key, hex encoded
+func (e AuditEntry) hash(key []byte) string {
+	// the JSON field order is fixed by the struct, and Hash is left out
+	raw, _ := json.Marshal(e)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditKeySize is the size of a generated audit key, and the smallest one
+// that's accepted
+const auditKeySize = 32
+
+// auditKey keys the audit log's hashes. It's read from a file outside the
+// client DB, so the chain can't be recomputed by someone who can only edit
+// the DB
+var auditKey []byte
+
+// loadAuditKey reads the audit key from path. If create is set and there
+// isn't one a new key is generated and written there
+func loadAuditKey(path string, create bool) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		key = make([]byte, auditKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("couldn't generate the audit key: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("couldn't create the audit key: %w", err)
+		}
+		// O_EXCL so a key that's already in use is never replaced
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create the audit key: %w", err)
+		}
+		_, err = f.Write(key)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't write the audit key: %w", err)
+		}
+		log.Info().Str("path", path).Msg("created the audit key")
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the audit key: %w", err)
+	}
+	if len(key) < auditKeySize {
+		return nil, fmt.Errorf("the audit key in %s is shorter than %d bytes", path, auditKeySize)
+	}
+	return key, nil
+}
+
+// auditActor is who caused an audited event
+type auditActor struct {
+	Subject  string
+	TokenID  string
+	SourceIP string
+}
+
+// watchdogActor removes peers whose timeouts ran out
+var watchdogActor = auditActor{Subject: "watchdog"}
+
+// requestActor returns the actor of a request with a verified token
+func requestActor(r *http.Request, claims Claims) auditActor {
+	return claimsActor(claims, sourceIP(r))
+}
+
+// claimsActor returns the actor with a verified token from sourceIP
+func claimsActor(claims Claims, sourceIP string) auditActor {
+	return auditActor{Subject: claims.String("sub"), TokenID: claims.String("jti"), SourceIP: sourceIP}
+}
+
+// sourceIP is the address a request came from, without the port
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// entry starts an audit entry for an event caused by a
+func (a auditActor) entry(event string) AuditEntry {
+	return AuditEntry{Event: event, Actor: a.Subject, SourceIP: a.SourceIP, TokenID: a.TokenID}
+}
+
+// auditMu serializes appends so every entry chains to the one before it
+var auditMu sync.Mutex
+
+// audit appends e to the audit log. A failure is logged, it doesn't fail what
+// was being audited
+func audit(e AuditEntry) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if db == nil {
+		return
+	}
+	err := db.QueryRow("SELECT seq, hash FROM wg_audit ORDER BY seq DESC LIMIT 1;").Scan(&e.Seq, &e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error().AnErr("error reading the audit log", err).Str("event", e.Event).Msg("audit entry not written")
+		return
+	}
+	e.Seq++
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	e.Hash = e.hash(auditKey)
+	_, err = db.Exec("INSERT INTO wg_audit ("+auditColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);",
+		e.Seq, e.Time, e.Event, e.Actor, e.SourceIP, e.TokenID, e.Subject, e.PublicKey, e.IP, e.Detail, e.PrevHash, e.Hash)
+	if err != nil {
+		log.Error().AnErr("error writing the audit log", err).Str("event", e.Event).Msg("audit entry not written")
+		return
+	}
+	// the head is logged so it's kept outside the DB too, and entries
+	// removed from the end can be found with audit verify -head
+	log.Info().Int64("seq", e.Seq).Str("hash", e.Hash).Str("event", e.Event).Msg("audit entry written")
+}
+
+// auditAuth records a's token being accepted or, if err is set, rejected,
+// and sends it to the webhooks. Failures without a verified token are only
+// written and sent once per source IP in each authFailureWindow, the rest are
+// counted and summarized by flushAuthFailures
+func auditAuth(a auditActor, err error) {
+	e := a.entry(auditAuthSuccess)
+	e.Subject = e.Actor
+	if err != nil {
+		e.Event, e.Detail = auditAuthFailure, err.Error()
+	}
+	if err != nil && a.Subject == "" && !authFailures.record(a.SourceIP, e.Detail) {
+		return
+	}
+	audit(e)
+	notify(WebhookEvent{Event: e.Event, Identity: Identity{Subject: e.Subject}, Reason: e.Detail, SourceIP: e.SourceIP})
+}
+
+// authFailureWindow is how often the counted unauthenticated failures are
+// written to the audit log
+const authFailureWindow = time.Minute
+
+// failureCounter counts unauthenticated failures by source IP so a flood of
+// anonymous requests isn't written to the audit log one entry at a time
+type failureCounter struct {
+	mu      sync.Mutex
+	sources map[string]*countedFailures
+}
+
+// countedFailures are the failures from a source that weren't written
+type countedFailures struct {
+	count int
+	// last is the most recent failure's error
+	last string
+}
+
+func newFailureCounter() *failureCounter {
+	return &failureCounter{sources: make(map[string]*countedFailures)}
+}
+
+// authFailures are the unauthenticated failures since the last flush
+var authFailures = newFailureCounter()
+
+// record reports whether a failure from source should be written, which it
+// should if it's the first from source since the last flush. Otherwise it's
+// counted. Sources past rateLimiterMaxKeys share the "" source
+func (c *failureCounter) record(source, detail string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sources[source]; !ok && len(c.sources) >= rateLimiterMaxKeys {
+		source = ""
+	}
+	counted, ok := c.sources[source]
+	if !ok {
+		c.sources[source] = &countedFailures{}
+		return true
+	}
+	counted.count++
+	counted.last = detail
+	return false
+}
+
+// flush returns the counted failures by source and starts a new window
+func (c *failureCounter) flush() map[string]countedFailures {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flushed := make(map[string]countedFailures)
+	for source, counted := range c.sources {
+		if counted.count > 0 {
+			flushed[source] = *counted
+		}
+	}
+	c.sources = make(map[string]*countedFailures)
+	return flushed
+}
+
+// flushAuthFailures writes and sends one entry for each source's counted
+// failures
+func flushAuthFailures() {
+	flushed := authFailures.flush()
+	sources := make([]string, 0, len(flushed))
+	for source := range flushed {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		counted := flushed[source]
+		e := AuditEntry{Event: auditAuthFailure, SourceIP: source,
+			Detail: fmt.Sprintf("%d more failures, the last: %s", counted.count, counted.last)}
+		audit(e)
+		notify(WebhookEvent{Event: e.Event, Reason: e.Detail, SourceIP: e.SourceIP})
+	}
+}
+
+// runAuthFailureFlusher flushes the counted failures every authFailureWindow
+// until ctx is cancelled. The failures counted after that are left for a
+// last flushAuthFailures once requests have stopped
+func runAuthFailureFlusher(ctx context.Context) {
+	ticker := time.NewTicker(authFailureWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			flushAuthFailures()
+		}
+	}
+}
+
+// auditReport is the result of verifying the audit log
+type auditReport struct {
+	Entries int64
+	// Head is the last entry's hash. The chain can't show entries missing
+	// from the end, so it should be compared with a head recorded earlier
+	Head     string
+	Problems []string
+}
+
+// verifyAuditLog checks the hash chain of the audit log in auditDB with key.
+// If head is set it's a hash recorded earlier, and the log must still have
+// its entry
+func verifyAuditLog(auditDB *sql.DB, key []byte, head string) (auditReport, error) {
+	var report auditReport
+	rows, err := auditDB.Query("SELECT " + auditColumns + " FROM wg_audit ORDER BY seq;")
+	if err != nil {
+		return report, fmt.Errorf("couldn't read the audit log: %w", err)
+	}
+	defer rows.Close()
+	var prev int64
+	headFound := false
+	for rows.Next() {
+		var e AuditEntry
+		err := rows.Scan(&e.Seq, &e.Time, &e.Event, &e.Actor, &e.SourceIP, &e.TokenID, &e.Subject,
+			&e.PublicKey, &e.IP, &e.Detail, &e.PrevHash, &e.Hash)
+		if err != nil {
+			return report, fmt.Errorf("couldn't read the audit log: %w", err)
+		}
+		report.Entries++
+		switch {
+		case e.Seq != prev+1:
+			report.Problems = append(report.Problems, fmt.Sprintf("entries %d to %d are missing", prev+1, e.Seq-1))
+		case e.PrevHash != report.Head:
+			report.Problems = append(report.Problems, fmt.Sprintf("entry %d doesn't follow entry %d", e.Seq, prev))
+		}
+		if !hmac.Equal([]byte(e.hash(key)), []byte(e.Hash)) {
+			report.Problems = append(report.Problems, fmt.Sprintf("entry %d was modified", e.Seq))
+		}
+		headFound = headFound || e.Hash == head
+		prev, report.Head = e.Seq, e.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return report, fmt.Errorf("couldn't read the audit log: %w", err)
+	}
+	if head != "" && !headFound {
+		report.Problems = append(report.Problems, fmt.Sprintf("no entry has the hash %s, entries were removed from the end", head))
+	}
+	return report, nil
+}
+
+// runAudit runs the audit subcommand with its arguments
+func runAudit(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return errors.New("usage: wg2fa audit verify [-config path] [-cl path] [-key path] [-head hash]")
+	}
+	// the paths come from the server's config, the flags override it
+	defaults := defaultConfig()
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	configFlag := fs.String("config", os.Getenv(configEnvPrefix+"_CONFIG"), "The path to the YAML config file, WG2FA_CONFIG by default")
+	fs.String("cl", defaults.WireGuard.ClientListPath, "the path of the client DB holding the audit log")
+	fs.String("key", defaults.Audit.KeyFile, "the path of the audit key")
+	headFlag := fs.String("head", "", "a last hash printed or logged earlier, whose entry must still be in the audit log")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	config, err := readConfig(*configFlag, os.Environ(), fs)
+	if err != nil {
+		return err
+	}
+	key, err := loadAuditKey(config.Audit.KeyFile, false)
+	if err != nil {
+		return err
+	}
+	auditDB, err := sql.Open("sqlite3", "file:"+config.WireGuard.ClientListPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer auditDB.Close()
+	report, err := verifyAuditLog(auditDB, key, *headFlag)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d entries, last hash %s\n", report.Entries, report.Head)
+	for _, problem := range report.Problems {
+		fmt.Fprintln(out, problem)
+	}
+	if len(report.Problems) > 0 {
+		return errors.New("the audit log has been tampered with")
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// auditEvents returns the audit log's events in order
+func auditEvents(t *testing.T) []AuditEntry {
+	rows, err := db.Query("SELECT seq, event, actor, source_ip, jti, sub, public_key, ip, detail FROM wg_audit ORDER BY seq;")
+	if err != nil {
+		t.Fatalf("error reading the audit log: %s", err)
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.Seq, &e.Event, &e.Actor, &e.SourceIP, &e.TokenID, &e.Subject, &e.PublicKey, &e.IP, &e.Detail); err != nil {
+			t.Fatalf("error reading the audit log: %s", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// useTestAuditKey keys the audit log with a new key for one test and
+// returns the file it's in
+func useTestAuditKey(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "audit.key")
+	key, err := loadAuditKey(path, true)
+	if err != nil {
+		t.Fatalf("error creating the audit key: %s", err)
+	}
+	old := auditKey
+	auditKey = key
+	t.Cleanup(func() { auditKey = old })
+	return path
+}
+
+// dropAuditTriggers lets a test tamper with the audit log the way someone
+// editing the DB file could
+func dropAuditTriggers(t *testing.T) {
+	for _, trigger := range []string{"wg_audit_no_update", "wg_audit_no_delete"} {
+		if _, err := db.Exec("DROP TRIGGER " + trigger + ";"); err != nil {
+			t.Fatalf("error dropping %s: %s", trigger, err)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	useTestWGClient(t, "audit.db")
+	useTestAuditKey(t)
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	claims := iss.claims()
+	claims["jti"] = "token-1"
+	token := iss.sign(t, "RS256", "rsa1", claims)
+	do := func(r *http.Request) {
+		r.RemoteAddr = "203.0.113.7:40000"
+		newRouter().ServeHTTP(httptest.NewRecorder(), r)
+	}
+	r := httptest.NewRequest("POST", "/newuser", strings.NewReader(`{"client_name": "laptop", "public_key": "`+pubkey+`"}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+	do(r)
+	do(authedRequest("GET", "/me/peers", "not-a-token"))
+	do(authedRequest("DELETE", "/me/peers/"+url.PathEscape(pubkey), token))
+
+	entries := auditEvents(t)
+	expected := []string{auditAuthSuccess, auditPeerCreated, auditAuthFailure, auditAuthSuccess, auditPeerRemoved}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d audit entries, got %+v", len(expected), entries)
+	}
+	for i, e := range entries {
+		if e.Event != expected[i] || e.SourceIP != "203.0.113.7" {
+			t.Errorf("entry %d: expected %s from 203.0.113.7, got %+v", i+1, expected[i], e)
+		}
+	}
+	created, removed := entries[1], entries[4]
+	if created.Actor != "00u1abcd" || created.TokenID != "token-1" || created.Subject != "00u1abcd" ||
+		created.PublicKey != pubkey || created.IP != "10.0.0.2/24" {
+		t.Errorf("wrong peer_created entry %+v", created)
+	}
+	if removed.Detail != sessionEndUser || removed.IP != "10.0.0.2/24" {
+		t.Errorf("wrong peer_removed entry %+v", removed)
+	}
+	if entries[2].Detail == "" {
+		t.Errorf("auth failure has no reason")
+	}
+
+	report, err := verifyAuditLog(db, auditKey, "")
+	if err != nil || len(report.Problems) != 0 || report.Entries != 5 || report.Head == "" {
+		t.Fatalf("expected a valid audit log, got %+v (%v)", report, err)
+	}
+	head := report.Head
+	// the log can only be appended to through the DB
+	if _, err := db.Exec("UPDATE wg_audit SET ip = '10.0.0.99/24' WHERE seq = 2;"); err == nil {
+		t.Errorf("an audit entry was updated")
+	}
+	if _, err := db.Exec("DELETE FROM wg_audit WHERE seq = 5;"); err == nil {
+		t.Errorf("an audit entry was deleted")
+	}
+	dropAuditTriggers(t)
+	// an edited entry, and then one rehashed without the key, are detected
+	db.Exec("UPDATE wg_audit SET ip = '10.0.0.99/24' WHERE seq = 2;")
+	report, _ = verifyAuditLog(db, auditKey, "")
+	if len(report.Problems) != 1 || report.Problems[0] != "entry 2 was modified" {
+		t.Errorf("edited entry wasn't detected: %v", report.Problems)
+	}
+	var e AuditEntry
+	db.QueryRow("SELECT seq, time, event, actor, source_ip, jti, sub, public_key, ip, detail, prev_hash FROM wg_audit WHERE seq = 2;").
+		Scan(&e.Seq, &e.Time, &e.Event, &e.Actor, &e.SourceIP, &e.TokenID, &e.Subject, &e.PublicKey, &e.IP, &e.Detail, &e.PrevHash)
+	db.Exec("UPDATE wg_audit SET hash = $1 WHERE seq = 2;", e.hash([]byte("not the audit key")))
+	report, _ = verifyAuditLog(db, auditKey, "")
+	if len(report.Problems) != 2 || report.Problems[0] != "entry 2 was modified" || report.Problems[1] != "entry 3 doesn't follow entry 2" {
+		t.Errorf("rehashed entry wasn't detected: %v", report.Problems)
+	}
+	db.Exec("DELETE FROM wg_audit WHERE seq IN (2, 3);")
+	report, _ = verifyAuditLog(db, auditKey, "")
+	if len(report.Problems) != 1 || report.Problems[0] != "entries 2 to 3 are missing" {
+		t.Errorf("missing entries weren't detected: %v", report.Problems)
+	}
+	// entries removed from the end are found with a head recorded earlier
+	db.Exec("DELETE FROM wg_audit WHERE seq = 5;")
+	if report, _ = verifyAuditLog(db, auditKey, head); len(report.Problems) != 2 ||
+		report.Problems[1] != "no entry has the hash "+head+", entries were removed from the end" {
+		t.Errorf("removed head wasn't detected: %v", report.Problems)
+	}
+}
+
+func TestAuditAnonymousFailures(t *testing.T) {
+	iss := newStubIssuer(t)
+	cfg := iss.config()
+	cfg.RequiredClaims = map[string]string{"groups": "vpn-admins"}
+	useTestVerifier(t, cfg)
+	useTestWGClient(t, "auditfailures.db")
+	probe := func(source, token string) {
+		r := authedRequest("GET", "/me/peers", token)
+		r.RemoteAddr = source + ":40000"
+		newRouter().ServeHTTP(httptest.NewRecorder(), r)
+	}
+	for i := 0; i < 5; i++ {
+		probe("203.0.113.7", "not-a-token")
+	}
+	probe("203.0.113.7", "still-not-a-token")
+	probe("198.51.100.1", "not-a-token")
+	// only the first failure from each source is written straight away
+	entries := auditEvents(t)
+	if len(entries) != 2 || entries[0].SourceIP != "203.0.113.7" || entries[1].SourceIP != "198.51.100.1" {
+		t.Fatalf("expected one failure from each source, got %+v", entries)
+	}
+	// the rest are summarized once per source
+	flushAuthFailures()
+	entries = auditEvents(t)
+	if len(entries) != 3 {
+		t.Fatalf("expected one summary, got %+v", entries)
+	}
+	summary := entries[2]
+	if summary.Event != auditAuthFailure || summary.SourceIP != "203.0.113.7" || summary.Actor != "" ||
+		!strings.HasPrefix(summary.Detail, "5 more failures, the last: ") {
+		t.Errorf("wrong summary %+v", summary)
+	}
+	// and the next failure starts a new window
+	probe("203.0.113.7", "not-a-token")
+	flushAuthFailures()
+	if entries = auditEvents(t); len(entries) != 4 || entries[3].Detail == summary.Detail {
+		t.Errorf("expected the failure in the new window to be written, got %+v", entries)
+	}
+	// failures with a verified token are always written
+	token := iss.sign(t, "RS256", "rsa1", iss.claims())
+	for i := 0; i < 2; i++ {
+		probe("203.0.113.7", token)
+	}
+	if entries = auditEvents(t); len(entries) != 6 || entries[5].Actor != "00u1abcd" ||
+		!strings.Contains(entries[5].Detail, "forbidden") {
+		t.Errorf("expected both forbidden requests to be written, got %+v", entries)
+	}
+}
+
+func TestRunAudit(t *testing.T) {
+	c, _ := newTestWGClient(t, "auditverify.db")
+	dbpath := filepath.Join(".", "test", "auditverify.db")
+	keyPath := useTestAuditKey(t)
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	if _, err := c.newUser(NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: Identity{Subject: "alice"}}, nil); err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	if err := c.removeUser(pubkey, removeReasonIdle, watchdogActor); err != nil {
+		t.Fatalf("error removing user: %s", err)
+	}
+	var out bytes.Buffer
+	if err := runAudit([]string{"verify", "-cl", dbpath, "-key", keyPath}, &out); err != nil {
+		t.Fatalf("verify failed: %s\n%s", err, out.String())
+	}
+	if !strings.HasPrefix(out.String(), "2 entries, last hash ") {
+		t.Errorf("wrong output %q", out.String())
+	}
+	head := strings.TrimSpace(strings.TrimPrefix(out.String(), "2 entries, last hash "))
+	out.Reset()
+	if err := runAudit([]string{"verify", "-cl", dbpath, "-key", keyPath, "-head", head}, &out); err != nil {
+		t.Errorf("verify with the head failed: %s\n%s", err, out.String())
+	}
+	// a log checked with another key, or without one, isn't trusted
+	otherKey := filepath.Join(t.TempDir(), "other.key")
+	if _, err := loadAuditKey(otherKey, true); err != nil {
+		t.Fatalf("error creating a key: %s", err)
+	}
+	if err := runAudit([]string{"verify", "-cl", dbpath, "-key", otherKey}, &out); err == nil {
+		t.Errorf("expected verification with another key to fail")
+	}
+	if err := runAudit([]string{"verify", "-cl", dbpath, "-key", filepath.Join(t.TempDir(), "missing.key")}, &out); err == nil {
+		t.Errorf("expected verification without the key to fail")
+	}
+	dropAuditTriggers(t)
+	db.Exec("UPDATE wg_audit SET actor = 'admin' WHERE seq = 2;")
+	out.Reset()
+	if err := runAudit([]string{"verify", "-cl", dbpath, "-key", keyPath}, &out); err == nil || !strings.Contains(out.String(), "entry 2 was modified") {
+		t.Errorf("expected the edit to fail verification, got %v:\n%s", err, out.String())
+	}
+	if err := runAudit(nil, &out); err == nil {
+		t.Errorf("expected a usage error without verify")
+	}
+}
+
+func TestRunAuditConfig(t *testing.T) {
+	c, _ := newTestWGClient(t, "auditconfig.db")
+	dbpath := filepath.Join(".", "test", "auditconfig.db")
+	keyPath := useTestAuditKey(t)
+	if _, err := c.newUser(NewUser{ClientName: "laptop", PublicKey: "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=",
+		Identity: Identity{Subject: "alice"}}, nil); err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	// the paths are read from the server's config, which only needs the ones
+	// verify uses
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	config := "wireguard:\n  client_list_path: " + dbpath + "\naudit:\n  key_file: " + keyPath + "\n"
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatalf("error writing config: %s", err)
+	}
+	var out bytes.Buffer
+	if err := runAudit([]string{"verify", "-config", configPath}, &out); err != nil || !strings.HasPrefix(out.String(), "1 entries") {
+		t.Fatalf("verify with the config failed: %v\n%s", err, out.String())
+	}
+	// flags override it
+	if err := runAudit([]string{"verify", "-config", configPath, "-key", filepath.Join(t.TempDir(), "missing.key")}, &out); err == nil {
+		t.Errorf("expected -key to override the config")
+	}
+	os.Setenv("WG2FA_CONFIG", configPath)
+	defer os.Unsetenv("WG2FA_CONFIG")
+	out.Reset()
+	if err := runAudit([]string{"verify"}, &out); err != nil {
+		t.Errorf("verify with WG2FA_CONFIG failed: %v\n%s", err, out.String())
+	}
+	// a broken config isn't ignored
+	if err := ioutil.WriteFile(configPath, []byte("audit: [\n"), 0600); err != nil {
+		t.Fatalf("error writing config: %s", err)
+	}
+	if err := runAudit([]string{"verify", "-config", configPath}, &out); err == nil {
+		t.Errorf("expected an invalid config to fail")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// authRealm is the realm sent in WWW-Authenticate challenges
+const authRealm = "wg2fa"
+
+var errNoToken = errors.New("no bearer token")
+var errBadAuthHeader = errors.New("malformed authorization header")
+var errStaleLogin = errors.New("token is from a login before the peer was last renewed, log in again")
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+const policyContextKey contextKey = "policy"
+
+// claimsFromContext returns the verified token claims stored by authMiddleware
+func claimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(Claims)
+	return claims, ok
+}
+
+// Identity is the authenticated user a peer belongs to
+type Identity struct {
+	// Subject is the token's sub claim, the IdP's stable user ID
+	Subject     string `json:"sub"`
+	Email       string `json:"email,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// identityFromClaims reads the user's identity from verified claims, falling
+// back to the claims Azure AD and Keycloak use when email or name are absent
+func identityFromClaims(claims Claims) Identity {
+	id := Identity{
+		Subject:     claims.String("sub"),
+		Email:       claims.String("email"),
+		DisplayName: claims.String("name"),
+	}
+	if id.Email == "" {
+		for _, name := range []string{"upn", "preferred_username"} {
+			if v := claims.String(name); strings.Contains(v, "@") {
+				id.Email = v
+				break
+			}
+		}
+	}
+	if id.DisplayName == "" {
+		id.DisplayName = claims.String("preferred_username")
+	}
+	return id
+}
+
+// policyFromContext returns the policy matched by authMiddleware, or nil if
+// no policies are configured
+func policyFromContext(ctx context.Context) *Policy {
+	policy, _ := ctx.Value(policyContextKey).(*Policy)
+	return policy
+}
+
+// bearerToken reads an RFC 6750 bearer token from the Authorization header
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", errNoToken
+	}
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", errBadAuthHeader
+	}
+	token := strings.TrimSpace(parts[1])
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return "", errBadAuthHeader
+	}
+	return token, nil
+}
+
+// authMiddleware verifies the bearer token of every request it wraps and puts
+// the token's claims and matching policy into the request context. Missing or
+// invalid tokens get a 401 and valid tokens that aren't allowed get a 403
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if disableAuth {
+			log.Warn().Msg("Auth disabled! Allowing request")
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, err := bearerToken(r)
+		switch err {
+		case nil:
+		case errNoToken:
+			log.Warn().Str("ip", r.RemoteAddr).Msg("request without a bearer token")
+			auditAuth(requestActor(r, nil), err)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", authRealm))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		default:
+			log.Warn().Str("ip", r.RemoteAddr).Msg("request with a malformed authorization header")
+			auditAuth(requestActor(r, nil), err)
+			authChallenge(w, http.StatusUnauthorized, "invalid_request", err.Error())
+			return
+		}
+		claims, policy, err := authorizeToken(token)
+		auditAuth(requestActor(r, claims), err)
+		if errors.Is(err, errForbidden) {
+			log.Warn().Str("ip", r.RemoteAddr).Str("sub", claims.String("sub")).Err(err).Msg("request permission denied")
+			authChallenge(w, http.StatusForbidden, "insufficient_scope", err.Error())
+			return
+		} else if err != nil {
+			log.Warn().Str("ip", r.RemoteAddr).Err(err).Msg("request with an invalid token")
+			authChallenge(w, http.StatusUnauthorized, "invalid_token", err.Error())
+			return
+		}
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		ctx = context.WithValue(ctx, policyContextKey, policy)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authenticatedAt returns when the token's owner logged in, from auth_time or
+// else iat. Refreshed tokens keep their auth_time
+func authenticatedAt(claims Claims) (time.Time, bool) {
+	if t, ok := numericDate(claims["auth_time"]); ok {
+		return t, true
+	}
+	return numericDate(claims["iat"])
+}
+
+// freshLogin reports whether the token's owner logged in after since, so the
+// token can restart a peer's force time. Tokens without auth_time or iat
+// aren't fresh
+func freshLogin(claims Claims, since time.Time) bool {
+	loggedIn, ok := authenticatedAt(claims)
+	return disableAuth || (ok && loggedIn.After(since))
+}
+
+// authorizeToken verifies a token and finds the policy that applies to it.
+// Errors for valid tokens that aren't allowed wrap errForbidden, and the
+// claims are returned with them
+func authorizeToken(token string) (Claims, *Policy, error) {
+	claims, err := tokenVerifier.Verify(token)
+	if err != nil {
+		return claims, nil, err
+	}
+	ps := currentPolicies()
+	if ps == nil {
+		return claims, nil, nil
+	}
+	policy, err := ps.match(claims)
+	return claims, policy, err
+}
+
+func authChallenge(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=%q, error_description=%q", authRealm, code, description))
+	w.WriteHeader(status)
+}
+
+// StatsHandler returns the token verifier's key cache counters to admins
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]interface{}{}
+	if tokenVerifier != nil {
+		stats["token_verifier"] = tokenVerifier.Stats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
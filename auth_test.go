@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useTestVerifier points the global verifier at a stub issuer for one test
+func useTestVerifier(t *testing.T, cfg OIDCConfig) {
+	v, err := newTokenVerifier(cfg)
+	if err != nil {
+		t.Fatalf("error creating verifier: %s", err)
+	}
+	old := tokenVerifier
+	tokenVerifier = v
+	t.Cleanup(func() { tokenVerifier = old })
+}
+
+func TestBearerToken(t *testing.T) {
+	cases := map[string]error{
+		"Bearer abc.def.ghi": nil,
+		"bearer abc.def.ghi": nil,
+		"":                   errNoToken,
+		"Basic dXNlcjpwYXNz": errBadAuthHeader,
+		"Bearer":             errBadAuthHeader,
+		"Bearer ":            errBadAuthHeader,
+		"Bearer abc def":     errBadAuthHeader,
+	}
+	for header, expected := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		token, err := bearerToken(r)
+		if err != expected {
+			t.Errorf("%q: expected %v, got %v", header, expected, err)
+		}
+		if err == nil && token != "abc.def.ghi" {
+			t.Errorf("%q: wrong token %q", header, token)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	iss := newStubIssuer(t)
+	cfg := iss.config()
+	cfg.RequiredClaims = map[string]string{"groups": "vpn-users"}
+	useTestVerifier(t, cfg)
+	var gotClaims Claims
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotClaims, _ = claimsFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+	notAllowed := iss.claims()
+	notAllowed["groups"] = []string{"contractors"}
+	cases := []struct {
+		name      string
+		header    string
+		status    int
+		challenge string
+	}{
+		{"valid", "Bearer " + iss.sign(t, "RS256", "rsa1", iss.claims()), http.StatusOK, ""},
+		{"missing", "", http.StatusUnauthorized, `Bearer realm="wg2fa"`},
+		{"wrong scheme", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, `error="invalid_request"`},
+		{"invalid", "Bearer not.a.token", http.StatusUnauthorized, `error="invalid_token"`},
+		{"not allowed", "Bearer " + iss.sign(t, "RS256", "rsa1", notAllowed), http.StatusForbidden, `error="insufficient_scope"`},
+	}
+	for _, c := range cases {
+		gotClaims = nil
+		r := httptest.NewRequest("POST", "/newuser", nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, w.Code)
+		}
+		challenge := w.Header().Get("WWW-Authenticate")
+		if c.challenge != "" && !strings.Contains(challenge, c.challenge) {
+			t.Errorf("%s: expected challenge containing %s, got %q", c.name, c.challenge, challenge)
+		}
+		if c.status == http.StatusOK && gotClaims.String("sub") != "00u1abcd" {
+			t.Errorf("%s: claims weren't put in the request context", c.name)
+		}
+		if c.status != http.StatusOK && gotClaims != nil {
+			t.Errorf("%s: handler shouldn't have been called", c.name)
+		}
+	}
+}
+
+func TestRouterAuth(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	router := newRouter()
+	// the home route is public
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("home route should be public, got %d", w.Code)
+	}
+	// newuser requires a token
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/newuser", strings.NewReader("{}")))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("newuser without a token should be a 401, got %d", w.Code)
+	}
+	// a valid token gets through to the handler, which rejects the bad body
+	r := httptest.NewRequest("POST", "/newuser", strings.NewReader("not json"))
+	r.Header.Set("Authorization", "Bearer "+iss.sign(t, "RS256", "rsa1", iss.claims()))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("newuser with a valid token should reach the handler, got %d", w.Code)
+	}
+}
+
+func TestIdentityFromClaims(t *testing.T) {
+	id := identityFromClaims(Claims{"sub": "abc", "email": "bob@example.com", "name": "Bob"})
+	if id != (Identity{Subject: "abc", Email: "bob@example.com", DisplayName: "Bob"}) {
+		t.Errorf("wrong identity %+v", id)
+	}
+	// Azure AD access tokens carry upn instead of email
+	id = identityFromClaims(Claims{"sub": "abc", "upn": "bob@example.com", "preferred_username": "bob"})
+	if id.Email != "bob@example.com" || id.DisplayName != "bob" {
+		t.Errorf("wrong identity from fallback claims %+v", id)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	useTestWGClient(t, "stats.db")
+	useTestAdmin(t)
+	claims := iss.claims()
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, authedRequest("GET", "/admin/stats", iss.sign(t, "RS256", "rsa1", claims)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a 403 for a non-admin, got %d", w.Code)
+	}
+	claims["groups"] = []string{"vpn-admins"}
+	w = httptest.NewRecorder()
+	newRouter().ServeHTTP(w, authedRequest("GET", "/admin/stats", iss.sign(t, "RS256", "rsa1", claims)))
+	var stats struct {
+		TokenVerifier VerifierStats `json:"token_verifier"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &stats) != nil {
+		t.Fatalf("expected the stats, got %d: %s", w.Code, w.Body.String())
+	}
+	// both requests' keys came from the cache
+	if stats.TokenVerifier.CacheHits != 2 || stats.TokenVerifier.RefreshFailures != 0 {
+		t.Errorf("wrong stats %+v", stats.TokenVerifier)
+	}
+}
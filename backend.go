@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var errNoBackend = errors.New("no wireguard backend configured")
+
+// Backend is the set of wireguard operations WGClient depends on. The kernel
+// backend talks to a real device over netlink, tests use an in-memory fake
+type Backend interface {
+	// AddPeer adds a peer (or updates an existing one) on scd.Interface
+	AddPeer(scd *serverCConfData) error
+	// RemovePeer removes the peer with the given public key from an interface
+	RemovePeer(iface, pubkey string) error
+	// Peers returns the current state of every peer on an interface
+	Peers(iface string) ([]PeerStatus, error)
+	// GenerateKey returns a new private key and its public key
+	GenerateKey() (string, string, error)
+	// PublicKey derives the public key of a private key
+	PublicKey(privkey string) (string, error)
+	// GeneratePSK returns a new preshared key
+	GeneratePSK() (string, error)
+}
+
+// PeerStatus is the runtime state of a peer as reported by the interface
+type PeerStatus struct {
+	PublicKey     string
+	Endpoint      string
+	LastHandshake time.Time
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// kernelBackend manages a wireguard device through the wgctrl netlink client
+type kernelBackend struct {
+	client *wgctrl.Client
+}
+
+func newKernelBackend() (*kernelBackend, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open wireguard control client: %w", err)
+	}
+	return &kernelBackend{client: client}, nil
+}
+
+func (b *kernelBackend) AddPeer(scd *serverCConfData) error {
+	pubkey, err := wgtypes.ParseKey(scd.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid peer public key: %w", err)
+	}
+	psk, err := wgtypes.ParseKey(scd.PSK)
+	if err != nil {
+		return fmt.Errorf("invalid peer preshared key: %w", err)
+	}
+	allowedIP, err := hostPrefix(scd.IP)
+	if err != nil {
+		return err
+	}
+	cfg := wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:         pubkey,
+			PresharedKey:      &psk,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        []net.IPNet{allowedIP},
+		}},
+	}
+	if err := b.client.ConfigureDevice(scd.Interface, cfg); err != nil {
+		return fmt.Errorf("couldn't add peer to %s: %w", scd.Interface, err)
+	}
+	return nil
+}
+
+func (b *kernelBackend) RemovePeer(iface, pubkey string) error {
+	key, err := wgtypes.ParseKey(pubkey)
+	if err != nil {
+		return fmt.Errorf("invalid peer public key: %w", err)
+	}
+	cfg := wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey: key,
+			Remove:    true,
+		}},
+	}
+	if err := b.client.ConfigureDevice(iface, cfg); err != nil {
+		return fmt.Errorf("couldn't remove peer from %s: %w", iface, err)
+	}
+	return nil
+}
+
+func (b *kernelBackend) Peers(iface string) ([]PeerStatus, error) {
+	device, err := b.client.Device(iface)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read device %s: %w", iface, err)
+	}
+	peers := make([]PeerStatus, 0, len(device.Peers))
+	for _, p := range device.Peers {
+		ps := PeerStatus{
+			PublicKey:     p.PublicKey.String(),
+			LastHandshake: p.LastHandshakeTime,
+			ReceiveBytes:  p.ReceiveBytes,
+			TransmitBytes: p.TransmitBytes,
+		}
+		if p.Endpoint != nil {
+			ps.Endpoint = p.Endpoint.String()
+		}
+		peers = append(peers, ps)
+	}
+	return peers, nil
+}
+
+func (b *kernelBackend) GenerateKey() (string, string, error) {
+	return createWGKey()
+}
+
+func (b *kernelBackend) PublicKey(privkey string) (string, error) {
+	return getPubKey(privkey)
+}
+
+func (b *kernelBackend) GeneratePSK() (string, error) {
+	return createPSK()
+}
+
+// hostPrefix turns an address in the interface's CIDR notation (10.0.0.3/24)
+// into the single host route a peer should be allowed (10.0.0.3/32)
+func hostPrefix(addr string) (net.IPNet, error) {
+	ipString := strings.Split(addr, "/")[0]
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		return net.IPNet{}, fmt.Errorf("invalid peer IP %q", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
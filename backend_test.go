@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend is an in-memory Backend for tests
+type fakeBackend struct {
+	mu sync.Mutex
+	// peers is a map of interface name to the peers configured on it
+	peers map[string]map[string]fakePeer
+	// addErr, if set, is returned from AddPeer
+	addErr error
+	// removeErr, if set, is returned from RemovePeer
+	removeErr error
+}
+
+type fakePeer struct {
+	serverCConfData
+	PeerStatus
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{peers: make(map[string]map[string]fakePeer)}
+}
+
+func (b *fakeBackend) AddPeer(scd *serverCConfData) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.addErr != nil {
+		return b.addErr
+	}
+	if _, ok := b.peers[scd.Interface]; !ok {
+		b.peers[scd.Interface] = make(map[string]fakePeer)
+	}
+	b.peers[scd.Interface][scd.PublicKey] = fakePeer{
+		serverCConfData: *scd,
+		PeerStatus:      PeerStatus{PublicKey: scd.PublicKey},
+	}
+	return nil
+}
+
+func (b *fakeBackend) RemovePeer(iface, pubkey string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.removeErr != nil {
+		return b.removeErr
+	}
+	if _, ok := b.peers[iface][pubkey]; !ok {
+		return errors.New("peer not found")
+	}
+	delete(b.peers[iface], pubkey)
+	return nil
+}
+
+func (b *fakeBackend) Peers(iface string) ([]PeerStatus, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	peers := make([]PeerStatus, 0, len(b.peers[iface]))
+	for _, p := range b.peers[iface] {
+		peers = append(peers, p.PeerStatus)
+	}
+	return peers, nil
+}
+
+func (b *fakeBackend) GenerateKey() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	privkey := base64.StdEncoding.EncodeToString(raw)
+	pubkey, err := b.PublicKey(privkey)
+	return privkey, pubkey, err
+}
+
+// PublicKey isn't curve25519, it only needs to be stable for a private key
+func (b *fakeBackend) PublicKey(privkey string) (string, error) {
+	sum := sha256.Sum256([]byte(privkey))
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+func (b *fakeBackend) GeneratePSK() (string, error) {
+	_, psk, err := b.GenerateKey()
+	return psk, err
+}
+
+// hasPeer reports whether a peer is configured on an interface
+func (b *fakeBackend) hasPeer(iface, pubkey string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.peers[iface][pubkey]
+	return ok
+}
+
+// setHandshake sets the last handshake time reported for a peer
+func (b *fakeBackend) setHandshake(iface, pubkey string, t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.peers[iface][pubkey]
+	p.LastHandshake = t
+	b.peers[iface][pubkey] = p
+}
+
+func newTestWGClient(t *testing.T, dbName string) (WGClient, *fakeBackend) {
+	dbpath := filepath.Join(".", "test", dbName)
+	if err := checkClientDb(dbpath, true); err != nil {
+		t.Fatalf("error creating client db: %s", err)
+	}
+	t.Cleanup(func() {
+		closeClientDb()
+		deleteFile(dbpath)
+	})
+	// failures counted by other tests would be summarized in this audit log
+	authFailures.flush()
+	fb := newFakeBackend()
+	c := WGClient{
+		WGConfigPath:   filepath.Join(".", "test", "wg0.conf"),
+		ClientListPath: dbpath,
+		DNSServers:     []string{"8.8.8.8", "8.8.4.4"},
+		ServerHostname: "example.com:51820",
+		InterfaceName:  "wg0",
+		Backend:        fb,
+	}
+	if err := c.init(); err != nil {
+		t.Fatalf("error initializing client: %s", err)
+	}
+	return c, fb
+}
+
+func TestInitRequiresBackend(t *testing.T) {
+	c := WGClient{
+		WGConfigPath:   filepath.Join(".", "test", "wg0.conf"),
+		ClientListPath: filepath.Join(".", "test", "nobackend.db"),
+		ServerHostname: "example.com:51820",
+		InterfaceName:  "wg0",
+	}
+	defer deleteFile(c.ClientListPath)
+	defer closeClientDb()
+	if err := c.init(); err != errNoBackend {
+		t.Errorf("expected errNoBackend, got %v", err)
+	}
+}
+
+func TestNewAndRemoveUser(t *testing.T) {
+	c, fb := newTestWGClient(t, "newremove.db")
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	created, err := c.newUser(NewUser{ClientName: "bob", PublicKey: pubkey}, nil)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	if created.WGConf == "" {
+		t.Errorf("no client config returned")
+	}
+	peer, ok := fb.peers["wg0"][pubkey]
+	if !ok {
+		t.Fatalf("peer wasn't added to the backend")
+	}
+	if peer.IP != "10.0.0.2/24" {
+		t.Errorf("wrong peer IP %s", peer.IP)
+	}
+	clients, err := getClients()
+	if err != nil || len(clients) != 1 {
+		t.Fatalf("expected one client in the db, got %d (%v)", len(clients), err)
+	}
+	if err := c.removeUser(pubkey, removeReasonIdle, watchdogActor); err != nil {
+		t.Errorf("error removing user: %s", err)
+	}
+	if _, ok := fb.peers["wg0"][pubkey]; ok {
+		t.Errorf("peer wasn't removed from the backend")
+	}
+	clients, _ = getClients()
+	if len(clients) != 0 {
+		t.Errorf("client wasn't removed from the db")
+	}
+}
+
+func TestNewUserBackendError(t *testing.T) {
+	c, fb := newTestWGClient(t, "backenderr.db")
+	fb.addErr = errors.New("device busy")
+	_, err := c.newUser(NewUser{ClientName: "bob", PublicKey: "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="}, nil)
+	if err == nil || errors.Is(err, errInvalidUser) {
+		t.Errorf("expected an error when the backend fails, got %v", err)
+	}
+	clients, _ := getClients()
+	if len(clients) != 0 {
+		t.Errorf("client shouldn't be in the db when the backend fails")
+	}
+}
+
+func TestNewUserConcurrentIPs(t *testing.T) {
+	c, _ := newTestWGClient(t, "concurrentips.db")
+	const logins = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, logins)
+	for i := 0; i < logins; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.newUser(NewUser{ClientName: "bob", GenerateKey: true}, nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+	clients, err := getClients()
+	if err != nil || len(clients) != logins {
+		t.Fatalf("expected %d clients, got %d (%v)", logins, len(clients), err)
+	}
+	ips := make(map[string]bool)
+	for _, client := range clients {
+		if ips[client.IP] {
+			t.Errorf("%s was given to more than one client", client.IP)
+		}
+		ips[client.IP] = true
+	}
+}
+
+func TestGetLastHandshakes(t *testing.T) {
+	c, fb := newTestWGClient(t, "handshakes.db")
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	if _, err := c.newUser(NewUser{ClientName: "bob", PublicKey: pubkey}, nil); err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	hs := time.Unix(1600000000, 0)
+	fb.setHandshake("wg0", pubkey, hs)
+	handshakes, err := c.getLastHandshakes()
+	if err != nil {
+		t.Fatalf("error getting handshakes: %s", err)
+	}
+	if !handshakes[pubkey].Equal(hs) {
+		t.Errorf("wrong handshake time %s", handshakes[pubkey])
+	}
+}
+
+func TestHostPrefix(t *testing.T) {
+	prefix, err := hostPrefix("10.0.0.3/24")
+	if err != nil {
+		t.Fatalf("error parsing prefix: %s", err)
+	}
+	if prefix.String() != "10.0.0.3/32" {
+		t.Errorf("wrong prefix %s", prefix.String())
+	}
+	if _, err := hostPrefix("not-an-ip/24"); err == nil {
+		t.Errorf("expected an error for an invalid IP")
+	}
+}
+
+func TestDeviceReactivation(t *testing.T) {
+	c, fb := newTestWGClient(t, "reactivate.db")
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	alice := Identity{Subject: "alice"}
+	first, err := c.newUser(NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: alice}, nil)
+	if err != nil {
+		t.Fatalf("error enrolling device: %s", err)
+	}
+	psk := fb.peers["wg0"][pubkey].PSK
+	// logging in again while active keeps the session
+	if _, err := c.newUser(NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: alice}, nil); err != nil {
+		t.Fatalf("error logging in an active device: %s", err)
+	}
+	// the watchdog deactivates it, which keeps the enrollment
+	if err := c.removeUser(pubkey, removeReasonIdle, watchdogActor); err != nil {
+		t.Fatalf("error deactivating device: %s", err)
+	}
+	if len(fb.peers["wg0"]) != 0 {
+		t.Errorf("deactivated device is still on the interface")
+	}
+	// a new device doesn't get the inactive device's IP
+	other, err := c.newUser(NewUser{ClientName: "phone", PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", Identity: alice}, nil)
+	if err != nil {
+		t.Fatalf("error enrolling second device: %s", err)
+	}
+	if other.WGConf == first.WGConf {
+		t.Errorf("second device got the first one's reservation")
+	}
+	second, err := c.newUser(NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: alice}, nil)
+	if err != nil {
+		t.Fatalf("error reactivating device: %s", err)
+	}
+	if second.WGConf != first.WGConf {
+		t.Errorf("reactivated device got a different config:\n%s\n%s", first.WGConf, second.WGConf)
+	}
+	if fb.peers["wg0"][pubkey].PSK != psk || fb.peers["wg0"][pubkey].IP != "10.0.0.2/24" {
+		t.Errorf("reactivated peer doesn't have its reserved IP and PSK")
+	}
+	// the device can't be used by someone else
+	_, err = c.newUser(NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: Identity{Subject: "mallory"}}, nil)
+	if !errors.Is(err, errForbidden) {
+		t.Errorf("expected errForbidden for another user's device, got %v", err)
+	}
+	devices, _ := getDevices()
+	if len(devices) != 2 {
+		t.Errorf("expected 2 enrolled devices, got %d", len(devices))
+	}
+	// revoking drops the enrollment too
+	if err := c.revokeDevice(pubkey, auditActor{Subject: "admin"}); err != nil {
+		t.Fatalf("error revoking device: %s", err)
+	}
+	if _, enrolled, _ := getDevice(pubkey); enrolled {
+		t.Errorf("revoked device is still enrolled")
+	}
+}
+
+func TestDevicePolicyChange(t *testing.T) {
+	c, fb := newTestWGClient(t, "devicepolicy.db")
+	ps := loadTestPolicies(t)
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	alice := Identity{Subject: "alice"}
+	if _, err := c.newUser(NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: alice}, nil); err != nil {
+		t.Fatalf("error enrolling device: %s", err)
+	}
+	// the device moves to the engineering pool, even while active
+	if _, err := c.newUser(NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: alice}, ps.byName("engineering")); err != nil {
+		t.Fatalf("error logging in under a new policy: %s", err)
+	}
+	if ip := fb.peers["wg0"][pubkey].IP; ip != "10.0.0.128/24" {
+		t.Errorf("IP %s isn't from the new policy's pool", ip)
+	}
+	clients, _ := getClients()
+	if len(clients) != 1 || clients[0].IP != "10.0.0.128/24" || clients[0].Policy != "engineering" {
+		t.Errorf("session wasn't moved to the new policy: %+v", clients)
+	}
+}
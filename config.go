@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+// configEnvPrefix prefixes the environment variables overriding the config
+// file, e.g. WG2FA_WIREGUARD_SERVER_HOSTNAME
+const configEnvPrefix = "WG2FA"
+
+var errUnknownSetting = errors.New("unknown setting")
+
+// Config is wg2fa's configuration. It's read from a YAML file, then
+// overridden by WG2FA_* environment variables and then by flags
+type Config struct {
+	// Listen is the HTTP listen address
+	Listen    string          `yaml:"listen"`
+	Debug     bool            `yaml:"debug"`
+	WireGuard WireGuardConfig `yaml:"wireguard"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Watchdog  WatchdogConfig  `yaml:"watchdog"`
+	Templates TemplatesConfig `yaml:"templates"`
+	Webhooks  WebhooksConfig  `yaml:"webhooks"`
+	Audit     AuditConfig     `yaml:"audit"`
+}
+
+// WireGuardConfig holds the WGClient settings
+type WireGuardConfig struct {
+	ConfigPath          string   `yaml:"config_path"`
+	ClientListPath      string   `yaml:"client_list_path"`
+	Interface           string   `yaml:"interface"`
+	ServerHostname      string   `yaml:"server_hostname"`
+	DNSServers          []string `yaml:"dns_servers"`
+	AllowedIPs          []string `yaml:"allowed_ips"`
+	PersistentKeepalive int      `yaml:"persistent_keepalive"`
+	MTU                 int      `yaml:"mtu"`
+}
+
+// AuthConfig holds the OIDC, portal, policy and admin settings
+type AuthConfig struct {
+	Issuer         string            `yaml:"issuer"`
+	ClientID       string            `yaml:"client_id"`
+	ClientSecret   string            `yaml:"client_secret"`
+	Audiences      []string          `yaml:"audiences"`
+	Algorithms     []string          `yaml:"algorithms"`
+	Scopes         []string          `yaml:"scopes"`
+	RequiredClaims map[string]string `yaml:"required_claims"`
+	AdminClaims    map[string]string `yaml:"admin_claims"`
+	PolicyFile     string            `yaml:"policy_file"`
+	PortalURL      string            `yaml:"portal_url"`
+	// ClientIDClaim is the claim that must hold ClientID, empty turns the
+	// check off
+	ClientIDClaim string `yaml:"client_id_claim"`
+}
+
+// requiredClaims returns the claims a token must carry, RequiredClaims and
+// the client ID in ClientIDClaim
+func (a AuthConfig) requiredClaims() map[string]string {
+	claims := make(map[string]string)
+	if a.ClientIDClaim != "" && a.ClientID != "" {
+		claims[a.ClientIDClaim] = a.ClientID
+	}
+	for name, value := range a.RequiredClaims {
+		claims[name] = value
+	}
+	return claims
+}
+
+// WatchdogConfig holds the default timeouts in minutes, <= 0 disables them
+type WatchdogConfig struct {
+	IdleTime           int64 `yaml:"idle_time"`
+	ForceTime          int64 `yaml:"force_time"`
+	FirstHandshakeTime int64 `yaml:"first_handshake_time"`
+	// ExpiryWarning is how many minutes before a peer's force time runs out
+	// the peer_expiring event is sent
+	ExpiryWarning int64 `yaml:"expiry_warning"`
+}
+
+// TemplatesConfig holds where the client config and portal templates are
+type TemplatesConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+// WebhooksConfig holds where events are sent
+type WebhooksConfig struct {
+	Endpoints []WebhookEndpoint `yaml:"endpoints"`
+	// Attempts is how many times a delivery is tried before it's given up
+	Attempts int `yaml:"attempts"`
+	// DeadLetterPath is the file given up deliveries are appended to. If
+	// it's empty they're only logged
+	DeadLetterPath string `yaml:"dead_letter_path"`
+}
+
+// WebhookEndpoint is a URL events are POSTed to, signed with Secret
+type WebhookEndpoint struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// Events are the events sent to the endpoint, defaultWebhookEvents if
+	// it's empty
+	Events []string `yaml:"events"`
+}
+
+// AuditConfig holds the audit log settings
+type AuditConfig struct {
+	// KeyFile holds the secret the audit log's hashes are keyed with. It's
+	// created if it doesn't exist
+	KeyFile string `yaml:"key_file"`
+}
+
+// defaultConfig is the configuration used for anything that isn't set
+func defaultConfig() Config {
+	return Config{
+		Listen: "0.0.0.0:8080",
+		WireGuard: WireGuardConfig{
+			ConfigPath:     "/etc/wireguard/wg0.conf",
+			ClientListPath: "/etc/wireguard/clientList",
+			Interface:      "wg0",
+			ServerHostname: "localhost:51280",
+			DNSServers:     []string{"8.8.8.8", "8.8.4.4"},
+			AllowedIPs:     []string{"0.0.0.0/0", "::/0"},
+		},
+		Auth: AuthConfig{
+			ClientIDClaim: "cid",
+			Audiences:     []string{"api://default"},
+			Algorithms:    []string{"RS256"},
+			Scopes:        []string{"openid", "profile", "email"},
+		},
+		Watchdog:  WatchdogConfig{IdleTime: 10, ForceTime: -1, FirstHandshakeTime: 10, ExpiryWarning: 5},
+		Templates: TemplatesConfig{Dir: filepath.Join(".", "text_templates")},
+		Webhooks:  WebhooksConfig{Attempts: 5},
+		Audit:     AuditConfig{KeyFile: "/etc/wg2fa/audit.key"},
+	}
+}
+
+// configFlags maps flag names to the config keys they set
+var configFlags = map[string]string{
+	"listen":     "listen",
+	"debug":      "debug",
+	"wgc":        "wireguard.config_path",
+	"cl":         "wireguard.client_list_path",
+	"interface":  "wireguard.interface",
+	"hostname":   "wireguard.server_hostname",
+	"dns":        "wireguard.dns_servers",
+	"allowedips": "wireguard.allowed_ips",
+	"keepalive":  "wireguard.persistent_keepalive",
+	"mtu":        "wireguard.mtu",
+	"iss":        "auth.issuer",
+	"cid":        "auth.client_id",
+	"cidclaim":   "auth.client_id_claim",
+	"csecret":    "auth.client_secret",
+	"aud":        "auth.audiences",
+	"algs":       "auth.algorithms",
+	"scopes":     "auth.scopes",
+	"claims":     "auth.required_claims",
+	"admin":      "auth.admin_claims",
+	"policy":     "auth.policy_file",
+	"portal":     "auth.portal_url",
+	"i":          "watchdog.idle_time",
+	"f":          "watchdog.force_time",
+	"fh":         "watchdog.first_handshake_time",
+	"templates":  "templates.dir",
+	"key":        "audit.key_file",
+}
+
+// configErrors is every problem found in a configuration
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+func (e *configErrors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// loadConfig reads the config file at path, if any, then applies the
+// environment and the flags that were set on fs. Every problem is reported
+// at once in a configErrors. Unknown WG2FA_* variables are only warned about,
+// so a stray one in the environment doesn't stop wg2fa from starting
+func loadConfig(path string, environ []string, fs *flag.FlagSet) (Config, error) {
+	c, err := readConfig(path, environ, fs)
+	errs, ok := err.(configErrors)
+	if err != nil && !ok {
+		return c, err
+	}
+	errs = append(errs, c.validate()...)
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// readConfig is loadConfig without checking the settings only the server
+// needs, for commands that use a few of them
+func readConfig(path string, environ []string, fs *flag.FlagSet) (Config, error) {
+	c := defaultConfig()
+	var errs configErrors
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		if err := yaml.UnmarshalStrict(raw, &c); err != nil {
+			if te, ok := err.(*yaml.TypeError); ok {
+				errs = append(errs, te.Errors...)
+			} else {
+				errs.add("%s: %s", path, err)
+			}
+		}
+	}
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if !strings.HasPrefix(parts[0], configEnvPrefix+"_") || len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimPrefix(parts[0], configEnvPrefix+"_")
+		if key == "CONFIG" {
+			continue
+		}
+		if err := c.set(key, parts[1], envKey); errors.Is(err, errUnknownSetting) {
+			log.Warn().Str("variable", parts[0]).Msg("ignoring unknown setting in the environment")
+		} else if err != nil {
+			errs.add("%s: %s", parts[0], err)
+		}
+	}
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) {
+			key, ok := configFlags[f.Name]
+			if !ok {
+				return
+			}
+			if err := c.set(key, f.Value.String(), yamlKey); err != nil {
+				errs.add("-%s: %s", f.Name, err)
+			}
+		})
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// yamlKey names a config field by its dotted YAML keys, e.g. auth.issuer
+func yamlKey(prefix, tag string) string {
+	if prefix == "" {
+		return tag
+	}
+	return prefix + "." + tag
+}
+
+// envKey names a config field the way the environment does, e.g. AUTH_ISSUER
+func envKey(prefix, tag string) string {
+	if prefix == "" {
+		return strings.ToUpper(tag)
+	}
+	return prefix + "_" + strings.ToUpper(tag)
+}
+
+// set sets the field named key to value, naming fields with keyName
+func (c *Config) set(key, value string, keyName func(prefix, tag string) string) error {
+	field, ok := findConfigField(reflect.ValueOf(c).Elem(), "", key, keyName)
+	if !ok {
+		return fmt.Errorf("%w %s", errUnknownSetting, key)
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q isn't a boolean", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", value)
+		}
+		field.SetInt(i)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("%s can only be set in the config file", key)
+		}
+		// lists are comma or space separated
+		field.Set(reflect.ValueOf(strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' '
+		})))
+	case reflect.Map:
+		pairs, err := parseClaimPairs(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(pairs))
+	}
+	return nil
+}
+
+func findConfigField(v reflect.Value, prefix, key string, keyName func(prefix, tag string) string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		name := keyName(prefix, v.Type().Field(i).Tag.Get("yaml"))
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if found, ok := findConfigField(field, name, key, keyName); ok {
+				return found, true
+			}
+		} else if name == key {
+			return field, true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// validate returns every problem with the configuration
+func (c *Config) validate() configErrors {
+	var errs configErrors
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs.add("listen: %q isn't a host:port address", c.Listen)
+	}
+	wg := c.WireGuard
+	if wg.ConfigPath == "" {
+		errs.add("wireguard.config_path: is required")
+	}
+	if wg.ClientListPath == "" {
+		errs.add("wireguard.client_list_path: is required")
+	}
+	if wg.Interface == "" {
+		errs.add("wireguard.interface: is required")
+	}
+	if _, _, err := net.SplitHostPort(wg.ServerHostname); err != nil {
+		errs.add("wireguard.server_hostname: %q isn't a host:port address", wg.ServerHostname)
+	}
+	for _, dns := range wg.DNSServers {
+		if net.ParseIP(dns) == nil {
+			errs.add("wireguard.dns_servers: %q isn't an IP", dns)
+		}
+	}
+	for _, cidr := range wg.AllowedIPs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs.add("wireguard.allowed_ips: %q isn't a CIDR", cidr)
+		}
+	}
+	if err := validateTunnelSettings(nil, nil, wg.PersistentKeepalive, 0); err != nil {
+		errs.add("wireguard.persistent_keepalive: %s", err)
+	}
+	if err := validateTunnelSettings(nil, nil, 0, wg.MTU); err != nil {
+		errs.add("wireguard.mtu: %s", err)
+	}
+	auth := c.Auth
+	if u, err := url.Parse(auth.Issuer); auth.Issuer == "" || err != nil || u.Host == "" {
+		errs.add("auth.issuer: %q isn't a URL", auth.Issuer)
+	}
+	if auth.ClientID == "" {
+		errs.add("auth.client_id: is required")
+	}
+	if len(auth.Audiences) == 0 {
+		errs.add("auth.audiences: at least one is required")
+	}
+	if len(auth.Algorithms) == 0 {
+		errs.add("auth.algorithms: at least one is required")
+	}
+	if auth.PortalURL != "" {
+		if u, err := url.Parse(auth.PortalURL); err != nil || u.Host == "" {
+			errs.add("auth.portal_url: %q isn't a URL", auth.PortalURL)
+		}
+	}
+	if auth.PolicyFile != "" {
+		if _, err := os.Stat(auth.PolicyFile); err != nil {
+			errs.add("auth.policy_file: %s", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.Templates.Dir, filepath.Base(clientTemplatePath))); err != nil {
+		errs.add("templates.dir: %s", err)
+	}
+	for i, endpoint := range c.Webhooks.Endpoints {
+		if u, err := url.Parse(endpoint.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("webhooks.endpoints[%d].url: %q isn't an http(s) URL", i, endpoint.URL)
+		}
+		if endpoint.Secret == "" {
+			errs.add("webhooks.endpoints[%d].secret: is required", i)
+		}
+		for _, event := range endpoint.Events {
+			if !webhookEvents[event] {
+				errs.add("webhooks.endpoints[%d].events: unknown event %q", i, event)
+			}
+		}
+	}
+	if c.Webhooks.Attempts < 1 {
+		errs.add("webhooks.attempts: must be at least 1")
+	}
+	if c.Audit.KeyFile == "" {
+		errs.add("audit.key_file: is required")
+	}
+	return errs
+}
+
+// useTemplateDir points every template path at dir
+func useTemplateDir(dir string) {
+	for _, path := range []*string{
+		&clientTemplatePath, &serverTemplatePath, &portalTemplatePath,
+		&nmConnectionTemplatePath, &netdevTemplatePath, &networkTemplatePath,
+	} {
+		*path = filepath.Join(dir, filepath.Base(*path))
+	}
+}
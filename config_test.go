@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	fs := flag.NewFlagSet("wg2fa", flag.ContinueOnError)
+	fs.String("hostname", "", "")
+	fs.Int64("i", 0, "")
+	fs.String("mtu", "", "")
+	if err := fs.Parse([]string{"-hostname", "wg.example.com:51820", "-i", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{
+		"WG2FA_CONFIG=ignored.yaml",
+		"WG2FA_WIREGUARD_SERVER_HOSTNAME=env.example.com:51820",
+		"WG2FA_WIREGUARD_ALLOWED_IPS=10.0.0.0/8, 192.168.0.0/16",
+		"WG2FA_AUTH_REQUIRED_CLAIMS=cid=client123",
+		"WG2FA_WATCHDOG_FORCE_TIME=480",
+		"HOME=/root",
+	}
+	c, err := loadConfig(filepath.Join("test", "config.yaml"), environ, fs)
+	if err != nil {
+		t.Fatalf("error loading config: %s", err)
+	}
+	checks := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		// from the file
+		{"listen", c.Listen, "127.0.0.1:9090"},
+		{"interface", c.WireGuard.Interface, "wg1"},
+		{"dns servers", c.WireGuard.DNSServers, []string{"10.0.0.1"}},
+		{"scopes", c.Auth.Scopes, []string{"openid", "email"}},
+		{"admin claims", c.Auth.AdminClaims, map[string]string{"groups": "vpn-admins"}},
+		// defaults for what the file leaves out
+		{"config path", c.WireGuard.ConfigPath, "/etc/wireguard/wg0.conf"},
+		{"audiences", c.Auth.Audiences, []string{"api://default"}},
+		// the environment overrides the file
+		{"allowed IPs", c.WireGuard.AllowedIPs, []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		{"required claims", c.Auth.RequiredClaims, map[string]string{"cid": "client123"}},
+		{"force time", c.Watchdog.ForceTime, int64(480)},
+		// and flags override both, but only when set
+		{"server hostname", c.WireGuard.ServerHostname, "wg.example.com:51820"},
+		{"idle time", c.Watchdog.IdleTime, int64(5)},
+		{"mtu", c.WireGuard.MTU, 0},
+	}
+	for _, check := range checks {
+		if !reflect.DeepEqual(check.got, check.expected) {
+			t.Errorf("%s: expected %v, got %v", check.name, check.expected, check.got)
+		}
+	}
+}
+
+func TestRequiredClaims(t *testing.T) {
+	auth := defaultConfig().Auth
+	auth.ClientID = "client123"
+	auth.RequiredClaims = map[string]string{"groups": "vpn-users"}
+	// the client ID is checked by default
+	expected := map[string]string{"cid": "client123", "groups": "vpn-users"}
+	if claims := auth.requiredClaims(); !reflect.DeepEqual(claims, expected) {
+		t.Errorf("expected %v, got %v", expected, claims)
+	}
+	// in another claim, or not at all
+	auth.ClientIDClaim = "azp"
+	expected = map[string]string{"azp": "client123", "groups": "vpn-users"}
+	if claims := auth.requiredClaims(); !reflect.DeepEqual(claims, expected) {
+		t.Errorf("expected %v, got %v", expected, claims)
+	}
+	auth.ClientIDClaim = ""
+	if claims := auth.requiredClaims(); !reflect.DeepEqual(claims, auth.RequiredClaims) {
+		t.Errorf("expected only the required claims, got %v", claims)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(path, []byte(`
+listen: 8080
+wireguard:
+  server_hostname: vpn.example.com
+  dns_servers: [dns.example.com]
+  allowed_ips: [10.0.0.0/33]
+  mtu: 100
+  peers: 3
+auth:
+  client_id: client123
+webhooks:
+  endpoints:
+    - url: ftp://hooks.example.com
+      events: [peer_created, peer_deleted]
+`), 0600)
+	environ := []string{"WG2FA_WATCHDOG_IDLE_TIME=ten", "WG2FA_WIREGUARD_COLOR=blue"}
+	_, err := loadConfig(path, environ, nil)
+	errs, ok := err.(configErrors)
+	if !ok {
+		t.Fatalf("expected configErrors, got %v", err)
+	}
+	// every problem is reported, not just the first
+	for _, expected := range []string{
+		"field peers not found",
+		"WG2FA_WATCHDOG_IDLE_TIME",
+		"listen:",
+		"wireguard.server_hostname:",
+		"wireguard.dns_servers:",
+		"wireguard.allowed_ips:",
+		"wireguard.mtu:",
+		"auth.issuer:",
+		"webhooks.endpoints[0].url:",
+		"webhooks.endpoints[0].secret:",
+		`unknown event "peer_deleted"`,
+	} {
+		if !strings.Contains(errs.Error(), expected) {
+			t.Errorf("missing %q in:\n%s", expected, errs)
+		}
+	}
+	// unknown environment variables are ignored
+	if strings.Contains(errs.Error(), "WIREGUARD_COLOR") {
+		t.Errorf("unknown environment variable reported:\n%s", errs)
+	}
+	if len(errs) != 11 {
+		t.Errorf("expected 11 problems, got %d:\n%s", len(errs), errs)
+	}
+}
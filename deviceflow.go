@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// defaultDevicePollInterval is the RFC 8628 default when the IdP sends none
+const defaultDevicePollInterval = 5 * time.Second
+
+// maxPendingDeviceFlows caps the device authorizations in progress, each of
+// which polls the IdP until it's approved or expires
+const maxPendingDeviceFlows = 1000
+
+// deviceAuthorizeLimit is how many device authorizations a source IP can
+// start a minute
+const deviceAuthorizeLimit = 10
+
+var errTooManyDeviceFlows = errors.New("too many device authorizations in progress")
+
+// RFC 8628 token endpoint error codes, also returned to wg2fa's clients
+const (
+	deviceAuthPending  = "authorization_pending"
+	deviceSlowDown     = "slow_down"
+	deviceAccessDenied = "access_denied"
+	deviceExpiredToken = "expired_token"
+	deviceInvalidGrant = "invalid_grant"
+	deviceServerError  = "server_error"
+)
+
+// deviceFlows is nil when the IdP doesn't support the device flow
+var deviceFlows *deviceFlow
+
+// deviceFlow runs the OAuth 2.0 Device Authorization Grant (RFC 8628) for
+// clients without a browser. wg2fa starts the authorization at the IdP, polls
+// the IdP's token endpoint and provisions the peer once the user approves.
+// The client only ever polls wg2fa
+type deviceFlow struct {
+	clientID              string
+	clientSecret          string
+	scopes                []string
+	authorizationEndpoint string
+	tokenEndpoint         string
+	httpClient            *http.Client
+	// wait and now are time.After and time.Now, swapped out in tests
+	wait func(time.Duration) <-chan time.Time
+	now  func() time.Time
+
+	// done stops all pollers when closed
+	done chan struct{}
+	// pollers are the pollers running
+	pollers sync.WaitGroup
+	// limiter limits the authorizations started by each source IP
+	limiter *rateLimiter
+
+	mu sync.Mutex
+	// maxPending caps len(requests)
+	maxPending int
+	requests   map[string]*deviceRequest
+}
+
+// deviceRequest is one device authorization, keyed by the device code wg2fa
+// gave its client. Its fields are guarded by deviceFlow.mu
+type deviceRequest struct {
+	newUser NewUser
+	// idpDeviceCode is the IdP's device code, it never leaves wg2fa
+	idpDeviceCode string
+	expires       time.Time
+	interval      time.Duration
+	lastPoll      time.Time
+	// status is an RFC 8628 error code, or "" once the peer is provisioned
+	status string
+	result NewUser
+}
+
+// deviceAuthResponse is the RFC 8628 device authorization response
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+// oauthTokenResponse is a token endpoint response, successful or not
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func newDeviceFlow(clientID, clientSecret string, scopes []string, metadata providerMetadata) (*deviceFlow, error) {
+	if metadata.DeviceAuthorizationEndpoint == "" || metadata.TokenEndpoint == "" {
+		return nil, errors.New("issuer doesn't support the device authorization grant")
+	}
+	return &deviceFlow{
+		clientID:              clientID,
+		clientSecret:          clientSecret,
+		scopes:                scopes,
+		authorizationEndpoint: metadata.DeviceAuthorizationEndpoint,
+		tokenEndpoint:         metadata.TokenEndpoint,
+		httpClient:            &http.Client{Timeout: 10 * time.Second},
+		wait:                  time.After,
+		now:                   time.Now,
+		done:                  make(chan struct{}),
+		limiter:               newRateLimiter(deviceAuthorizeLimit, time.Minute),
+		maxPending:            maxPendingDeviceFlows,
+		requests:              make(map[string]*deviceRequest),
+	}, nil
+}
+
+// stop stops polling the IdP for every pending request and waits for the
+// pollers to return. A poller already provisioning a peer finishes first
+func (f *deviceFlow) stop() {
+	close(f.done)
+	f.pollers.Wait()
+}
+
+// full reports whether no more requests can be started
+func (f *deviceFlow) full() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests) >= f.maxPending
+}
+
+// start begins a device authorization at the IdP for newUser and starts
+// polling for the user's approval. It returns errTooManyDeviceFlows once
+// maxPending requests are in progress
+func (f *deviceFlow) start(newUser NewUser) (deviceAuthResponse, error) {
+	if f.full() {
+		return deviceAuthResponse{}, errTooManyDeviceFlows
+	}
+	form := url.Values{
+		"client_id": {f.clientID},
+		"scope":     {strings.Join(f.scopes, " ")},
+	}
+	f.authenticate(form)
+	resp, err := f.httpClient.PostForm(f.authorizationEndpoint, form)
+	if err != nil {
+		return deviceAuthResponse{}, fmt.Errorf("device authorization request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return deviceAuthResponse{}, fmt.Errorf("device authorization returned %s: %s", resp.Status, body)
+	}
+	var idpResp struct {
+		deviceAuthResponse
+		// Azure AD and Google call it verification_url
+		VerificationURL string `json:"verification_url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&idpResp); err != nil {
+		return deviceAuthResponse{}, fmt.Errorf("couldn't decode device authorization response: %w", err)
+	}
+	auth := idpResp.deviceAuthResponse
+	if auth.VerificationURI == "" {
+		auth.VerificationURI = idpResp.VerificationURL
+	}
+	if auth.DeviceCode == "" || auth.UserCode == "" || auth.VerificationURI == "" {
+		return deviceAuthResponse{}, errors.New("incomplete device authorization response")
+	}
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDevicePollInterval
+	}
+	handle, err := randomToken()
+	if err != nil {
+		return deviceAuthResponse{}, err
+	}
+	req := &deviceRequest{
+		newUser:       newUser,
+		idpDeviceCode: auth.DeviceCode,
+		expires:       f.now().Add(time.Duration(auth.ExpiresIn) * time.Second),
+		interval:      interval,
+		status:        deviceAuthPending,
+	}
+	f.mu.Lock()
+	if len(f.requests) >= f.maxPending {
+		f.mu.Unlock()
+		return deviceAuthResponse{}, errTooManyDeviceFlows
+	}
+	f.requests[handle] = req
+	f.pollers.Add(1)
+	f.mu.Unlock()
+	go func() {
+		defer f.pollers.Done()
+		f.poll(handle, req)
+	}()
+	auth.DeviceCode = handle
+	auth.Interval = int(interval / time.Second)
+	return auth, nil
+}
+
+// poll polls the IdP's token endpoint until the user approves or denies the
+// request or it expires
+func (f *deviceFlow) poll(handle string, req *deviceRequest) {
+	f.mu.Lock()
+	interval := req.interval
+	f.mu.Unlock()
+	for {
+		select {
+		case <-f.wait(interval):
+		case <-f.done:
+			return
+		}
+		if f.now().After(req.expires) {
+			f.finish(handle, req, deviceExpiredToken, NewUser{})
+			return
+		}
+		token, errCode, err := f.requestToken(req.idpDeviceCode)
+		switch {
+		case err != nil:
+			// keep polling through transient errors until the request expires
+			log.Warn().Err(err).Msg("error polling the device token endpoint")
+		case errCode == deviceAuthPending:
+		case errCode == deviceSlowDown:
+			interval += 5 * time.Second
+			f.mu.Lock()
+			req.interval = interval
+			f.mu.Unlock()
+		case errCode == deviceExpiredToken:
+			f.finish(handle, req, deviceExpiredToken, NewUser{})
+			return
+		case errCode != "":
+			log.Warn().Str("error", errCode).Msg("device authorization failed")
+			f.finish(handle, req, deviceAccessDenied, NewUser{})
+			return
+		default:
+			f.provision(handle, req, token)
+			return
+		}
+	}
+}
+
+// provision creates the peer once the IdP has issued a token
+func (f *deviceFlow) provision(handle string, req *deviceRequest, token string) {
+	claims, policy, err := authorizeToken(token)
+	auditAuth(claimsActor(claims, req.newUser.actor.SourceIP), err)
+	if err != nil {
+		log.Warn().Err(err).Str("sub", claims.String("sub")).Msg("device flow token rejected")
+		f.finish(handle, req, deviceAccessDenied, NewUser{})
+		return
+	}
+	created, err := createUserFor(req.newUser, claims, policy)
+	if errors.Is(err, errForbidden) || errors.Is(err, errStaleLogin) {
+		log.Warn().Err(err).Msg("device flow request permission denied")
+		f.finish(handle, req, deviceAccessDenied, NewUser{})
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("error creating device flow user")
+		f.finish(handle, req, deviceServerError, NewUser{})
+		return
+	}
+	log.Info().Str("new user", created.ClientName).Str("sub", created.Subject).
+		Str("public key", created.PublicKey).Msg("created new user via device flow")
+	f.finish(handle, req, "", created)
+}
+
+// finish records the outcome of a request. Results nobody collects are
+// dropped once the request expires
+func (f *deviceFlow) finish(handle string, req *deviceRequest, status string, result NewUser) {
+	f.mu.Lock()
+	req.status = status
+	req.result = result
+	f.mu.Unlock()
+	time.AfterFunc(req.expires.Sub(f.now()), func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.requests[handle] == req {
+			delete(f.requests, handle)
+		}
+	})
+}
+
+// result returns the outcome of a request for wg2fa's client. The error code
+// is "" when the peer was provisioned. Finished requests are only returned
+// once
+func (f *deviceFlow) result(handle string) (NewUser, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	req, ok := f.requests[handle]
+	if !ok {
+		return NewUser{}, deviceInvalidGrant
+	}
+	if req.status == deviceAuthPending {
+		now := f.now()
+		tooSoon := now.Sub(req.lastPoll) < req.interval
+		req.lastPoll = now
+		if tooSoon {
+			return NewUser{}, deviceSlowDown
+		}
+		return NewUser{}, deviceAuthPending
+	}
+	delete(f.requests, handle)
+	return req.result, req.status
+}
+
+// requestToken asks the IdP's token endpoint for the device code's token. It
+// returns the access token, or the endpoint's error code
+func (f *deviceFlow) requestToken(deviceCode string) (string, string, error) {
+	form := url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"device_code": {deviceCode},
+		"client_id":   {f.clientID},
+	}
+	f.authenticate(form)
+	resp, err := f.httpClient.PostForm(f.tokenEndpoint, form)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	var tokenResp oauthTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", "", fmt.Errorf("couldn't decode token response (%s): %w", resp.Status, err)
+	}
+	if tokenResp.Error != "" {
+		return "", tokenResp.Error, nil
+	}
+	if resp.StatusCode != http.StatusOK || tokenResp.AccessToken == "" {
+		return "", "", fmt.Errorf("token endpoint returned %s without a token", resp.Status)
+	}
+	return tokenResp.AccessToken, "", nil
+}
+
+// authenticate adds the client secret to a request, for confidential clients
+func (f *deviceFlow) authenticate(form url.Values) {
+	if f.clientSecret != "" {
+		form.Set("client_secret", f.clientSecret)
+	}
+}
+
+// DeviceAuthorizeHandler starts a device flow login for a new user. The body
+// is the same as for /newuser
+func DeviceAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("Starting device authorize http handler")
+	var newUser NewUser
+	if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
+		log.Error().AnErr("error unmarshaling user", err)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if newUser.GenerateKey && newUser.PublicKey != "" {
+		log.Warn().Msg("device authorization with both a public key and generate_key")
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request", "error_description": "public_key and generate_key can't both be set"})
+		return
+	}
+	if err := checkNewUser(newUser); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+	// the device flow is for devices with their own key
+	if _, err := wgtypes.ParseKey(newUser.PublicKey); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request", "error_description": "invalid public key"})
+		return
+	}
+	newUser.actor.SourceIP = sourceIP(r)
+	if !deviceFlows.limiter.allow(newUser.actor.SourceIP) {
+		log.Warn().Str("ip", r.RemoteAddr).Msg("too many device authorizations from one address")
+		w.Header().Set("Retry-After", "60")
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": deviceSlowDown})
+		return
+	}
+	auth, err := deviceFlows.start(newUser)
+	if errors.Is(err, errTooManyDeviceFlows) {
+		log.Warn().Err(err).Msg("device authorization refused")
+		w.Header().Set("Retry-After", "60")
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "temporarily_unavailable"})
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("error starting device authorization")
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": deviceServerError})
+		return
+	}
+	log.Info().Str("ip", r.RemoteAddr).Str("client name", newUser.ClientName).Msg("started device authorization")
+	writeJSON(w, http.StatusOK, auth)
+}
+
+// DeviceTokenHandler is polled by device flow clients with their device_code.
+// Until the user approves it returns RFC 8628 errors, then the new user
+func DeviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	deviceCode := r.PostFormValue("device_code")
+	if deviceCode == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			DeviceCode string `json:"device_code"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		deviceCode = body.DeviceCode
+	}
+	if deviceCode == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	created, errCode := deviceFlows.result(deviceCode)
+	switch errCode {
+	case "":
+		writeJSON(w, http.StatusOK, created)
+	case deviceServerError:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": errCode})
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": errCode})
+	}
+}
+
+// randomToken returns 32 random bytes, base64url encoded
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
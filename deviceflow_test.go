@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockDeviceIdP adds RFC 8628 device authorization and token endpoints to a
+// stub issuer. Each device code is pending until the test approves or denies it
+type mockDeviceIdP struct {
+	iss *stubIssuer
+	mu  sync.Mutex
+	// states maps IdP device codes to pending, approved, denied or slow
+	states map[string]string
+	// claims are put in tokens issued for approved codes
+	claims map[string]interface{}
+	polls  int
+	forms  []url.Values
+}
+
+func newMockDeviceIdP(t *testing.T) *mockDeviceIdP {
+	m := &mockDeviceIdP{iss: newStubIssuer(t), states: make(map[string]string)}
+	m.claims = m.iss.claims()
+	m.iss.mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		m.forms = append(m.forms, r.PostForm)
+		code := "idp-device-code-" + string(rune('a'+len(m.states)))
+		m.states[code] = "pending"
+		m.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":      code,
+			"user_code":        "WDJB-MJHT",
+			"verification_url": m.iss.server.URL + "/activate",
+			"expires_in":       600,
+			"interval":         1,
+		})
+	})
+	m.iss.mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.polls++
+		m.forms = append(m.forms, r.PostForm)
+		if r.PostForm.Get("grant_type") != deviceCodeGrantType {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unsupported_grant_type"})
+			return
+		}
+		state := m.states[r.PostForm.Get("device_code")]
+		switch state {
+		case "approved":
+			json.NewEncoder(w).Encode(map[string]string{
+				"access_token": m.iss.sign(t, "RS256", "rsa1", m.claims),
+				"token_type":   "Bearer",
+			})
+			return
+		case "pending":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": deviceAuthPending})
+		case "slow":
+			m.states[r.PostForm.Get("device_code")] = "pending"
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": deviceSlowDown})
+		case "denied":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": deviceAccessDenied})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": deviceInvalidGrant})
+		}
+	})
+	return m
+}
+
+func (m *mockDeviceIdP) set(code, state string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states[code] = state
+}
+
+// useTestDeviceFlow wires up the verifier, wireguard client and device flow
+// globals against a mock IdP
+func useTestDeviceFlow(t *testing.T, dbName string) (*mockDeviceIdP, *fakeBackend) {
+	m := newMockDeviceIdP(t)
+	useTestVerifier(t, m.iss.config())
+	fb := useTestWGClient(t, dbName)
+	f, err := newDeviceFlow("client123", "", []string{"openid", "email"}, tokenVerifier.metadata)
+	if err != nil {
+		t.Fatalf("error creating device flow: %s", err)
+	}
+	// poll the mock IdP without waiting out the real interval
+	f.wait = func(time.Duration) <-chan time.Time { return time.After(5 * time.Millisecond) }
+	old := deviceFlows
+	deviceFlows = f
+	t.Cleanup(func() {
+		f.stop()
+		deviceFlows = old
+	})
+	return m, fb
+}
+
+func postDeviceToken(t *testing.T, router http.Handler, deviceCode string) (int, map[string]interface{}) {
+	form := url.Values{"device_code": {deviceCode}}
+	r := httptest.NewRequest("POST", "/device/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+func startDeviceLogin(t *testing.T, router http.Handler) deviceAuthResponse {
+	body := `{"client_name": "jumphost", "public_key": "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/device/authorize", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("device authorize returned %d: %s", w.Code, w.Body.String())
+	}
+	var auth deviceAuthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &auth); err != nil {
+		t.Fatalf("error decoding device authorization: %s", err)
+	}
+	return auth
+}
+
+// waitForDeviceResult polls wg2fa like a client would until the request is
+// no longer pending
+func waitForDeviceResult(t *testing.T, router http.Handler, deviceCode string) (int, map[string]interface{}) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		// space the polls out past the slow_down check
+		deviceFlows.mu.Lock()
+		for _, req := range deviceFlows.requests {
+			req.lastPoll = time.Time{}
+		}
+		deviceFlows.mu.Unlock()
+		status, body := postDeviceToken(t, router, deviceCode)
+		if body["error"] != deviceAuthPending {
+			return status, body
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("device request still pending")
+	return 0, nil
+}
+
+func TestDeviceFlowApproved(t *testing.T) {
+	m, fb := useTestDeviceFlow(t, "deviceapproved.db")
+	router := newRouter()
+	auth := startDeviceLogin(t, router)
+	if auth.UserCode != "WDJB-MJHT" || auth.VerificationURI != m.iss.server.URL+"/activate" {
+		t.Errorf("wrong device authorization %+v", auth)
+	}
+	if auth.DeviceCode == "" || strings.HasPrefix(auth.DeviceCode, "idp-device-code") {
+		t.Errorf("the IdP's device code shouldn't be handed out")
+	}
+	if m.forms[0].Get("client_id") != "client123" || m.forms[0].Get("scope") != "openid email" {
+		t.Errorf("wrong device authorization request %v", m.forms[0])
+	}
+	// the user hasn't approved yet
+	status, body := postDeviceToken(t, router, auth.DeviceCode)
+	if status != http.StatusBadRequest || body["error"] != deviceAuthPending {
+		t.Errorf("expected authorization_pending, got %d %v", status, body)
+	}
+	m.set("idp-device-code-a", "approved")
+	status, body = waitForDeviceResult(t, router, auth.DeviceCode)
+	if status != http.StatusOK {
+		t.Fatalf("expected the new user, got %d %v", status, body)
+	}
+	if body["sub"] != "00u1abcd" || body["wg_conf"] == "" {
+		t.Errorf("wrong new user %v", body)
+	}
+	if len(fb.peers["wg0"]) != 1 {
+		t.Errorf("peer wasn't provisioned")
+	}
+	// the result is only handed out once
+	status, body = postDeviceToken(t, router, auth.DeviceCode)
+	if status != http.StatusBadRequest || body["error"] != deviceInvalidGrant {
+		t.Errorf("expected invalid_grant on a second fetch, got %d %v", status, body)
+	}
+}
+
+func TestDeviceFlowDenied(t *testing.T) {
+	m, fb := useTestDeviceFlow(t, "devicedenied.db")
+	router := newRouter()
+	auth := startDeviceLogin(t, router)
+	m.set("idp-device-code-a", "denied")
+	status, body := waitForDeviceResult(t, router, auth.DeviceCode)
+	if status != http.StatusBadRequest || body["error"] != deviceAccessDenied {
+		t.Errorf("expected access_denied, got %d %v", status, body)
+	}
+	if len(fb.peers["wg0"]) != 0 {
+		t.Errorf("peer shouldn't be provisioned")
+	}
+}
+
+func TestDeviceFlowPolicyDenied(t *testing.T) {
+	m, fb := useTestDeviceFlow(t, "devicepolicy.db")
+	policies = loadTestPolicies(t)
+	defer func() { policies = nil }()
+	m.claims["groups"] = []string{"contractors"}
+	router := newRouter()
+	auth := startDeviceLogin(t, router)
+	m.set("idp-device-code-a", "approved")
+	status, body := waitForDeviceResult(t, router, auth.DeviceCode)
+	if status != http.StatusBadRequest || body["error"] != deviceAccessDenied {
+		t.Errorf("expected access_denied, got %d %v", status, body)
+	}
+	if len(fb.peers["wg0"]) != 0 {
+		t.Errorf("peer shouldn't be provisioned")
+	}
+}
+
+func TestDeviceFlowSlowDown(t *testing.T) {
+	m, _ := useTestDeviceFlow(t, "deviceslow.db")
+	router := newRouter()
+	auth := startDeviceLogin(t, router)
+	// clients polling wg2fa faster than the interval are told to slow down
+	postDeviceToken(t, router, auth.DeviceCode)
+	status, body := postDeviceToken(t, router, auth.DeviceCode)
+	if status != http.StatusBadRequest || body["error"] != deviceSlowDown {
+		t.Errorf("expected slow_down, got %d %v", status, body)
+	}
+	// and wg2fa backs off when the IdP says so
+	m.set("idp-device-code-a", "slow")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deviceFlows.mu.Lock()
+		interval := deviceFlows.requests[auth.DeviceCode].interval
+		deviceFlows.mu.Unlock()
+		if interval == 6*time.Second {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("poll interval wasn't increased after slow_down")
+}
+
+func TestDeviceFlowRejectsBadPublicKey(t *testing.T) {
+	useTestDeviceFlow(t, "devicebadkey.db")
+	w := httptest.NewRecorder()
+	body := `{"client_name": "jumphost", "public_key": "nope"}`
+	newRouter().ServeHTTP(w, httptest.NewRequest("POST", "/device/authorize", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a bad public key, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	body = `{"client_name": "jumphost", "public_key": "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=", "generate_key": true}`
+	newRouter().ServeHTTP(w, httptest.NewRequest("POST", "/device/authorize", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "generate_key") {
+		t.Errorf("expected a 400 for a public key with generate_key, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDeviceFlowLimits(t *testing.T) {
+	m, _ := useTestDeviceFlow(t, "devicelimits.db")
+	router := newRouter()
+	deviceFlows.maxPending = 2
+	startDeviceLogin(t, router)
+	startDeviceLogin(t, router)
+	body := `{"client_name": "jumphost", "public_key": "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/device/authorize", strings.NewReader(body)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 once the pending requests are capped, got %d", w.Code)
+	}
+	m.mu.Lock()
+	if len(m.states) != 2 {
+		t.Errorf("the IdP was asked for %d authorizations", len(m.states))
+	}
+	m.mu.Unlock()
+
+	// each source IP is limited on its own, the refused request counts too
+	deviceFlows.maxPending = maxPendingDeviceFlows
+	for i := 3; i < deviceAuthorizeLimit; i++ {
+		startDeviceLogin(t, router)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/device/authorize", strings.NewReader(body)))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a 429 past the per address limit, got %d", w.Code)
+	}
+	r := httptest.NewRequest("POST", "/device/authorize", strings.NewReader(body))
+	r.RemoteAddr = "203.0.113.7:40000"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("another address was limited too: %d", w.Code)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// templates for the client config formats other than wg-quick
+var nmConnectionTemplatePath = filepath.Join(".", "text_templates", "client_config.nmconnection")
+var netdevTemplatePath = filepath.Join(".", "text_templates", "client_config.netdev")
+var networkTemplatePath = filepath.Join(".", "text_templates", "client_config.network")
+
+// client config output formats, picked with the format parameter
+const (
+	formatWGQuick      = "wg-quick"
+	formatJSON         = "json"
+	formatNMConnection = "nmconnection"
+	formatSystemd      = "systemd"
+)
+
+// configFormat is a way of returning a new user's client config
+type configFormat struct {
+	name string
+	// mediaType selects the format through the Accept header
+	mediaType string
+	// complete formats can't carry the private key placeholder, so they're
+	// only available with server generated keys
+	complete bool
+	write    func(w http.ResponseWriter, user NewUser) error
+}
+
+// configFormats are the client config formats, in order of preference when
+// an Accept header allows several
+var configFormats = []configFormat{
+	{name: formatJSON, mediaType: "application/json", write: writeConfigJSON},
+	{name: formatWGQuick, mediaType: "text/plain", write: writeConfigWGQuick},
+	{name: formatNMConnection, mediaType: "application/x-nmconnection", write: writeConfigNMConnection},
+	{name: formatSystemd, mediaType: "multipart/mixed", write: writeConfigSystemd},
+	{name: formatQRPNG, mediaType: "image/png", complete: true, write: func(w http.ResponseWriter, user NewUser) error {
+		return writeConfigQR(w, formatQRPNG, user.WGConf)
+	}},
+	{name: formatQRSVG, mediaType: "image/svg+xml", complete: true, write: func(w http.ResponseWriter, user NewUser) error {
+		return writeConfigQR(w, formatQRSVG, user.WGConf)
+	}},
+}
+
+// requestedConfigFormat picks the client config format for a request. The
+// format parameter wins over the Accept header, and JSON is the default when
+// neither names a known format
+func requestedConfigFormat(r *http.Request) (configFormat, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, f := range configFormats {
+			if f.name == name {
+				return f, nil
+			}
+		}
+		return configFormat{}, errors.New("unknown format " + name)
+	}
+	for _, mediaType := range acceptedMediaTypes(r.Header.Get("Accept")) {
+		for _, f := range configFormats {
+			if f.mediaType == mediaType {
+				return f, nil
+			}
+		}
+	}
+	return configFormats[0], nil
+}
+
+// acceptedMediaTypes returns the media types in an Accept header, most
+// preferred first. Wildcards and types with q=0 are left out
+func acceptedMediaTypes(accept string) []string {
+	type accepted struct {
+		mediaType string
+		q         float64
+	}
+	var types []accepted
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || strings.HasSuffix(mediaType, "/*") {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			types = append(types, accepted{mediaType, q})
+		}
+	}
+	sort.SliceStable(types, func(i, j int) bool { return types[i].q > types[j].q })
+	mediaTypes := make([]string, len(types))
+	for i, t := range types {
+		mediaTypes[i] = t.mediaType
+	}
+	return mediaTypes
+}
+
+// clientConfigJSON is a client config as a JSON object
+type clientConfigJSON struct {
+	Interface clientInterfaceJSON `json:"interface"`
+	Peer      clientPeerJSON      `json:"peer"`
+}
+
+type clientInterfaceJSON struct {
+	// PrivateKey is only set for server generated keys
+	PrivateKey string   `json:"private_key,omitempty"`
+	Address    string   `json:"address"`
+	DNS        []string `json:"dns"`
+	MTU        int      `json:"mtu,omitempty"`
+}
+
+type clientPeerJSON struct {
+	PublicKey    string   `json:"public_key"`
+	PresharedKey string   `json:"preshared_key"`
+	Endpoint     string   `json:"endpoint"`
+	AllowedIPs   []string `json:"allowed_ips"`
+	// PersistentKeepalive is in seconds
+	PersistentKeepalive int `json:"persistent_keepalive,omitempty"`
+}
+
+// newUserResponse is the JSON response to a new user request
+type newUserResponse struct {
+	NewUser
+	Config *clientConfigJSON `json:"config,omitempty"`
+}
+
+func newClientConfigJSON(ccd *clientConfData) *clientConfigJSON {
+	if ccd == nil {
+		return nil
+	}
+	return &clientConfigJSON{
+		Interface: clientInterfaceJSON{
+			PrivateKey: ccd.PrivateKey,
+			Address:    ccd.ClientIP,
+			DNS:        splitList(ccd.DNS),
+			MTU:        ccd.MTU,
+		},
+		Peer: clientPeerJSON{
+			PublicKey:           ccd.ServerPubKey,
+			PresharedKey:        ccd.PSK,
+			Endpoint:            ccd.ServerHostname,
+			AllowedIPs:          splitList(ccd.AllowedIPs),
+			PersistentKeepalive: ccd.Keepalive,
+		},
+	}
+}
+
+// bufferedResponse holds a response until it has been rendered completely,
+// so a format that fails halfway doesn't send half a config
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+// flush sends the buffered response to w
+func (b *bufferedResponse) flush(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+// setConfigHeaders sets the headers for a client config download
+func setConfigHeaders(w http.ResponseWriter, user NewUser, contentType, fileName string) {
+	w.Header().Set("Content-Type", contentType)
+	if fileName != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	}
+	if user.GenerateKey {
+		// the config holds a private key
+		w.Header().Set("Cache-Control", "no-store")
+	}
+}
+
+func writeConfigJSON(w http.ResponseWriter, user NewUser) error {
+	body, err := json.Marshal(newUserResponse{NewUser: user, Config: newClientConfigJSON(user.conf)})
+	if err != nil {
+		return err
+	}
+	setConfigHeaders(w, user, "application/json", "")
+	w.Write(body)
+	return nil
+}
+
+func writeConfigWGQuick(w http.ResponseWriter, user NewUser) error {
+	setConfigHeaders(w, user, "text/plain; charset=utf-8", "wg2fa.conf")
+	w.Write([]byte(user.WGConf))
+	return nil
+}
+
+func writeConfigNMConnection(w http.ResponseWriter, user NewUser) error {
+	conf, err := buildClientConfigFromTemplate(nmConnectionTemplatePath, user.conf)
+	if err != nil {
+		return err
+	}
+	setConfigHeaders(w, user, "application/x-nmconnection", "wg2fa.nmconnection")
+	w.Write([]byte(conf))
+	return nil
+}
+
+// writeConfigSystemd writes the systemd-networkd .netdev and .network files
+// as the two parts of a multipart response
+func writeConfigSystemd(w http.ResponseWriter, user NewUser) error {
+	netdev, err := buildClientConfigFromTemplate(netdevTemplatePath, user.conf)
+	if err != nil {
+		return err
+	}
+	network, err := buildClientConfigFromTemplate(networkTemplatePath, user.conf)
+	if err != nil {
+		return err
+	}
+	mw := multipart.NewWriter(w)
+	setConfigHeaders(w, user, "multipart/mixed; boundary="+mw.Boundary(), "")
+	for _, file := range []struct{ name, body string }{
+		{"wg2fa.netdev", netdev},
+		{"wg2fa.network", network},
+	} {
+		part, err := mw.CreatePart(map[string][]string{
+			"Content-Type":        {"text/plain; charset=utf-8"},
+			"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": file.name})},
+		})
+		if err != nil {
+			return err
+		}
+		part.Write([]byte(file.body))
+	}
+	return mw.Close()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testClientConfData() *clientConfData {
+	return &clientConfData{
+		ClientIP:       "10.0.0.5/24",
+		DNS:            "8.8.8.8, 8.8.4.4",
+		ServerPubKey:   "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=",
+		PSK:            "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+		ServerHostname: "example.com:51820",
+		AllowedIPs:     "10.0.0.0/8, 192.168.1.0/24",
+		Keepalive:      25,
+		MTU:            1380,
+	}
+}
+
+func TestClientConfigTemplates(t *testing.T) {
+	ccd := testClientConfData()
+	expected := map[string][]string{
+		nmConnectionTemplatePath: {
+			"type=wireguard\n",
+			"private-key=CLIENT_PRIVATE_KEY\nmtu=1380\n",
+			"persistent-keepalive=25\n",
+			"[wireguard-peer.i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=]\n",
+			"allowed-ips=10.0.0.0/8;192.168.1.0/24;\n",
+			"address1=10.0.0.5/24\n",
+			"dns=8.8.8.8;8.8.4.4;\n",
+		},
+		netdevTemplatePath: {
+			"Kind=wireguard\nMTUBytes=1380\n",
+			"PersistentKeepalive=25\n",
+			"PrivateKey=CLIENT_PRIVATE_KEY\n",
+			"Endpoint=example.com:51820\n",
+			"AllowedIPs=10.0.0.0/8, 192.168.1.0/24\n",
+		},
+		networkTemplatePath: {
+			"Address=10.0.0.5/24\n",
+			"DNS=8.8.8.8\nDNS=8.8.4.4\n",
+			"[Route]\nDestination=10.0.0.0/8\n",
+			"[Route]\nDestination=192.168.1.0/24\n",
+		},
+	}
+	for path, lines := range expected {
+		conf, err := buildClientConfigFromTemplate(path, ccd)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		for _, line := range lines {
+			if !strings.Contains(conf, line) {
+				t.Errorf("%s: missing %q in\n%s", path, line, conf)
+			}
+		}
+	}
+	for _, path := range []string{netdevTemplatePath, networkTemplatePath} {
+		if conf, _ := buildClientConfigFromTemplate(path, ccd); strings.Contains(conf, "FirewallMark") {
+			t.Errorf("%s: split tunnel has policy routing:\n%s", path, conf)
+		}
+	}
+	if conf, _ := buildClientConfigFromTemplate(nmConnectionTemplatePath, ccd); !strings.Contains(conf, "[ipv6]\nmethod=ignore\n") {
+		t.Errorf("IPv4 only routes should leave IPv6 alone:\n%s", conf)
+	}
+	// a full tunnel routes through its own table, except the tunnel's packets
+	ccd.AllowedIPs = "0.0.0.0/0, ::/0, 192.168.1.0/24"
+	full := map[string][]string{
+		netdevTemplatePath: {"FirewallMark=51820\n"},
+		networkTemplatePath: {
+			"[RoutingPolicyRule]\nTable=main\nSuppressPrefixLength=0\nPriority=9\nFamily=both\n",
+			"[RoutingPolicyRule]\nFirewallMark=51820\nInvertRule=true\nTable=51820\nPriority=10\nFamily=both\n",
+			"[Route]\nDestination=0.0.0.0/0\nTable=51820\n",
+			"[Route]\nDestination=::/0\nTable=51820\n",
+			"[Route]\nDestination=192.168.1.0/24\n\n",
+		},
+		nmConnectionTemplatePath: {"[ipv6]\nmethod=link-local\n"},
+	}
+	for path, lines := range full {
+		conf, _ := buildClientConfigFromTemplate(path, ccd)
+		for _, line := range lines {
+			if !strings.Contains(conf, line) {
+				t.Errorf("%s: missing %q in full tunnel\n%s", path, line, conf)
+			}
+		}
+	}
+	ccd.AllowedIPs = "0.0.0.0/0"
+	if conf, _ := buildClientConfigFromTemplate(networkTemplatePath, ccd); !strings.Contains(conf, "Family=ipv4\n") {
+		t.Errorf("IPv4 full tunnel should only policy route IPv4:\n%s", conf)
+	}
+	// a generated private key is filled in and no routes means none are written
+	ccd.PrivateKey = "cHJpdmF0ZWtleXByaXZhdGVrZXlwcml2YXRla2V5cHI="
+	ccd.AllowedIPs = ""
+	conf, _ := buildClientConfigFromTemplate(netdevTemplatePath, ccd)
+	if !strings.Contains(conf, "PrivateKey="+ccd.PrivateKey) || strings.Contains(conf, "AllowedIPs") {
+		t.Errorf("wrong netdev for a generated key without routes:\n%s", conf)
+	}
+	conf, _ = buildClientConfigFromTemplate(networkTemplatePath, ccd)
+	if strings.Contains(conf, "[Route]") {
+		t.Errorf("no routes expected:\n%s", conf)
+	}
+}
+
+func TestRequestedConfigFormat(t *testing.T) {
+	cases := []struct {
+		target string
+		accept string
+		format string
+	}{
+		{"/newuser", "", formatJSON},
+		{"/newuser", "*/*", formatJSON},
+		{"/newuser", "text/html", formatJSON},
+		{"/newuser", "text/plain", formatWGQuick},
+		{"/newuser", "application/json;q=0.5, application/x-nmconnection", formatNMConnection},
+		{"/newuser", "text/plain;q=0, multipart/mixed;q=0.1", formatSystemd},
+		{"/newuser?format=systemd", "application/json", formatSystemd},
+		{"/newuser?format=qr-svg", "", formatQRSVG},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", c.target, nil)
+		r.Header.Set("Accept", c.accept)
+		f, err := requestedConfigFormat(r)
+		if err != nil || f.name != c.format {
+			t.Errorf("%s with Accept %q: expected %s, got %s (%v)", c.target, c.accept, c.format, f.name, err)
+		}
+	}
+	if _, err := requestedConfigFormat(httptest.NewRequest("POST", "/newuser?format=ovpn", nil)); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
+
+func TestNewUserHandlerFormats(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	useTestWGClient(t, "handlerformats.db")
+	token := "Bearer " + iss.sign(t, "RS256", "rsa1", iss.claims())
+	post := func(target, accept, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r.Header.Set("Authorization", token)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected a 200, got %d: %s", target, w.Code, w.Body.String())
+		}
+		return w
+	}
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	body := `{"client_name": "laptop", "public_key": "` + pubkey + `"}`
+	// the device stays enrolled, so logging in again returns the same config.
+	// It's deactivated in between since the same token can't renew it
+	deactivate := func() {
+		if err := currentClient().removeUser(pubkey, removeReasonIdle, watchdogActor); err != nil {
+			t.Fatalf("error deactivating the peer: %s", err)
+		}
+	}
+
+	// the default JSON envelope carries the structured config as well
+	w := post("/newuser", "", body)
+	var created struct {
+		WGConf string            `json:"wg_conf"`
+		Config *clientConfigJSON `json:"config"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.Config == nil {
+		t.Fatalf("no config in the response: %s", w.Body.String())
+	}
+	if !strings.Contains(created.WGConf, "Address = "+created.Config.Interface.Address) ||
+		created.Config.Interface.PrivateKey != "" || len(created.Config.Interface.DNS) == 0 {
+		t.Errorf("structured config doesn't match wg_conf: %+v", created.Config)
+	}
+
+	deactivate()
+	w = post("/newuser", "text/plain", body)
+	if w.Body.String() != created.WGConf || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("expected the wg-quick config, got %s:\n%s", w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	deactivate()
+	w = post("/newuser?format=nmconnection", "", body)
+	if !strings.Contains(w.Body.String(), "address1="+created.Config.Interface.Address) ||
+		!strings.Contains(w.Header().Get("Content-Disposition"), "wg2fa.nmconnection") {
+		t.Errorf("expected a NetworkManager keyfile, got:\n%s", w.Body.String())
+	}
+
+	// a generated key pair is in every file of the systemd-networkd pair
+	w = post("/newuser?format=systemd", "", `{"client_name": "server", "generate_key": true}`)
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected an uncached multipart response, got %s", w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	files := make(map[string]string)
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(part)
+		files[part.FileName()] = string(content)
+	}
+	if !strings.Contains(files["wg2fa.netdev"], "[WireGuard]\nPrivateKey=") ||
+		strings.Contains(files["wg2fa.netdev"], clientPrivateKeyPlaceholder) ||
+		!strings.Contains(files["wg2fa.network"], "[Match]\nName=wg2fa\n") {
+		t.Errorf("wrong systemd-networkd files: %v", files)
+	}
+}
+
+func TestNewUserHandlerRenderFailure(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	fb := useTestWGClient(t, "handlerrenderfailure.db")
+	old := nmConnectionTemplatePath
+	nmConnectionTemplatePath = filepath.Join(".", "test", "missing.nmconnection")
+	defer func() { nmConnectionTemplatePath = old }()
+	r := httptest.NewRequest("POST", "/newuser?format=nmconnection", strings.NewReader(`{"client_name": "server", "generate_key": true}`))
+	r.Header.Set("Authorization", "Bearer "+iss.sign(t, "RS256", "rsa1", iss.claims()))
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError || w.Body.Len() != 0 {
+		t.Fatalf("expected an empty 500, got %d: %s", w.Code, w.Body.String())
+	}
+	// the generated private key is gone, so is the peer
+	fb.mu.Lock()
+	peers := len(fb.peers["wg0"])
+	fb.mu.Unlock()
+	clients, _ := getClients()
+	devices, _ := getDevices()
+	if peers != 0 || len(clients) != 0 || len(devices) != 0 {
+		t.Errorf("peer with a lost key was kept: %d peers, %d clients, %d devices", peers, len(clients), len(devices))
+	}
+}
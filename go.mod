@@ -5,6 +5,9 @@ go 1.15
 require (
 	github.com/gorilla/mux v1.8.0
 	github.com/mattn/go-sqlite3 v1.14.6
-	github.com/okta/okta-jwt-verifier-golang v1.0.0
 	github.com/rs/zerolog v1.20.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b // indirect
+	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200205215550-e35592f146e4
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// loginTimeout is how long `wg2fa login` waits for the user to log in
+const loginTimeout = 5 * time.Minute
+
+// loginClient is the client side of `wg2fa login`. It logs the user in,
+// requests a peer from a wg2fa server and writes a ready to use config. The
+// private key is generated locally and is never sent to the server
+type loginClient struct {
+	// server is the wg2fa base URL
+	server     string
+	httpClient *http.Client
+	// out is where instructions for the user are written
+	out io.Writer
+	// openBrowser sends the user to a login URL
+	openBrowser func(string)
+	// wait is time.After, swapped out in tests
+	wait func(time.Duration) <-chan time.Time
+}
+
+func newLoginClient(server string, out io.Writer) *loginClient {
+	c := &loginClient{
+		server:     strings.TrimSuffix(server, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		out:        out,
+		wait:       time.After,
+	}
+	c.openBrowser = func(u string) {
+		fmt.Fprintf(c.out, "Open this URL in your browser to log in:\n\n  %s\n\n", u)
+	}
+	return c
+}
+
+// runLogin runs the login subcommand with its arguments
+func runLogin(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	serverFlag := fs.String("server", "", "The wg2fa server URL, e.g. https://vpn.example.com")
+	nameFlag := fs.String("name", "", "The name of this device, defaults to the hostname")
+	profileFlag := fs.String("profile", "", "The tunnel profile to ask for, e.g. full-tunnel. Defaults to the policy's")
+	outFlag := fs.String("o", "wg2fa.conf", "The path to write the wireguard config to")
+	forceFlag := fs.Bool("force", false, "Overwrite the config if it exists")
+	qrFlag := fs.Bool("qr", false, "Also print the config as a QR code, for the WireGuard mobile apps")
+	browserFlag := fs.Bool("browser", false, "Log in with a browser on this machine instead of the device flow")
+	issuerFlag := fs.String("iss", "", "The oauth issuer URL, for -browser")
+	clientIDFlag := fs.String("cid", "", "The client ID for OAuth, for -browser")
+	scopesFlag := fs.String("scopes", "openid profile email", "Space separated list of scopes, for -browser")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *serverFlag == "" {
+		return errors.New("-server is required")
+	}
+	if *browserFlag && (*issuerFlag == "" || *clientIDFlag == "") {
+		return errors.New("-browser requires -iss and -cid")
+	}
+	if !*forceFlag {
+		if _, err := os.Stat(*outFlag); err == nil {
+			return fmt.Errorf("%s already exists, use -force to overwrite it", *outFlag)
+		}
+	}
+	name := *nameFlag
+	if name == "" {
+		hostname, _ := os.Hostname()
+		name = clientNameFrom(hostname)
+	}
+	privkey, pubkey, err := createWGKey()
+	if err != nil {
+		return fmt.Errorf("couldn't generate a key: %w", err)
+	}
+	c := newLoginClient(*serverFlag, os.Stderr)
+	newUser := NewUser{ClientName: name, PublicKey: pubkey, Profile: *profileFlag}
+	var created NewUser
+	if *browserFlag {
+		token, err := c.browserLogin(*issuerFlag, *clientIDFlag, strings.Fields(*scopesFlag))
+		if err != nil {
+			return err
+		}
+		created, err = c.requestNewUser(token, newUser)
+		if err != nil {
+			return err
+		}
+	} else {
+		created, err = c.deviceLogin(newUser)
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeClientConfig(*outFlag, created.WGConf, privkey); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Wrote the config for %s to %s\n", created.ClientName, *outFlag)
+	if *qrFlag {
+		qr, err := configQRTerminal(strings.Replace(created.WGConf, clientPrivateKeyPlaceholder, privkey, 1))
+		if err != nil {
+			return err
+		}
+		fmt.Print(qr)
+	}
+	return nil
+}
+
+// clientNameFrom makes a valid client_name from a hostname, replacing the
+// characters a client_name can't have with '-'
+func clientNameFrom(hostname string) string {
+	name := strings.Map(func(r rune) rune {
+		if clientNameRegex.MatchString(string(r)) {
+			return r
+		}
+		return '-'
+	}, hostname)
+	if name == "" {
+		return "device"
+	}
+	return name
+}
+
+// deviceLogin requests a peer with the server's device flow, showing the user
+// where to approve it
+func (c *loginClient) deviceLogin(newUser NewUser) (NewUser, error) {
+	var auth deviceAuthResponse
+	if err := c.postJSON("/device/authorize", newUser, &auth); err != nil {
+		return NewUser{}, fmt.Errorf("couldn't start the device login: %w", err)
+	}
+	if auth.VerificationURIComplete != "" {
+		fmt.Fprintf(c.out, "Open %s to log in, and check the code is %s\n", auth.VerificationURIComplete, auth.UserCode)
+	} else {
+		fmt.Fprintf(c.out, "Open %s and enter the code %s to log in\n", auth.VerificationURI, auth.UserCode)
+	}
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDevicePollInterval
+	}
+	expires := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	for time.Now().Before(expires) {
+		<-c.wait(interval)
+		resp, err := c.httpClient.PostForm(c.server+"/device/token", url.Values{"device_code": {auth.DeviceCode}})
+		if err != nil {
+			return NewUser{}, err
+		}
+		var body struct {
+			NewUser
+			Error string `json:"error"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			return NewUser{}, fmt.Errorf("couldn't decode device token response (%s): %w", resp.Status, err)
+		}
+		switch body.Error {
+		case "":
+			if resp.StatusCode != http.StatusOK {
+				return NewUser{}, fmt.Errorf("device token request returned %s", resp.Status)
+			}
+			return body.NewUser, nil
+		case deviceAuthPending:
+		case deviceSlowDown:
+			interval += 5 * time.Second
+		case deviceAccessDenied:
+			return NewUser{}, errors.New("the login was denied")
+		default:
+			return NewUser{}, fmt.Errorf("device login failed: %s", body.Error)
+		}
+	}
+	return NewUser{}, errors.New("the login expired, please start again")
+}
+
+// browserLogin logs in with the authorization code flow and PKCE, catching
+// the redirect on a loopback port (RFC 8252). It returns the access token
+func (c *loginClient) browserLogin(issuer, clientID string, scopes []string) (string, error) {
+	var metadata providerMetadata
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := c.getJSON(discoveryURL, &metadata); err != nil {
+		return "", fmt.Errorf("discovery failed: %w", err)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" {
+		return "", errors.New("issuer doesn't support the authorization code grant")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	// the portal's login does the PKCE and state bookkeeping
+	p := &loginPortal{
+		clientID:              clientID,
+		scopes:                scopes,
+		authorizationEndpoint: metadata.AuthorizationEndpoint,
+		tokenEndpoint:         metadata.TokenEndpoint,
+		redirectURL:           "http://" + listener.Addr().String() + "/callback",
+		httpClient:            c.httpClient,
+		now:                   time.Now,
+		maxLogins:             1,
+		logins:                make(map[string]portalLogin),
+	}
+	loginURL, state, err := p.loginURL()
+	if err != nil {
+		return "", err
+	}
+	type callback struct{ code, err string }
+	callbacks := make(chan callback, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/callback" || q.Get("state") != state {
+			http.NotFound(w, r)
+			return
+		}
+		cb := callback{code: q.Get("code"), err: q.Get("error")}
+		if cb.err != "" {
+			fmt.Fprintln(w, "Login failed, you can close this window.")
+		} else {
+			fmt.Fprintln(w, "Logged in, you can close this window.")
+		}
+		select {
+		case callbacks <- cb:
+		default:
+		}
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+	c.openBrowser(loginURL)
+	var cb callback
+	select {
+	case cb = <-callbacks:
+	case <-c.wait(loginTimeout):
+		return "", errors.New("timed out waiting for the login")
+	}
+	if cb.err != "" {
+		return "", fmt.Errorf("login failed: %s", cb.err)
+	}
+	p.mu.Lock()
+	login := p.logins[state]
+	p.mu.Unlock()
+	return p.exchange(cb.code, login.codeVerifier)
+}
+
+// requestNewUser creates the peer with an access token
+func (c *loginClient) requestNewUser(token string, newUser NewUser) (NewUser, error) {
+	body, err := json.Marshal(newUser)
+	if err != nil {
+		return NewUser{}, err
+	}
+	req, err := http.NewRequest("POST", c.server+"/newuser", bytes.NewReader(body))
+	if err != nil {
+		return NewUser{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return NewUser{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return NewUser{}, fmt.Errorf("newuser returned %s", resp.Status)
+	}
+	var created NewUser
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return NewUser{}, fmt.Errorf("couldn't decode the new user: %w", err)
+	}
+	return created, nil
+}
+
+func (c *loginClient) postJSON(path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Post(c.server+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s returned %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *loginClient) getJSON(url string, out interface{}) error {
+	resp, err := c.httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// writeClientConfig fills the private key into a config from the server and
+// writes it where only the user can read it
+func writeClientConfig(path, conf, privkey string) error {
+	if !strings.Contains(conf, clientPrivateKeyPlaceholder) {
+		return errors.New("the server's config has no private key placeholder to fill in")
+	}
+	conf = strings.Replace(conf, clientPrivateKeyPlaceholder, privkey, 1)
+	if err := ioutil.WriteFile(path, []byte(conf), 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file it overwrites
+	return os.Chmod(path, 0600)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginDeviceFlow(t *testing.T) {
+	m, fb := useTestDeviceFlow(t, "logindevice.db")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	var out bytes.Buffer
+	c := newLoginClient(srv.URL+"/", &out)
+	// the user approves as soon as the client starts polling
+	c.wait = func(time.Duration) <-chan time.Time {
+		m.set("idp-device-code-a", "approved")
+		return time.After(5 * time.Millisecond)
+	}
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	created, err := c.deviceLogin(NewUser{ClientName: "jumphost", PublicKey: pubkey})
+	if err != nil {
+		t.Fatalf("device login failed: %s", err)
+	}
+	if !strings.Contains(out.String(), "WDJB-MJHT") {
+		t.Errorf("user code wasn't shown: %s", out.String())
+	}
+	if created.PublicKey != pubkey || created.WGConf == "" {
+		t.Errorf("wrong new user %+v", created)
+	}
+	if len(fb.peers["wg0"]) != 1 {
+		t.Errorf("peer wasn't provisioned")
+	}
+}
+
+func TestLoginBrowser(t *testing.T) {
+	m := newMockCodeIdP(t)
+	// the IdP logs the user straight in and redirects back to the client
+	m.iss.mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		callback := m.approve(t, r.URL.String())
+		http.Redirect(w, r, r.URL.Query().Get("redirect_uri")+"?"+callback.Encode(), http.StatusFound)
+	})
+	useTestVerifier(t, m.iss.config())
+	useTestWGClient(t, "loginbrowser.db")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	c := newLoginClient(srv.URL, ioutil.Discard)
+	c.openBrowser = func(u string) {
+		go func() {
+			resp, err := http.Get(u)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	token, err := c.browserLogin(m.iss.server.URL, "client123", []string{"openid"})
+	if err != nil {
+		t.Fatalf("browser login failed: %s", err)
+	}
+	redirect, _ := url.Parse(m.forms[0].Get("redirect_uri"))
+	if redirect.Scheme != "http" || !strings.HasPrefix(redirect.Host, "127.0.0.1:") {
+		t.Errorf("redirect %s isn't a loopback address", redirect)
+	}
+	created, err := c.requestNewUser(token, NewUser{ClientName: "laptop", PublicKey: "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="})
+	if err != nil {
+		t.Fatalf("error requesting new user: %s", err)
+	}
+	if created.Subject != "00u1abcd" {
+		t.Errorf("peer isn't owned by the logged in user: %+v", created)
+	}
+	// a bad token is refused
+	if _, err := c.requestNewUser("not.a.token", NewUser{ClientName: "laptop"}); err == nil {
+		t.Errorf("expected an error for a bad token")
+	}
+}
+
+func TestWriteClientConfig(t *testing.T) {
+	path := filepath.Join(".", "test", "login.conf")
+	defer os.Remove(path)
+	conf := "[Interface]\nPrivateKey = CLIENT_PRIVATE_KEY\nAddress = 10.0.0.2/24\n"
+	if err := writeClientConfig(path, conf, "cHJpdmF0ZQ=="); err != nil {
+		t.Fatalf("error writing config: %s", err)
+	}
+	written, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(written), "PrivateKey = cHJpdmF0ZQ==\n") {
+		t.Errorf("private key wasn't filled in:\n%s", written)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("config should only be readable by the user")
+	}
+	if err := writeClientConfig(path, "[Interface]\n", "cHJpdmF0ZQ=="); err == nil {
+		t.Errorf("expected an error for a config without a placeholder")
+	}
+}
+
+func TestClientNameFrom(t *testing.T) {
+	cases := map[string]string{
+		"MacBook-Pro":       "MacBook-Pro",
+		"Bob's MacBook Pro": "Bob-s-MacBook-Pro",
+		"build01.example":   "build01.example",
+		"":                  "device",
+	}
+	for hostname, expected := range cases {
+		name := clientNameFrom(hostname)
+		if name != expected {
+			t.Errorf("%q: expected %q, got %q", hostname, expected, name)
+		}
+		if checkNewUser(NewUser{ClientName: name, GenerateKey: true}) != nil {
+			t.Errorf("%q isn't a valid client name", name)
+		}
+	}
+}
@@ -1,36 +1,43 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
-	jwtverifier "github.com/okta/okta-jwt-verifier-golang"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 var wgclient WGClient
 var clientID string
-var issuer string
+var tokenVerifier *TokenVerifier
+var policies *PolicySet
+var watchdogConfig *removeClientConfig
+
+// adminClaims are claim=value pairs, any of which allows access to the peer
+// admin API
+var adminClaims map[string]string
 var disableAuth = false
 
 // NewUserHandler accepts POSTs of new user objects and creates a new wireguard user.
-// The returned wireguard config will require the caller to replace CLIENT_PRIVATE_KEY
-// with their private key
+// The peer is owned by the identity in the bearer token, client_name is only a
+// label for the device. Unless generate_key is set, the returned wireguard
+// config will require the caller to replace CLIENT_PRIVATE_KEY with their
+// private key, `wg2fa login` does that for them. With ?format=qr-png or qr-svg
+// the complete config of a generated key is returned as a QR code instead
 func NewUserHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug().Msg("Starting New User http handler")
-	btoken := r.Header.Get("Bearer")
-	if !disableAuth && isAuthenticated(btoken) {
-		log.Warn().Str("ip", r.RemoteAddr).Msg("request permission denied")
-		w.WriteHeader(http.StatusForbidden)
-		return
-	} else if disableAuth {
-		log.Warn().Msg("Auth disabled! Allowing request")
-	}
 	reqbody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Error().AnErr("error reading from body", err)
@@ -44,20 +51,95 @@ func NewUserHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	createdUser, err := wgclient.newUser(newUser)
+	if newUser.GenerateKey && newUser.PublicKey != "" {
+		log.Warn().Msg("new user request with both a public key and generate_key")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	format, err := requestedConfigFormat(r)
 	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	// only configs with a server generated key are complete
+	if format.complete && !newUser.GenerateKey {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": errIncompleteConfig.Error()})
+		return
+	}
+	claims, _ := claimsFromContext(r.Context())
+	newUser.actor.SourceIP = sourceIP(r)
+	createdUser, err := createUserFor(newUser, claims, policyFromContext(r.Context()))
+	if errors.Is(err, errForbidden) {
+		log.Warn().Str("ip", r.RemoteAddr).Err(err).Msg("request permission denied")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if errors.Is(err, errInvalidUser) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	} else if errors.Is(err, errStaleLogin) {
+		log.Warn().Str("ip", r.RemoteAddr).Str("public key", newUser.PublicKey).Msg("renewal with a token from before the last renewal")
+		authChallenge(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	} else if err != nil {
 		log.Error().Str("error", err.Error()).Msg("Error creating new user")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	jsonNewUser, err := json.Marshal(createdUser)
+	log.Info().Str("new user", createdUser.ClientName).Str("sub", createdUser.Subject).
+		Str("email", createdUser.Email).Str("public key", createdUser.PublicKey).
+		Bool("server generated key", createdUser.GenerateKey).Msg("created new user")
+	buf := newBufferedResponse()
+	if err := format.write(buf, createdUser); err != nil {
+		log.Error().Str("format", format.name).AnErr("error writing client config", err)
+		discardUser(createdUser)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	buf.flush(w)
+}
+
+// discardUser undoes creating a user whose config couldn't be returned. A
+// server generated private key is lost with the response, so the device is
+// revoked. A pasted key is kept, as sending it again returns the same config
+func discardUser(created NewUser) {
+	if !created.GenerateKey {
+		return
+	}
+	if err := currentClient().revokeDevice(created.PublicKey, created.actor); err != nil {
+		log.Error().Err(err).Str("pubkey", created.PublicKey).Msg("error revoking device with a lost key")
+	}
+}
+
+// createUserFor creates a new user owned by the identity in claims. The owner
+// always comes from the token, never from the request body. newUser's source
+// IP is set by the caller for the audit log
+func createUserFor(newUser NewUser, claims Claims, policy *Policy) (NewUser, error) {
+	newUser.Identity = identityFromClaims(claims)
+	newUser.actor = claimsActor(claims, newUser.actor.SourceIP)
+	newUser.claims = claims
+	if newUser.Subject == "" && !disableAuth {
+		err := fmt.Errorf("%w: token has no subject", errForbidden)
+		auditAuth(newUser.actor, err)
+		return NewUser{}, err
+	}
+	created, err := currentClient().newUser(newUser, policy)
+	if errors.Is(err, errForbidden) {
+		auditAuth(newUser.actor, err)
+	}
+	return created, err
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
 	if err != nil {
-		log.Error().AnErr("error marshaling new user to JSON", err)
+		log.Error().AnErr("error marshaling response to JSON", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	log.Info().Str("new user", createdUser.ClientName).Str("public key", createdUser.PublicKey).Msg("created new user")
-	w.Write(jsonNewUser)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
 }
 
 // HomeHandler just returns a 200 OK
@@ -67,95 +149,267 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// newRouter builds the router. Routes on the api subrouter require a valid
+// bearer token
+func newRouter() *mux.Router {
+	// public keys in paths are percent-encoded as they can contain slashes
+	r := mux.NewRouter().UseEncodedPath()
+	r.HandleFunc("/", HomeHandler).Methods("GET")
+	if deviceFlows != nil {
+		// device flow clients don't have a token yet
+		r.HandleFunc("/device/authorize", DeviceAuthorizeHandler).Methods("POST")
+		r.HandleFunc("/device/token", DeviceTokenHandler).Methods("POST")
+	}
+	if portal != nil {
+		// the portal has its own login and session cookie
+		r.HandleFunc("/portal", PortalHandler).Methods("GET")
+		r.HandleFunc("/portal/callback", PortalCallbackHandler).Methods("GET")
+		r.HandleFunc("/portal/newuser", PortalNewUserHandler).Methods("POST")
+	}
+	api := r.NewRoute().Subrouter()
+	api.Use(authMiddleware)
+	api.HandleFunc("/newuser", NewUserHandler).Methods("POST")
+	api.HandleFunc("/me/peers", MyPeersHandler).Methods("GET")
+	api.HandleFunc("/me/peers/{pubkey}", DeleteMyPeerHandler).Methods("DELETE")
+	// renewal is for the peer's owner, so it's registered before the admin routes
+	api.HandleFunc("/peers/{pubkey}/renew", RenewPeerHandler).Methods("POST")
+	admin := api.PathPrefix("/peers").Subrouter()
+	admin.Use(adminMiddleware)
+	admin.HandleFunc("", ListPeersHandler).Methods("GET")
+	admin.HandleFunc("/{pubkey}", GetPeerHandler).Methods("GET")
+	admin.HandleFunc("/{pubkey}", DeletePeerHandler).Methods("DELETE")
+	api.Handle("/admin/reload", adminMiddleware(http.HandlerFunc(ReloadHandler))).Methods("POST")
+	api.Handle("/admin/stats", adminMiddleware(http.HandlerFunc(StatsHandler))).Methods("GET")
+	api.Handle("/reports/sessions", adminMiddleware(http.HandlerFunc(SessionsReportHandler))).Methods("GET")
+	return r
+}
+
 func main() {
-	debugFlag := flag.Bool("debug", false, "turn debug logging on")
+	if len(os.Args) > 1 && os.Args[1] == "login" {
+		err := runLogin(os.Args[2:])
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		} else if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		err := runAudit(os.Args[2:], os.Stdout)
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		} else if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		return
+	}
+	// flag defaults are only shown in the help, flags override the config
+	// file and the environment only when they're set
+	defaults := defaultConfig()
+	configFlag := flag.String("config", os.Getenv(configEnvPrefix+"_CONFIG"), "The path to the YAML config file, WG2FA_CONFIG by default")
+	flag.Bool("debug", defaults.Debug, "turn debug logging on")
 	turnOffAuthFlag := flag.Bool("dangerauth", false, "turn on to disable auth to the newuser API")
-	wgConfPathFlag := flag.String("wgc", "/etc/wireguard/wg0.conf", "the path to the wireguard config managed by wg2fa")
-	wgClientListPathFlag := flag.String("cl", "/etc/wireguard/clientList", "the path to write the clientList to")
-	ForceTimeFlag := flag.Int64("f", -1, "The number of minutes since auth to force a reauth regardless of activity")
-	IdleTimeFlag := flag.Int64("i", 10, "The number of minutes since last activity to force a reauth")
-	ClientIDFlag := flag.String("cid", "", "The client ID for OAuth")
-	IssuerFlag := flag.String("iss", "", "The oauth issuer URL")
+	flag.String("listen", defaults.Listen, "The HTTP listen address")
+	flag.String("wgc", defaults.WireGuard.ConfigPath, "the path to the wireguard config managed by wg2fa")
+	flag.String("cl", defaults.WireGuard.ClientListPath, "the path to write the clientList to")
+	flag.String("interface", defaults.WireGuard.Interface, "The name of the wireguard interface")
+	flag.String("hostname", defaults.WireGuard.ServerHostname, "The server endpoint put in client configs, in host:port format")
+	flag.String("dns", strings.Join(defaults.WireGuard.DNSServers, ","), "Comma separated list of DNS servers put in client configs")
+	flag.Int64("f", defaults.Watchdog.ForceTime, "The number of minutes since auth to force a reauth regardless of activity")
+	flag.Int64("i", defaults.Watchdog.IdleTime, "The number of minutes since last activity to force a reauth")
+	flag.Int64("fh", defaults.Watchdog.FirstHandshakeTime, "The number of minutes a new peer has to make its first handshake before it's removed")
+	flag.String("cid", "", "The client ID for OAuth")
+	flag.String("cidclaim", defaults.Auth.ClientIDClaim, "The claim tokens must carry the client ID in, empty to not check it")
+	flag.String("csecret", "", "The client secret for OAuth, if the client is confidential")
+	flag.String("scopes", strings.Join(defaults.Auth.Scopes, " "), "Space separated list of scopes requested by the device flow and portal")
+	flag.String("portal", "", "The external base URL of wg2fa, e.g. https://vpn.example.com, to enable the login portal")
+	flag.String("iss", "", "The oauth issuer URL")
+	flag.String("aud", strings.Join(defaults.Auth.Audiences, ","), "Comma separated list of accepted token audiences")
+	flag.String("algs", strings.Join(defaults.Auth.Algorithms, ","), "Comma separated list of accepted token signing algorithms")
+	flag.String("policy", "", "The path to the access policy file. If empty any valid token is allowed")
+	flag.String("claims", "", "Comma separated list of claim=value pairs required in the token, e.g. cid=abc123")
+	flag.String("allowedips", strings.Join(defaults.WireGuard.AllowedIPs, ", "), "Comma separated list of CIDRs routed through the tunnel by clients, unless a policy or profile sets its own")
+	flag.Int("keepalive", defaults.WireGuard.PersistentKeepalive, "The PersistentKeepalive interval in seconds put in client configs, 0 leaves it out")
+	flag.Int("mtu", defaults.WireGuard.MTU, "The MTU put in client configs, 0 leaves it out")
+	flag.String("admin", "", "Comma separated list of claim=value pairs, any of which grants access to the peers API, e.g. groups=vpn-admins")
+	flag.String("templates", defaults.Templates.Dir, "The directory holding the client config and portal templates")
 	//TODO:
 	// ForceRecreateFlag := flag.Bool("force-recreate", false, "force the recreation of the user database and clearing all authenticated users")
 	flag.Parse()
 	// setup logging
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	if *debugFlag {
-		log.Debug().Msg("setting log level to debug")
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	config, err := loadConfig(*configFlag, os.Environ(), flag.CommandLine)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
 	}
+	setLogLevel(config.Debug)
+	log.Debug().Msg("log level set to debug")
 	// if we want auth to be disables for testing:
 	if *turnOffAuthFlag {
 		log.Warn().Msg("===WARNING=== setting danger auth to true, not validating ANY tokens")
 		disableAuth = true
 	}
-	// set the client ID and issuer
-	if *ClientIDFlag != "" {
-		clientID = *ClientIDFlag
-	} else {
-		log.Fatal().Msg("Empty client ID")
+	useTemplateDir(config.Templates.Dir)
+	set, err := parseTemplates()
+	if err != nil {
+		log.Fatal().Msg(err.Error())
 	}
-	if *IssuerFlag != "" {
-		issuer = *IssuerFlag
-	} else {
-		log.Fatal().Msg("Empty Issuer")
+	templates.Store(set)
+	configSource.path, configSource.flags = *configFlag, flag.CommandLine
+	startupConfig = config
+	clientID = config.Auth.ClientID
+	adminClaims = config.Auth.AdminClaims
+	oidcConfig := OIDCConfig{
+		Issuer:         config.Auth.Issuer,
+		Audiences:      config.Auth.Audiences,
+		Algorithms:     config.Auth.Algorithms,
+		RequiredClaims: config.Auth.requiredClaims(),
+	}
+	// the verifier is shared by every request so the issuer's keys are
+	// fetched once and cached
+	if !disableAuth {
+		tokenVerifier, err = newTokenVerifier(oidcConfig)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		deviceFlows, err = newDeviceFlow(clientID, config.Auth.ClientSecret, config.Auth.Scopes, tokenVerifier.metadata)
+		if err != nil {
+			log.Warn().Err(err).Msg("device flow disabled")
+		}
+		if config.Auth.PortalURL != "" {
+			portal, err = newLoginPortal(config.Auth.PortalURL, clientID, config.Auth.ClientSecret, config.Auth.Scopes, tokenVerifier.metadata)
+			if err != nil {
+				log.Fatal().Msg(err.Error())
+			}
+		}
+	}
+	if config.Auth.PolicyFile != "" {
+		policies, err = loadPolicies(config.Auth.PolicyFile)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
 	}
 	// initialize the wireguard client
-	// TODO: make these come from a conf file and
-	// from flags
+	backend, err := newKernelBackend()
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
 	wgclient = WGClient{
-		WGConfigPath:   *wgConfPathFlag,
-		ClientListPath: *wgClientListPathFlag,
-		DNSServers:     []string{"8.8.8.8, 8.8.4.4"},
-		ServerHostname: "localhost:51280",
-		InterfaceName:  "wg0",
+		WGConfigPath:        config.WireGuard.ConfigPath,
+		ClientListPath:      config.WireGuard.ClientListPath,
+		DNSServers:          config.WireGuard.DNSServers,
+		ServerHostname:      config.WireGuard.ServerHostname,
+		InterfaceName:       config.WireGuard.Interface,
+		Backend:             backend,
+		AllowedIPs:          config.WireGuard.AllowedIPs,
+		PersistentKeepalive: config.WireGuard.PersistentKeepalive,
+		MTU:                 config.WireGuard.MTU,
 	}
-	err := wgclient.init()
+	auditKey, err = loadAuditKey(config.Audit.KeyFile, true)
 	if err != nil {
 		log.Fatal().Msg(err.Error())
 	}
-	log.Debug().Str("wg config set to:", *wgConfPathFlag).
-		Str("client db set to", *wgClientListPathFlag).
+	err = wgclient.init()
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	log.Debug().Str("wg config set to:", wgclient.WGConfigPath).
+		Str("client db set to", wgclient.ClientListPath).
 		Str("server hostname set to", wgclient.ServerHostname).
 		Str("interface name set to", wgclient.InterfaceName).
 		Msg("wgclient init complete")
 	// start the watchdog timer
-	rcc := removeClientConfig{
-		ForceTime: *ForceTimeFlag,
-		IdleTime:  *IdleTimeFlag,
+	watchdogConfig = &removeClientConfig{
+		ForceTime:          config.Watchdog.ForceTime,
+		IdleTime:           config.Watchdog.IdleTime,
+		Policies:           policies,
+		FirstHandshakeTime: config.Watchdog.FirstHandshakeTime,
+		ExpiryWarning:      config.Watchdog.ExpiryWarning,
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	// the webhooks outlive ctx, to deliver the events sent while stopping
+	webhooksCtx, stopWebhooks := context.WithCancel(context.Background())
+	defer stopWebhooks()
+	if len(config.Webhooks.Endpoints) > 0 {
+		webhooks = newNotifier(webhooksCtx, config.Webhooks)
 	}
-	go watchdog(&wgclient, &rcc)
+	wd := &watchdog{client: &wgclient, config: watchdogConfig, clock: realClock{}}
+	watchdogDone := make(chan struct{})
+	go func() {
+		wd.run(ctx)
+		close(watchdogDone)
+	}()
+	flusherDone := make(chan struct{})
+	go func() {
+		runAuthFailureFlusher(ctx)
+		close(flusherDone)
+	}()
+	go reloadOnSIGHUP()
 	// start the router
-	r := mux.NewRouter()
-	r.HandleFunc("/", HomeHandler).Methods("GET")
-	r.HandleFunc("/newuser", NewUserHandler).Methods("POST")
+	r := newRouter()
 	// start
 	srv := &http.Server{
-		Addr: "0.0.0.0:8080",
+		Addr: config.Listen,
 		// Good practice to set timeouts to avoid Slowloris attacks.
 		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
 		Handler:      r, // Pass our instance of gorilla/mux in.
 	}
+	// let requests finish on SIGINT or SIGTERM, then stop the watchdog
+	shutdownDone := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Info().Msg("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+		if deviceFlows != nil {
+			deviceFlows.stop()
+		}
+		stop()
+		close(shutdownDone)
+	}()
 	log.Debug().Msg("Starting http server")
-	log.Fatal().Msg(srv.ListenAndServe().Error())
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal().Msg(err.Error())
+	}
+	<-shutdownDone
+	<-watchdogDone
+	<-flusherDone
+	flushAuthFailures()
+	if webhooks != nil {
+		// nothing sends events anymore, the ones left get a little time to be
+		// delivered before retries are given up and dead lettered
+		drain := time.AfterFunc(webhookDrainTime, stopWebhooks)
+		webhooks.wait()
+		drain.Stop()
+	}
+	closeClientDb()
 }
 
-func isAuthenticated(jwt string) bool {
-	toValidate := map[string]string{}
-	toValidate["aud"] = "api://default"
-	toValidate["cid"] = clientID
-
-	jwtVerifierSetup := jwtverifier.JwtVerifier{
-		Issuer:           issuer,
-		ClaimsToValidate: toValidate,
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
+}
 
-	verifier := jwtVerifierSetup.New()
-
-	_, err := verifier.VerifyAccessToken(jwt)
-	log.Debug().AnErr("JWT verifier error", err)
-	return err != nil
+// parseClaimPairs parses a comma separated list of claim=value pairs
+func parseClaimPairs(s string) (map[string]string, error) {
+	claims := make(map[string]string)
+	for _, pair := range splitList(s) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("invalid claim pair: " + pair)
+		}
+		claims[kv[0]] = kv[1]
+	}
+	return claims, nil
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestWGClient points the global wireguard client at a fake backend for
+// one test
+func useTestWGClient(t *testing.T, dbName string) *fakeBackend {
+	c, fb := newTestWGClient(t, dbName)
+	old := wgclient
+	wgclient = c
+	t.Cleanup(func() { wgclient = old })
+	return fb
+}
+
+func TestNewUserHandlerBindsIdentity(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	useTestWGClient(t, "handleridentity.db")
+	// the body tries to claim someone else's identity
+	body := `{"client_name": "laptop", "public_key": "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=",
+		"sub": "someone-else", "email": "ceo@example.com"}`
+	r := httptest.NewRequest("POST", "/newuser", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+iss.sign(t, "RS256", "rsa1", iss.claims()))
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a 200, got %d", w.Code)
+	}
+	var created NewUser
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("error decoding response: %s", err)
+	}
+	expected := Identity{Subject: "00u1abcd", Email: "bob@example.com", DisplayName: "Bob Example"}
+	if created.Identity != expected {
+		t.Errorf("response identity %+v, expected %+v", created.Identity, expected)
+	}
+	clients, _ := getClients()
+	if len(clients) != 1 || clients[0].Identity != expected || clients[0].Name != "laptop" {
+		t.Errorf("stored client %+v doesn't match the token", clients)
+	}
+}
+
+func TestNewUserHandlerGenerateKey(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	fb := useTestWGClient(t, "handlergenkey.db")
+	token := "Bearer " + iss.sign(t, "RS256", "rsa1", iss.claims())
+	r := httptest.NewRequest("POST", "/newuser", strings.NewReader(`{"client_name": "phone", "generate_key": true}`))
+	r.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a 200, got %d", w.Code)
+	}
+	var created NewUser
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("error decoding response: %s", err)
+	}
+	if strings.Contains(created.WGConf, clientPrivateKeyPlaceholder) || !strings.Contains(created.WGConf, "PrivateKey = ") {
+		t.Errorf("private key wasn't filled in:\n%s", created.WGConf)
+	}
+	if _, ok := fb.peers["wg0"][created.PublicKey]; !ok || created.PublicKey == "" {
+		t.Errorf("generated public key wasn't added to the backend")
+	}
+	device, enrolled, _ := getDevice(created.PublicKey)
+	if !enrolled || !device.ServerKey {
+		t.Errorf("device wasn't flagged as having a server generated key: %+v", device)
+	}
+	// the audit log keeps it after the device is revoked
+	if err := currentClient().revokeDevice(created.PublicKey, auditActor{Subject: "admin"}); err != nil {
+		t.Fatalf("error revoking device: %s", err)
+	}
+	recorded := false
+	for _, e := range auditEvents(t) {
+		if e.Event == auditPeerCreated && e.PublicKey == created.PublicKey {
+			recorded = e.Detail == auditServerKey
+		}
+	}
+	if !recorded {
+		t.Errorf("peer_created entry doesn't record the server generated key: %+v", auditEvents(t))
+	}
+	// a public key and generate_key together are rejected
+	r = httptest.NewRequest("POST", "/newuser", strings.NewReader(`{"client_name": "phone", "generate_key": true,
+		"public_key": "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="}`))
+	r.Header.Set("Authorization", token)
+	w = httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400, got %d", w.Code)
+	}
+}
+
+func TestNewUserHandlerValidation(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	useTestWGClient(t, "handlervalidation.db")
+	token := "Bearer " + iss.sign(t, "RS256", "rsa1", iss.claims())
+	cases := []struct {
+		body   string
+		status int
+	}{
+		{`{"client_name": "MacBook-Pro", "public_key": "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="}`, http.StatusOK},
+		{`{"client_name": "Bob's MacBook", "public_key": "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="}`, http.StatusBadRequest},
+		{`{"client_name": "laptop", "public_key": "abc123"}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/newuser", strings.NewReader(c.body))
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: expected a %d, got %d: %s", c.body, c.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestNewUserHandlerStaleLogin(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	useTestWGClient(t, "newuserstale.db")
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	body := `{"client_name": "laptop", "public_key": "` + pubkey + `"}`
+	post := func(claims Claims) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/newuser", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+iss.sign(t, "RS256", "rsa1", claims))
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, r)
+		return w
+	}
+	if w := post(iss.claims()); w.Code != http.StatusOK {
+		t.Fatalf("expected a 200, got %d: %s", w.Code, w.Body.String())
+	}
+	old := time.Now().Add(-50 * time.Minute).Format(time.RFC3339)
+	if _, err := db.Exec("UPDATE wg_user SET added = $1 WHERE public_key = $2;", old, pubkey); err != nil {
+		t.Fatalf("error backdating peer: %s", err)
+	}
+
+	// re-posting with a login from before the peer was renewed doesn't extend it
+	stale := iss.claims()
+	stale["auth_time"] = time.Now().Add(-time.Hour).Unix()
+	w := post(stale)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("expected a 401 invalid_token for a stale login, got %d", w.Code)
+	}
+	if client, _, _ := findClient(pubkey); client.Added.Format(time.RFC3339) != old {
+		t.Errorf("stale login renewed the peer: added %s", client.Added)
+	}
+
+	if w := post(iss.claims()); w.Code != http.StatusOK {
+		t.Errorf("expected a 200 for a fresh login, got %d: %s", w.Code, w.Body.String())
+	}
+	if client, _, _ := findClient(pubkey); time.Since(client.Added) > time.Minute {
+		t.Errorf("fresh login didn't renew the peer: added %s", client.Added)
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA256 for crypto.Hash
+	_ "crypto/sha512" // registers SHA384 and SHA512 for crypto.Hash
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// clockSkew is how far exp, nbf and iat may be off from the local clock
+const clockSkew = time.Minute
+
+// defaultKeyCacheTTL is how long fetched keys are used before a refresh
+const defaultKeyCacheTTL = time.Hour
+
+// defaultKeyRefreshInterval is the minimum time between two key fetches
+const defaultKeyRefreshInterval = 30 * time.Second
+
+// defaultKeyMaxAge is how long cached keys are used while the issuer can't
+// be reached
+const defaultKeyMaxAge = 24 * time.Hour
+
+// minRSAKeyBits is the smallest RSA modulus accepted for signing keys
+const minRSAKeyBits = 2048
+
+var errMalformedToken = errors.New("malformed token")
+var errUnknownKey = errors.New("token signed with an unknown key")
+var errRefreshLimited = errors.New("key refresh rate limited")
+var errKeysTooOld = errors.New("signing keys couldn't be refreshed for too long")
+
+// errForbidden is wrapped by verification errors for tokens that are valid
+// but not allowed to use wg2fa
+var errForbidden = errors.New("forbidden")
+
+// OIDCConfig configures verification of access tokens issued by an OpenID
+// Connect provider
+type OIDCConfig struct {
+	// Issuer is the issuer URL. The discovery document is read from
+	// Issuer/.well-known/openid-configuration
+	Issuer string
+	// Audiences are the accepted aud values, a token must match at least one
+	Audiences []string
+	// Algorithms are the accepted signing algorithms. Defaults to RS256
+	Algorithms []string
+	// RequiredClaims are claims that must be in the token with the given
+	// value. For list claims (groups, roles) the value must be in the list
+	RequiredClaims map[string]string
+	// HTTPClient is used for discovery and key fetches. Defaults to a client
+	// with a 10 second timeout
+	HTTPClient *http.Client
+	// KeyCacheTTL is how long fetched keys are trusted before they're
+	// refreshed. If the refresh fails the cached keys keep being used, up to
+	// KeyMaxAge. Defaults to an hour
+	KeyCacheTTL time.Duration
+	// KeyMaxAge is how old cached keys can get before tokens are rejected
+	// because the issuer can't be reached. Defaults to a day
+	KeyMaxAge time.Duration
+	// KeyRefreshInterval is the minimum time between two key fetches, which
+	// limits refreshes triggered by tokens with an unknown kid. Defaults to
+	// 30 seconds
+	KeyRefreshInterval time.Duration
+}
+
+// providerMetadata is the subset of the OpenID provider discovery document
+// that wg2fa uses
+type providerMetadata struct {
+	Issuer                      string `json:"issuer"`
+	JWKSURI                     string `json:"jwks_uri"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+// jsonWebKey is a single key from a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verificationKey is a parsed JWK
+type verificationKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// Claims are the claims of a verified token
+type Claims map[string]interface{}
+
+// String returns a claim as a string, or "" if it isn't a string
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// has reports whether a claim is value or, for list claims, contains value
+func (c Claims) has(name, value string) bool {
+	switch claim := c[name].(type) {
+	case nil:
+		return false
+	case string:
+		return claim == value
+	case []interface{}:
+		for _, item := range claim {
+			if s, ok := item.(string); ok && s == value {
+				return true
+			}
+		}
+		return false
+	default:
+		return fmt.Sprint(claim) == value
+	}
+}
+
+// VerifierStats are counters describing the verifier's key cache
+type VerifierStats struct {
+	// CacheHits is the number of key lookups served from the cache
+	CacheHits uint64 `json:"cache_hits"`
+	// CacheMisses is the number of lookups for an unknown kid
+	CacheMisses uint64 `json:"cache_misses"`
+	// Refreshes is the number of successful key fetches after startup
+	Refreshes uint64 `json:"refreshes"`
+	// RefreshFailures is the number of key fetches that failed
+	RefreshFailures uint64 `json:"refresh_failures"`
+	// RefreshesLimited is the number of refreshes skipped by rate limiting
+	RefreshesLimited uint64 `json:"refreshes_limited"`
+}
+
+// TokenVerifier verifies access tokens against an OpenID Connect issuer's
+// published keys. It is safe for concurrent use and meant to be shared by
+// every request
+type TokenVerifier struct {
+	// stats is first so its counters are 64-bit aligned for sync/atomic
+	stats    VerifierStats
+	config   OIDCConfig
+	metadata providerMetadata
+	now      func() time.Time
+	// mu guards keys and keysFetched
+	mu          sync.RWMutex
+	keys        map[string]verificationKey
+	keysFetched time.Time
+	// refreshMu serializes key fetches and guards lastRefresh
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+}
+
+// newTokenVerifier runs discovery against the configured issuer and fetches
+// its signing keys
+func newTokenVerifier(cfg OIDCConfig) (*TokenVerifier, error) {
+	if cfg.Issuer == "" {
+		return nil, errors.New("no issuer configured")
+	}
+	if len(cfg.Audiences) == 0 {
+		return nil, errors.New("no audience configured")
+	}
+	if len(cfg.Algorithms) == 0 {
+		cfg.Algorithms = []string{"RS256"}
+	}
+	for _, alg := range cfg.Algorithms {
+		if _, ok := signingHashes[alg]; !ok {
+			return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+		}
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.KeyCacheTTL <= 0 {
+		cfg.KeyCacheTTL = defaultKeyCacheTTL
+	}
+	if cfg.KeyRefreshInterval <= 0 {
+		cfg.KeyRefreshInterval = defaultKeyRefreshInterval
+	}
+	if cfg.KeyMaxAge <= 0 {
+		cfg.KeyMaxAge = defaultKeyMaxAge
+	}
+	v := &TokenVerifier{config: cfg, now: time.Now}
+	discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := v.getJSON(discoveryURL, &v.metadata); err != nil {
+		return nil, fmt.Errorf("discovery failed: %w", err)
+	}
+	if strings.TrimSuffix(v.metadata.Issuer, "/") != strings.TrimSuffix(cfg.Issuer, "/") {
+		return nil, fmt.Errorf("discovery document is for issuer %q, expected %q", v.metadata.Issuer, cfg.Issuer)
+	}
+	if v.metadata.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+	keys, err := v.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.keysFetched = v.now()
+	v.lastRefresh = v.keysFetched
+	return v, nil
+}
+
+// Stats returns a snapshot of the key cache counters
+func (v *TokenVerifier) Stats() VerifierStats {
+	return VerifierStats{
+		CacheHits:        atomic.LoadUint64(&v.stats.CacheHits),
+		CacheMisses:      atomic.LoadUint64(&v.stats.CacheMisses),
+		Refreshes:        atomic.LoadUint64(&v.stats.Refreshes),
+		RefreshFailures:  atomic.LoadUint64(&v.stats.RefreshFailures),
+		RefreshesLimited: atomic.LoadUint64(&v.stats.RefreshesLimited),
+	}
+}
+
+// Verify checks a token's signature and claims and returns its claims. If
+// the token is valid but lacks a required claim the error wraps errForbidden
+// and the claims are returned too
+func (v *TokenVerifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errMalformedToken
+	}
+	if !contains(v.config.Algorithms, header.Alg) {
+		return nil, fmt.Errorf("signing algorithm %q not allowed", header.Alg)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, fmt.Errorf("key %q can't be used with %s", header.Kid, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	if err := verifySignature(header.Alg, key.key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errMalformedToken
+	}
+	if err := v.validateClaims(claims); err != nil {
+		if errors.Is(err, errForbidden) {
+			return claims, err
+		}
+		return nil, err
+	}
+	return claims, nil
+}
+
+// key returns the key for kid. Expired caches are refreshed, but the cached
+// keys are still used if the issuer can't be reached, until they're
+// KeyMaxAge old. A key the issuer no longer publishes is rejected once a
+// refresh succeeds. An unknown kid triggers a rate limited refresh in case
+// the issuer rotated its keys
+func (v *TokenVerifier) key(kid string) (verificationKey, error) {
+	key, ok, age := v.cachedKey(kid)
+	if ok && age <= v.config.KeyCacheTTL {
+		atomic.AddUint64(&v.stats.CacheHits, 1)
+		return key, nil
+	}
+	if ok {
+		if err := v.refreshKeys(); err != nil {
+			if _, _, age = v.cachedKey(kid); age > v.config.KeyMaxAge {
+				log.Error().Err(err).Dur("age", age).Msg("signing keys are too old to use")
+				return verificationKey{}, errKeysTooOld
+			}
+			if err != errRefreshLimited {
+				log.Warn().Err(err).Msg("couldn't refresh signing keys, using cached keys")
+			}
+			return key, nil
+		}
+		if key, ok, _ = v.cachedKey(kid); !ok {
+			return verificationKey{}, errUnknownKey
+		}
+		return key, nil
+	}
+	atomic.AddUint64(&v.stats.CacheMisses, 1)
+	if err := v.refreshKeys(); err != nil {
+		if err != errRefreshLimited {
+			log.Warn().Err(err).Msg("couldn't refresh signing keys")
+		}
+		return verificationKey{}, errUnknownKey
+	}
+	if key, ok, _ = v.cachedKey(kid); !ok {
+		return verificationKey{}, errUnknownKey
+	}
+	return key, nil
+}
+
+// cachedKey looks kid up in the cache and returns how old the cache is
+func (v *TokenVerifier) cachedKey(kid string) (verificationKey, bool, time.Duration) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	age := v.now().Sub(v.keysFetched)
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true, age
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok, age
+}
+
+// refreshKeys fetches the issuer's keys and swaps them into the cache, at
+// most once per KeyRefreshInterval. On failure the cache is left as is
+func (v *TokenVerifier) refreshKeys() error {
+	v.refreshMu.Lock()
+	defer v.refreshMu.Unlock()
+	now := v.now()
+	if now.Sub(v.lastRefresh) < v.config.KeyRefreshInterval {
+		atomic.AddUint64(&v.stats.RefreshesLimited, 1)
+		return errRefreshLimited
+	}
+	v.lastRefresh = now
+	keys, err := v.fetchKeys()
+	if err != nil {
+		atomic.AddUint64(&v.stats.RefreshFailures, 1)
+		return err
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.keysFetched = now
+	v.mu.Unlock()
+	atomic.AddUint64(&v.stats.Refreshes, 1)
+	log.Info().Int("keys", len(keys)).Interface("stats", v.Stats()).Msg("refreshed signing keys")
+	return nil
+}
+
+func (v *TokenVerifier) validateClaims(claims Claims) error {
+	if claims.String("iss") != v.metadata.Issuer {
+		return fmt.Errorf("token issued by %q", claims.String("iss"))
+	}
+	audOK := false
+	for _, aud := range v.config.Audiences {
+		if claims.has("aud", aud) {
+			audOK = true
+			break
+		}
+	}
+	if !audOK {
+		return errors.New("token audience not accepted")
+	}
+	now := v.now()
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(clockSkew)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(clockSkew).Before(nbf) {
+		return errors.New("token not valid yet")
+	}
+	if iat, ok := numericDate(claims["iat"]); ok && now.Add(clockSkew).Before(iat) {
+		return errors.New("token issued in the future")
+	}
+	for name, value := range v.config.RequiredClaims {
+		if !claims.has(name, value) {
+			return fmt.Errorf("%w: required claim %q missing or wrong", errForbidden, name)
+		}
+	}
+	return nil
+}
+
+// fetchKeys downloads and parses the issuer's JWKS
+func (v *TokenVerifier) fetchKeys() (map[string]verificationKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(v.metadata.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("couldn't fetch signing keys: %w", err)
+	}
+	keys := make(map[string]verificationKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Debug().Err(err).Str("kid", jwk.Kid).Msg("skipping unusable signing key")
+			continue
+		}
+		keys[jwk.Kid] = verificationKey{alg: jwk.Alg, key: key}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("issuer published no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (v *TokenVerifier) getJSON(url string, out interface{}) error {
+	resp, err := v.config.HTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		if n.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key is %d bits, at least %d are required", n.BitLen(), minRSAKeyBits)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// signingHashes maps the supported JWS algorithms to their hash. EdDSA signs
+// the message directly
+var signingHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// ecdsaCurves are the curves each ECDSA algorithm must be used with
+var ecdsaCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	errBadSignature := errors.New("invalid token signature")
+	hash := signingHashes[alg]
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return errBadSignature
+		}
+		if err != nil {
+			return errBadSignature
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if ecdsaCurves[alg] != pub.Curve.Params().Name || len(signature) != 2*size {
+			return errBadSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errBadSignature
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" || !ed25519.Verify(pub, []byte(signed), signature) {
+			return errBadSignature
+		}
+		return nil
+	}
+	return errBadSignature
+}
+
+// decodeSegment decodes a base64url JSON token segment, keeping numbers as
+// json.Number
+func decodeSegment(segment string, out interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(raw) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// numericDate reads a JWT NumericDate claim
+func numericDate(claim interface{}) (time.Time, bool) {
+	n, ok := claim.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
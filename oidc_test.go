@@ -0,0 +1,500 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubIssuer is a local OpenID provider serving a discovery document and a
+// JWKS, and signing tokens with its keys
+type stubIssuer struct {
+	server *httptest.Server
+	// mux lets tests add more IdP endpoints
+	mux  *http.ServeMux
+	mu   sync.Mutex
+	keys map[string]crypto.Signer
+	// jwksHits counts requests for the JWKS
+	jwksHits int
+	// down makes every request fail with a 503
+	down bool
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	s := &stubIssuer{keys: make(map[string]crypto.Signer)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		if s.isDown() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                        s.server.URL,
+			"jwks_uri":                      s.server.URL + "/keys",
+			"authorization_endpoint":        s.server.URL + "/authorize",
+			"token_endpoint":                s.server.URL + "/token",
+			"device_authorization_endpoint": s.server.URL + "/device",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.jwksHits++
+		if s.down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		keys := make([]map[string]string, 0)
+		for kid, key := range s.keys {
+			keys = append(keys, publicJWK(kid, key.Public()))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	s.mux = mux
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+	s.addRSAKey(t, "rsa1")
+	return s
+}
+
+func (s *stubIssuer) isDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.down
+}
+
+func (s *stubIssuer) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *stubIssuer) hits() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jwksHits
+}
+
+func (s *stubIssuer) addRSAKey(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating RSA key: %s", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[kid] = key
+}
+
+func (s *stubIssuer) addECKey(t *testing.T, kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating EC key: %s", err)
+	}
+	s.addKey(kid, key)
+}
+
+// addKey publishes key as kid
+func (s *stubIssuer) addKey(kid string, key crypto.Signer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[kid] = key
+}
+
+func (s *stubIssuer) removeKey(kid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, kid)
+}
+
+// claims returns a valid set of claims for the stub issuer
+func (s *stubIssuer) claims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":    s.server.URL,
+		"aud":    "api://wg2fa",
+		"sub":    "00u1abcd",
+		"email":  "bob@example.com",
+		"name":   "Bob Example",
+		"cid":    "client123",
+		"groups": []string{"vpn-users", "engineering"},
+		"iat":    now.Unix(),
+		"exp":    now.Add(time.Hour).Unix(),
+	}
+}
+
+// sign signs claims with the key kid using alg
+func (s *stubIssuer) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	s.mu.Lock()
+	key := s.keys[kid]
+	s.mu.Unlock()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := signingHashes[alg].New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, signingHashes[alg], digest)
+	case *ecdsa.PrivateKey:
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		ss.FillBytes(sig[size:])
+	}
+	if err != nil {
+		t.Fatalf("error signing token: %s", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (s *stubIssuer) config() OIDCConfig {
+	return OIDCConfig{
+		Issuer:    s.server.URL,
+		Audiences: []string{"api://wg2fa"},
+	}
+}
+
+func publicJWK(kid string, pub crypto.PublicKey) map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA", "kid": kid, "use": "sig",
+			"n": enc(k.N.Bytes()),
+			"e": enc(big.NewInt(int64(k.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		return map[string]string{
+			"kty": "EC", "kid": kid, "use": "sig", "crv": k.Curve.Params().Name,
+			"x": enc(k.X.Bytes()),
+			"y": enc(k.Y.Bytes()),
+		}
+	}
+	return nil
+}
+
+func TestVerifyValidToken(t *testing.T) {
+	iss := newStubIssuer(t)
+	v, err := newTokenVerifier(iss.config())
+	if err != nil {
+		t.Fatalf("error creating verifier: %s", err)
+	}
+	claims, err := v.Verify(iss.sign(t, "RS256", "rsa1", iss.claims()))
+	if err != nil {
+		t.Fatalf("valid token rejected: %s", err)
+	}
+	if claims.String("sub") != "00u1abcd" {
+		t.Errorf("wrong sub claim %q", claims.String("sub"))
+	}
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+	iss := newStubIssuer(t)
+	iss.addECKey(t, "ec1")
+	v, err := newTokenVerifier(iss.config())
+	if err != nil {
+		t.Fatalf("error creating verifier: %s", err)
+	}
+	with := func(name string, value interface{}) map[string]interface{} {
+		c := iss.claims()
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+		return c
+	}
+	valid := iss.sign(t, "RS256", "rsa1", iss.claims())
+	tampered := valid[:len(valid)-4] + "AAAA"
+	unsigned := strings.Join(strings.Split(valid, ".")[:2], ".") + "."
+	cases := map[string]string{
+		"expired":         iss.sign(t, "RS256", "rsa1", with("exp", time.Now().Add(-time.Hour).Unix())),
+		"no expiry":       iss.sign(t, "RS256", "rsa1", with("exp", nil)),
+		"not yet valid":   iss.sign(t, "RS256", "rsa1", with("nbf", time.Now().Add(time.Hour).Unix())),
+		"wrong audience":  iss.sign(t, "RS256", "rsa1", with("aud", "api://default")),
+		"wrong issuer":    iss.sign(t, "RS256", "rsa1", with("iss", "https://evil.example.com")),
+		"disallowed alg":  iss.sign(t, "ES256", "ec1", iss.claims()),
+		"unknown kid":     strings.Replace(valid, valid[:strings.Index(valid, ".")], base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"nope"}`)), 1),
+		"alg none":        base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa1"}`)) + unsigned[strings.Index(unsigned, "."):],
+		"tampered":        tampered,
+		"malformed":       "not.a-token",
+		"empty signature": unsigned,
+	}
+	for name, token := range cases {
+		if _, err := v.Verify(token); err == nil {
+			t.Errorf("%s: token should have been rejected", name)
+		}
+	}
+}
+
+func TestVerifyRejectsWeakKeys(t *testing.T) {
+	iss := newStubIssuer(t)
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("error generating RSA key: %s", err)
+	}
+	iss.addKey("weak", weak)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating EC key: %s", err)
+	}
+	iss.addKey("ec384", p384)
+	cfg := iss.config()
+	cfg.Algorithms = []string{"RS256", "ES256", "ES384"}
+	v, err := newTokenVerifier(cfg)
+	if err != nil {
+		t.Fatalf("error creating verifier: %s", err)
+	}
+	// RSA keys under 2048 bits aren't used
+	if _, err := v.Verify(iss.sign(t, "RS256", "weak", iss.claims())); err != errUnknownKey {
+		t.Errorf("expected the 1024 bit key to be unknown, got %v", err)
+	}
+	// and ECDSA algorithms only verify with their own curve
+	if _, err := v.Verify(iss.sign(t, "ES256", "ec384", iss.claims())); err == nil {
+		t.Errorf("ES256 token signed with a P-384 key accepted")
+	}
+	if _, err := v.Verify(iss.sign(t, "ES384", "ec384", iss.claims())); err != nil {
+		t.Errorf("ES384 token signed with a P-384 key rejected: %s", err)
+	}
+}
+
+func TestVerifyAlgorithmsAndAudiences(t *testing.T) {
+	iss := newStubIssuer(t)
+	iss.addECKey(t, "ec1")
+	cfg := iss.config()
+	cfg.Algorithms = []string{"RS256", "ES256"}
+	cfg.Audiences = []string{"api://other", "api://wg2fa"}
+	v, err := newTokenVerifier(cfg)
+	if err != nil {
+		t.Fatalf("error creating verifier: %s", err)
+	}
+	claims := iss.claims()
+	claims["aud"] = []string{"api://unrelated", "api://wg2fa"}
+	if _, err := v.Verify(iss.sign(t, "ES256", "ec1", claims)); err != nil {
+		t.Errorf("ES256 token with list audience rejected: %s", err)
+	}
+}
+
+func TestVerifyRequiredClaims(t *testing.T) {
+	iss := newStubIssuer(t)
+	cfg := iss.config()
+	cfg.RequiredClaims = map[string]string{"cid": "client123", "groups": "vpn-users"}
+	v, err := newTokenVerifier(cfg)
+	if err != nil {
+		t.Fatalf("error creating verifier: %s", err)
+	}
+	if _, err := v.Verify(iss.sign(t, "RS256", "rsa1", iss.claims())); err != nil {
+		t.Errorf("token with required claims rejected: %s", err)
+	}
+	claims := iss.claims()
+	claims["groups"] = []string{"engineering"}
+	if _, err := v.Verify(iss.sign(t, "RS256", "rsa1", claims)); err == nil {
+		t.Errorf("token missing a required group should be rejected")
+	}
+	claims = iss.claims()
+	claims["cid"] = "someone-else"
+	if _, err := v.Verify(iss.sign(t, "RS256", "rsa1", claims)); err == nil {
+		t.Errorf("token with the wrong cid should be rejected")
+	}
+}
+
+func TestNewTokenVerifierErrors(t *testing.T) {
+	iss := newStubIssuer(t)
+	cfg := iss.config()
+	cfg.Audiences = nil
+	if _, err := newTokenVerifier(cfg); err == nil {
+		t.Errorf("expected an error with no audience")
+	}
+	cfg = iss.config()
+	cfg.Algorithms = []string{"HS256"}
+	if _, err := newTokenVerifier(cfg); err == nil {
+		t.Errorf("expected an error for an unsupported algorithm")
+	}
+	cfg = iss.config()
+	cfg.Issuer = iss.server.URL + "/other"
+	if _, err := newTokenVerifier(cfg); err == nil {
+		t.Errorf("expected an error when discovery fails")
+	}
+	iss.setDown(true)
+	if _, err := newTokenVerifier(iss.config()); err == nil {
+		t.Errorf("expected an error when the issuer is down")
+	}
+}
+
+func TestParseClaimPairs(t *testing.T) {
+	claims, err := parseClaimPairs("cid=abc, groups=vpn-users")
+	if err != nil {
+		t.Fatalf("error parsing claims: %s", err)
+	}
+	if claims["cid"] != "abc" || claims["groups"] != "vpn-users" {
+		t.Errorf("wrong claims %v", claims)
+	}
+	if _, err := parseClaimPairs("cid"); err == nil {
+		t.Errorf("expected an error for a pair with no value")
+	}
+}
+
+// fakeClock is a manually advanced clock for the key cache tests
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newCachedTestVerifier(t *testing.T, iss *stubIssuer) (*TokenVerifier, *fakeClock) {
+	cfg := iss.config()
+	cfg.KeyCacheTTL = time.Hour
+	cfg.KeyRefreshInterval = time.Minute
+	v, err := newTokenVerifier(cfg)
+	if err != nil {
+		t.Fatalf("error creating verifier: %s", err)
+	}
+	clock := &fakeClock{t: time.Now()}
+	v.now = clock.now
+	return v, clock
+}
+
+func TestVerifierCachesKeys(t *testing.T) {
+	iss := newStubIssuer(t)
+	v, _ := newCachedTestVerifier(t, iss)
+	token := iss.sign(t, "RS256", "rsa1", iss.claims())
+	for i := 0; i < 5; i++ {
+		if _, err := v.Verify(token); err != nil {
+			t.Fatalf("valid token rejected: %s", err)
+		}
+	}
+	if iss.hits() != 1 {
+		t.Errorf("expected one JWKS fetch, got %d", iss.hits())
+	}
+	if stats := v.Stats(); stats.CacheHits != 5 || stats.Refreshes != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestVerifierKeyRotation(t *testing.T) {
+	iss := newStubIssuer(t)
+	v, clock := newCachedTestVerifier(t, iss)
+	clock.advance(2 * time.Minute)
+	// the issuer rotates to a new key
+	iss.addRSAKey(t, "rsa2")
+	iss.removeKey("rsa1")
+	if _, err := v.Verify(iss.sign(t, "RS256", "rsa2", iss.claims())); err != nil {
+		t.Fatalf("token signed with the rotated key rejected: %s", err)
+	}
+	stats := v.Stats()
+	if stats.CacheMisses != 1 || stats.Refreshes != 1 {
+		t.Errorf("unexpected stats after rotation %+v", stats)
+	}
+	// a second unknown kid right after the refresh is rate limited
+	iss.addRSAKey(t, "rsa3")
+	token := iss.sign(t, "RS256", "rsa3", iss.claims())
+	if _, err := v.Verify(token); err == nil {
+		t.Errorf("refresh should have been rate limited")
+	}
+	if iss.hits() != 2 {
+		t.Errorf("expected two JWKS fetches, got %d", iss.hits())
+	}
+	if v.Stats().RefreshesLimited != 1 {
+		t.Errorf("expected one rate limited refresh, got %+v", v.Stats())
+	}
+	// once the interval passes the new key is picked up
+	clock.advance(2 * time.Minute)
+	if _, err := v.Verify(token); err != nil {
+		t.Errorf("token rejected after the refresh interval: %s", err)
+	}
+}
+
+func TestVerifierUsesCachedKeysWhenIssuerDown(t *testing.T) {
+	iss := newStubIssuer(t)
+	v, clock := newCachedTestVerifier(t, iss)
+	claims := iss.claims()
+	claims["exp"] = time.Now().Add(4 * time.Hour).Unix()
+	token := iss.sign(t, "RS256", "rsa1", claims)
+	iss.setDown(true)
+	// the cache is stale but the issuer can't be reached
+	clock.advance(2 * time.Hour)
+	if _, err := v.Verify(token); err != nil {
+		t.Fatalf("token rejected while the issuer is down: %s", err)
+	}
+	if v.Stats().RefreshFailures != 1 {
+		t.Errorf("expected one failed refresh, got %+v", v.Stats())
+	}
+	// further requests inside the refresh interval don't hit the issuer
+	hits := iss.hits()
+	if _, err := v.Verify(token); err != nil {
+		t.Errorf("token rejected while the issuer is down: %s", err)
+	}
+	if iss.hits() != hits {
+		t.Errorf("issuer was hit again inside the refresh interval")
+	}
+}
+
+func TestVerifierDropsRotatedOutKeys(t *testing.T) {
+	iss := newStubIssuer(t)
+	v, clock := newCachedTestVerifier(t, iss)
+	claims := iss.claims()
+	claims["exp"] = time.Now().Add(4 * time.Hour).Unix()
+	token := iss.sign(t, "RS256", "rsa1", claims)
+	if _, err := v.Verify(token); err != nil {
+		t.Fatalf("valid token rejected: %s", err)
+	}
+	// the issuer stops publishing the key before the cache goes stale
+	iss.addRSAKey(t, "rsa2")
+	iss.removeKey("rsa1")
+	clock.advance(2 * time.Hour)
+	if _, err := v.Verify(token); err != errUnknownKey {
+		t.Errorf("expected a rotated out key to be rejected, got %v", err)
+	}
+}
+
+func TestVerifierKeyMaxAge(t *testing.T) {
+	iss := newStubIssuer(t)
+	v, clock := newCachedTestVerifier(t, iss)
+	v.config.KeyMaxAge = 3 * time.Hour
+	claims := iss.claims()
+	claims["exp"] = time.Now().Add(6 * time.Hour).Unix()
+	token := iss.sign(t, "RS256", "rsa1", claims)
+	iss.setDown(true)
+	clock.advance(2 * time.Hour)
+	if _, err := v.Verify(token); err != nil {
+		t.Fatalf("token rejected while the issuer is briefly down: %s", err)
+	}
+	// the cached keys aren't used forever
+	clock.advance(2 * time.Hour)
+	if _, err := v.Verify(token); err != errKeysTooOld {
+		t.Errorf("expected the keys to be too old, got %v", err)
+	}
+	// until the issuer is back
+	iss.setDown(false)
+	clock.advance(2 * time.Minute)
+	if _, err := v.Verify(token); err != nil {
+		t.Errorf("token rejected once the issuer is back: %s", err)
+	}
+}
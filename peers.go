@@ -0,0 +1,306 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// PeerInfo is a client with its live state, as returned by the peers API
+type PeerInfo struct {
+	ClientConfig
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	// ExpiresAt is when the watchdog removes the peer, unset if it never will
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ExpiresIn is the number of seconds left until ExpiresAt
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	ExpiryReason string `json:"expiry_reason,omitempty"`
+}
+
+// peerInfos adds handshakes and watchdog deadlines to clients
+func peerInfos(clients []ClientConfig) ([]PeerInfo, error) {
+	handshakes, err := currentClient().getLastHandshakes()
+	if err != nil {
+		return nil, err
+	}
+	rc := currentWatchdogConfig()
+	now := time.Now()
+	infos := make([]PeerInfo, 0, len(clients))
+	for _, client := range clients {
+		info := PeerInfo{ClientConfig: client}
+		handshake := handshakes[client.PublicKey]
+		if !neverHandshook(handshake) {
+			info.LastHandshake = &handshake
+		}
+		if rc != nil {
+			deadline, reason := rc.expiry(client, handshake)
+			if !deadline.IsZero() {
+				info.ExpiresAt = &deadline
+				info.ExpiryReason = reason
+				if left := deadline.Sub(now); left > 0 {
+					info.ExpiresIn = int64(left / time.Second)
+				}
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// pubkeyVar reads the public key in a request's path. Keys are standard
+// base64, so clients percent-encode them or send them base64url encoded
+func pubkeyVar(r *http.Request) (string, bool) {
+	pubkey, err := url.PathUnescape(mux.Vars(r)["pubkey"])
+	if err != nil {
+		return "", false
+	}
+	pubkey = strings.NewReplacer("-", "+", "_", "/").Replace(pubkey)
+	key, err := wgtypes.ParseKey(pubkey)
+	if err != nil {
+		return "", false
+	}
+	return key.String(), true
+}
+
+// adminMiddleware only lets tokens with one of the admin claims through. It
+// must be used after authMiddleware
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if disableAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, _ := claimsFromContext(r.Context())
+		if !isAdmin(claims) {
+			log.Warn().Str("ip", r.RemoteAddr).Str("sub", claims.String("sub")).Msg("admin request permission denied")
+			authChallenge(w, http.StatusForbidden, "insufficient_scope", "admin access required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether claims have any of the admin claim values
+func isAdmin(claims Claims) bool {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	for name, value := range adminClaims {
+		if claims.hasAny(name, []string{value}) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListPeersHandler returns every peer
+func ListPeersHandler(w http.ResponseWriter, r *http.Request) {
+	clients, err := getClients()
+	if err != nil {
+		log.Error().AnErr("error getting clients from DB", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	infos, err := peerInfos(clients)
+	if err != nil {
+		log.Error().AnErr("error getting peer state", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// GetPeerHandler returns one peer
+func GetPeerHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := peerFromRequest(w, r, "")
+	if !ok {
+		return
+	}
+	infos, err := peerInfos([]ClientConfig{client})
+	if err != nil {
+		log.Error().AnErr("error getting peer state", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, infos[0])
+}
+
+// DeletePeerHandler revokes a device, removing its peer from the interface
+// and its enrollment from the DB. Inactive devices can be revoked too
+func DeletePeerHandler(w http.ResponseWriter, r *http.Request) {
+	pubkey, ok := pubkeyVar(r)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid public key"})
+		return
+	}
+	device, enrolled, err := getDevice(pubkey)
+	if err != nil {
+		log.Error().AnErr("error getting device from DB", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	client, active, err := findClient(pubkey)
+	if err != nil {
+		log.Error().AnErr("error getting clients from DB", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !enrolled && !active {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "peer not found"})
+		return
+	}
+	claims, _ := claimsFromContext(r.Context())
+	if err := currentClient().revokeDevice(pubkey, requestActor(r, claims)); err != nil {
+		log.Error().Err(err).Str("pubkey", pubkey).Msg("error revoking peer")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	owner := device.Subject
+	if !enrolled {
+		owner = client.Subject
+	}
+	log.Info().Str("pubkey", pubkey).Str("owner", owner).
+		Str("revoked by", claims.String("sub")).Msg("revoked peer")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MyPeersHandler returns the peers owned by the token's identity
+func MyPeersHandler(w http.ResponseWriter, r *http.Request) {
+	sub, ok := subjectFromRequest(w, r)
+	if !ok {
+		return
+	}
+	clients, err := getClients()
+	if err != nil {
+		log.Error().AnErr("error getting clients from DB", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	owned := make([]ClientConfig, 0)
+	for _, client := range clients {
+		if client.Subject == sub {
+			owned = append(owned, client)
+		}
+	}
+	infos, err := peerInfos(owned)
+	if err != nil {
+		log.Error().AnErr("error getting peer state", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// DeleteMyPeerHandler ends one of the token identity's own sessions. The
+// device stays enrolled. Other users' peers are reported as not found
+func DeleteMyPeerHandler(w http.ResponseWriter, r *http.Request) {
+	sub, ok := subjectFromRequest(w, r)
+	if !ok {
+		return
+	}
+	client, ok := peerFromRequest(w, r, sub)
+	if !ok {
+		return
+	}
+	claims, _ := claimsFromContext(r.Context())
+	if err := currentClient().removeUser(client.PublicKey, sessionEndUser, requestActor(r, claims)); err != nil {
+		log.Error().Err(err).Str("pubkey", client.PublicKey).Msg("error removing peer")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("pubkey", client.PublicKey).Str("sub", sub).Msg("user removed their peer")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RenewPeerHandler restarts the force time of one of the token identity's
+// peers. The peer keeps its IP, keys and PSK, so its connections survive. The
+// user has to have logged in again since the peer was added or last renewed,
+// or the force time could be put off forever with one token
+func RenewPeerHandler(w http.ResponseWriter, r *http.Request) {
+	sub, ok := subjectFromRequest(w, r)
+	if !ok {
+		return
+	}
+	client, ok := peerFromRequest(w, r, sub)
+	if !ok {
+		return
+	}
+	// the peer's IP and allowed IPs came from its policy, so a user who now
+	// matches a different one needs a new peer
+	policyName := ""
+	if policy := policyFromContext(r.Context()); policy != nil {
+		policyName = policy.Name
+	}
+	if currentPolicies() != nil && policyName != client.Policy {
+		log.Warn().Str("pubkey", client.PublicKey).Str("policy", policyName).
+			Str("peer policy", client.Policy).Msg("can't renew peer under a different policy")
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "policy changed, create a new peer"})
+		return
+	}
+	claims, _ := claimsFromContext(r.Context())
+	if !freshLogin(claims, client.Added) {
+		log.Warn().Str("pubkey", client.PublicKey).Str("sub", sub).Msg("renewal with a token from before the last renewal")
+		authChallenge(w, http.StatusUnauthorized, "invalid_token", errStaleLogin.Error())
+		return
+	}
+	if err := renewClientInDb(client.PublicKey); err != nil {
+		log.Error().Err(err).Str("pubkey", client.PublicKey).Msg("error renewing peer")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	e := requestActor(r, claims).entry(auditPeerRenewed)
+	e.Subject, e.PublicKey, e.IP = client.Subject, client.PublicKey, client.IP
+	audit(e)
+	notify(WebhookEvent{Event: auditPeerRenewed, Identity: client.Identity, ClientName: client.Name,
+		PublicKey: client.PublicKey, IP: client.IP, SourceIP: e.SourceIP})
+	client, _, err := findClient(client.PublicKey)
+	if err != nil {
+		log.Error().AnErr("error getting clients from DB", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	infos, err := peerInfos([]ClientConfig{client})
+	if err != nil {
+		log.Error().AnErr("error getting peer state", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("pubkey", client.PublicKey).Str("sub", sub).Msg("renewed peer")
+	writeJSON(w, http.StatusOK, infos[0])
+}
+
+// subjectFromRequest returns the token's subject, writing a 403 if it has none
+func subjectFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	claims, _ := claimsFromContext(r.Context())
+	sub := claims.String("sub")
+	if sub == "" {
+		authChallenge(w, http.StatusForbidden, "insufficient_scope", "token has no subject")
+		return "", false
+	}
+	return sub, true
+}
+
+// peerFromRequest looks up the peer in the request path, writing a 400 or 404
+// if there isn't one. If owner is set, peers owned by anyone else aren't found
+func peerFromRequest(w http.ResponseWriter, r *http.Request, owner string) (ClientConfig, bool) {
+	pubkey, ok := pubkeyVar(r)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid public key"})
+		return ClientConfig{}, false
+	}
+	client, found, err := findClient(pubkey)
+	if err != nil {
+		log.Error().AnErr("error getting clients from DB", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return ClientConfig{}, false
+	}
+	if !found || (owner != "" && client.Subject != owner) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "peer not found"})
+		return ClientConfig{}, false
+	}
+	return client, true
+}
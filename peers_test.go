@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestAdmin sets the admin claim and the watchdog config for one test
+func useTestAdmin(t *testing.T) {
+	oldAdmin, oldWatchdog := adminClaims, watchdogConfig
+	adminClaims = map[string]string{"groups": "vpn-admins"}
+	watchdogConfig = &removeClientConfig{ForceTime: 60, IdleTime: 10}
+	t.Cleanup(func() {
+		adminClaims = oldAdmin
+		watchdogConfig = oldWatchdog
+	})
+}
+
+// addTestPeer creates a peer owned by sub through the global wireguard client
+func addTestPeer(t *testing.T, name, pubkey, sub string) {
+	newUser := NewUser{ClientName: name, PublicKey: pubkey, Identity: Identity{Subject: sub}}
+	if _, err := wgclient.newUser(newUser, nil); err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+}
+
+func authedRequest(method, target, token string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestPeersAPIRequiresAdmin(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	useTestWGClient(t, "peersadmin.db")
+	useTestAdmin(t)
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, authedRequest("GET", "/peers", iss.sign(t, "RS256", "rsa1", iss.claims())))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a 403 for a non-admin, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/peers", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a 401 without a token, got %d", w.Code)
+	}
+}
+
+func TestPeersAPI(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	fb := useTestWGClient(t, "peersapi.db")
+	useTestAdmin(t)
+	claims := iss.claims()
+	claims["groups"] = []string{"vpn-admins"}
+	token := iss.sign(t, "RS256", "rsa1", claims)
+	router := newRouter()
+	// a key with a slash in it, which has to be encoded in the path
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	addTestPeer(t, "laptop", pubkey, "alice")
+	addTestPeer(t, "phone", "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", "bob")
+	handshake := time.Now().Add(-2 * time.Minute).Truncate(time.Second)
+	fb.setHandshake("wg0", pubkey, handshake)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("GET", "/peers", token))
+	var list []PeerInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &list); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("list returned %d: %s", w.Code, w.Body.String())
+	}
+	if len(list) != 2 {
+		t.Errorf("expected 2 peers, got %d", len(list))
+	}
+
+	// standard base64 percent-encoded, and base64url
+	paths := []string{
+		"/peers/" + url.PathEscape(pubkey),
+		"/peers/" + base64.URLEncoding.EncodeToString(mustDecodeKey(t, pubkey)),
+	}
+	for _, path := range paths {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, authedRequest("GET", path, token))
+		var info PeerInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &info); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("%s returned %d: %s", path, w.Code, w.Body.String())
+		}
+		if info.Subject != "alice" || info.LastHandshake == nil || !info.LastHandshake.Equal(handshake) {
+			t.Errorf("wrong peer %+v", info)
+		}
+		// idle expiry comes first, 10 minutes after the handshake
+		if info.ExpiryReason != removeReasonIdle || info.ExpiresIn < 7*60 || info.ExpiresIn > 8*60 {
+			t.Errorf("wrong expiry %s in %d", info.ExpiryReason, info.ExpiresIn)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("GET", "/peers/not-a-key", token))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a bad key, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("GET", "/peers/"+url.PathEscape("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="), token))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a 404 for an unknown peer, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("DELETE", paths[0], token))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete returned %d", w.Code)
+	}
+	if _, ok := fb.peers["wg0"][pubkey]; ok {
+		t.Errorf("peer wasn't removed from the backend")
+	}
+	if _, found, _ := findClient(pubkey); found {
+		t.Errorf("peer wasn't removed from the db")
+	}
+}
+
+func mustDecodeKey(t *testing.T, key string) []byte {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatalf("bad key %s", key)
+	}
+	return raw
+}
+
+func TestMyPeers(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	fb := useTestWGClient(t, "mypeers.db")
+	useTestAdmin(t)
+	token := iss.sign(t, "RS256", "rsa1", iss.claims())
+	router := newRouter()
+	mine := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	theirs := "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	addTestPeer(t, "laptop", mine, "00u1abcd")
+	addTestPeer(t, "phone", theirs, "someone-else")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("GET", "/me/peers", token))
+	var list []PeerInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &list); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("my peers returned %d: %s", w.Code, w.Body.String())
+	}
+	if len(list) != 1 || list[0].PublicKey != mine || list[0].Name != "laptop" || list[0].IP == "" || list[0].ExpiresAt == nil {
+		t.Errorf("wrong peers %+v", list)
+	}
+
+	// someone else's peer isn't found
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("DELETE", "/me/peers/"+url.PathEscape(theirs), token))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a 404 for another user's peer, got %d", w.Code)
+	}
+	if _, ok := fb.peers["wg0"][theirs]; !ok {
+		t.Errorf("another user's peer was removed")
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("DELETE", "/me/peers/"+url.PathEscape(mine), token))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected a 204 removing my peer, got %d", w.Code)
+	}
+	if _, ok := fb.peers["wg0"][mine]; ok {
+		t.Errorf("my peer wasn't removed")
+	}
+}
+
+func TestRenewPeer(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	fb := useTestWGClient(t, "renewpeer.db")
+	useTestAdmin(t)
+	token := iss.sign(t, "RS256", "rsa1", iss.claims())
+	router := newRouter()
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	addTestPeer(t, "laptop", pubkey, "00u1abcd")
+	before, _, _ := findClient(pubkey)
+	old := time.Now().Add(-50 * time.Minute).Format(time.RFC3339)
+	if _, err := db.Exec("UPDATE wg_user SET added = $1 WHERE public_key = $2;", old, pubkey); err != nil {
+		t.Fatalf("error backdating peer: %s", err)
+	}
+	psk := fb.peers["wg0"][pubkey].PSK
+
+	// someone else can't renew it
+	other := iss.claims()
+	other["sub"] = "someone-else"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("POST", "/peers/"+url.PathEscape(pubkey)+"/renew", iss.sign(t, "RS256", "rsa1", other)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a 404 renewing another user's peer, got %d", w.Code)
+	}
+
+	// a token from a login before the peer was added can't renew it
+	stale := iss.claims()
+	stale["auth_time"] = time.Now().Add(-time.Hour).Unix()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("POST", "/peers/"+url.PathEscape(pubkey)+"/renew", iss.sign(t, "RS256", "rsa1", stale)))
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("expected a 401 invalid_token for a stale login, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("POST", "/peers/"+url.PathEscape(pubkey)+"/renew", token))
+	var info PeerInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("renew returned %d: %s", w.Code, w.Body.String())
+	}
+	if time.Since(info.Added) > time.Minute || info.IP != before.IP {
+		t.Errorf("peer wasn't renewed in place: %+v", info)
+	}
+	if fb.peers["wg0"][pubkey].PSK != psk {
+		t.Errorf("peer was re-provisioned")
+	}
+	// the same token can't renew it again
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("POST", "/peers/"+url.PathEscape(pubkey)+"/renew", token))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a 401 renewing twice with one token, got %d", w.Code)
+	}
+
+	// a user who now matches a different policy needs a new peer
+	policies = loadTestPolicies(t)
+	defer func() { policies = nil }()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, authedRequest("POST", "/peers/"+url.PathEscape(pubkey)+"/renew", token))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected a 409 after a policy change, got %d", w.Code)
+	}
+}
+
+func TestRevokeInactiveDevice(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	useTestWGClient(t, "revokeinactive.db")
+	useTestAdmin(t)
+	claims := iss.claims()
+	claims["groups"] = []string{"vpn-admins"}
+	token := iss.sign(t, "RS256", "rsa1", claims)
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	addTestPeer(t, "laptop", pubkey, "alice")
+	wgclient.removeUser(pubkey, removeReasonIdle, watchdogActor)
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, authedRequest("DELETE", "/peers/"+url.PathEscape(pubkey), token))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected a 204 revoking an inactive device, got %d", w.Code)
+	}
+	if _, enrolled, _ := getDevice(pubkey); enrolled {
+		t.Errorf("device is still enrolled")
+	}
+}
+
+func TestRevokeKeepsPeerRemovalFailed(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	fb := useTestWGClient(t, "revokefailed.db")
+	useTestAdmin(t)
+	claims := iss.claims()
+	claims["groups"] = []string{"vpn-admins"}
+	token := iss.sign(t, "RS256", "rsa1", claims)
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	addTestPeer(t, "laptop", pubkey, "alice")
+	revoke := func() int {
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, authedRequest("DELETE", "/peers/"+url.PathEscape(pubkey), token))
+		return w.Code
+	}
+	fb.mu.Lock()
+	fb.removeErr = errors.New("netlink: operation not permitted")
+	fb.mu.Unlock()
+	if code := revoke(); code != http.StatusInternalServerError {
+		t.Errorf("expected a 500 when the peer can't be removed, got %d", code)
+	}
+	if _, active, _ := findClient(pubkey); !active {
+		t.Errorf("client was removed while its peer is still on the interface")
+	}
+	if _, enrolled, _ := getDevice(pubkey); !enrolled {
+		t.Errorf("device was revoked while its peer is still on the interface")
+	}
+	for _, e := range auditEvents(t) {
+		if e.Event == auditPeerRemoved || e.Event == auditDeviceRevoked {
+			t.Errorf("unexpected %s audit entry", e.Event)
+		}
+	}
+	// a peer that's already gone from the interface is removed from the DB
+	fb.mu.Lock()
+	fb.removeErr = nil
+	delete(fb.peers["wg0"], pubkey)
+	fb.mu.Unlock()
+	if code := revoke(); code != http.StatusNoContent {
+		t.Errorf("expected a 204 revoking a peer that's already gone, got %d", code)
+	}
+	if _, active, _ := findClient(pubkey); active {
+		t.Errorf("client wasn't removed")
+	}
+}
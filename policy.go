@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// PolicySet is the list of access policies loaded from the policy file.
+// Policies are checked in order and the first one matching a token applies
+type PolicySet struct {
+	// GroupsClaim is the claim holding the user's groups. Nested claims are
+	// addressed with dots. Defaults to groups
+	GroupsClaim string `json:"groups_claim"`
+	// RolesClaim is the claim holding the user's roles, e.g.
+	// realm_access.roles for Keycloak. Defaults to roles
+	RolesClaim string `json:"roles_claim"`
+	// Policies are the policies in match order
+	Policies []Policy `json:"policies"`
+	// Profiles are the named client tunnel settings policies can give out
+	Profiles []Profile `json:"profiles"`
+}
+
+// Profile is a named set of client tunnel settings, e.g. full-tunnel or
+// corp-only. Unset fields keep the policy's or the server's value
+type Profile struct {
+	Name string `json:"name"`
+	// AllowedIPs are the routes put in the client config
+	AllowedIPs []string `json:"allowed_ips"`
+	// DNSServers are the client DNS servers
+	DNSServers []string `json:"dns_servers"`
+	// PersistentKeepalive is the client keepalive interval in seconds
+	PersistentKeepalive int `json:"persistent_keepalive"`
+	// MTU is the client interface MTU
+	MTU int `json:"mtu"`
+}
+
+// Policy maps token claims to whether access is allowed and the settings of
+// the peers created for matching users
+type Policy struct {
+	// Name identifies the policy. Peers record the name of the policy they
+	// were created under
+	Name string `json:"name"`
+	// Groups matches users in any of these groups. Empty matches everyone
+	Groups []string `json:"groups"`
+	// Roles matches users with any of these roles. Empty matches everyone
+	Roles []string `json:"roles"`
+	// EmailDomains matches users whose email, as identityFromClaims reads it,
+	// is in any of these domains. An email_verified claim must be true.
+	// Empty matches everyone
+	EmailDomains []string `json:"email_domains"`
+	// Deny denies access to matching users
+	Deny bool `json:"deny"`
+	// AddressPool is the CIDR peer IPs are taken from. It must be inside the
+	// interface's address range. Empty uses the whole range
+	AddressPool string `json:"address_pool"`
+	// AllowedIPs are the routes put in the client config
+	AllowedIPs []string `json:"allowed_ips"`
+	// DNSServers overrides the client DNS servers
+	DNSServers []string `json:"dns_servers"`
+	// IdleTime overrides the idle timeout in minutes, <= 0 disables it
+	IdleTime *int64 `json:"idle_time"`
+	// ForceTime overrides the force reauth timeout in minutes, <= 0 disables it
+	ForceTime *int64 `json:"force_time"`
+	// FirstHandshakeTime overrides the minutes new peers have to make their
+	// first handshake
+	FirstHandshakeTime *int64 `json:"first_handshake_time"`
+	// Profile is the profile matching users get when they don't ask for one
+	Profile string `json:"profile"`
+	// Profiles are the other profiles matching users may ask for
+	Profiles []string `json:"profiles"`
+	// profiles are the policy's profiles by name, filled in by validate
+	profiles map[string]*Profile
+}
+
+// loadPolicies reads and validates a policy file
+func loadPolicies(path string) (*PolicySet, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ps PolicySet
+	if err := json.Unmarshal(raw, &ps); err != nil {
+		return nil, fmt.Errorf("couldn't parse policy file: %w", err)
+	}
+	if err := ps.validate(); err != nil {
+		return nil, err
+	}
+	return &ps, nil
+}
+
+func (ps *PolicySet) validate() error {
+	if ps.GroupsClaim == "" {
+		ps.GroupsClaim = "groups"
+	}
+	if ps.RolesClaim == "" {
+		ps.RolesClaim = "roles"
+	}
+	if len(ps.Policies) == 0 {
+		return errors.New("policy file has no policies")
+	}
+	profiles := make(map[string]*Profile)
+	for i := range ps.Profiles {
+		profile := &ps.Profiles[i]
+		if profile.Name == "" {
+			return errors.New("profile without a name")
+		}
+		if profiles[profile.Name] != nil {
+			return fmt.Errorf("duplicate profile name %q", profile.Name)
+		}
+		profiles[profile.Name] = profile
+		if err := validateTunnelSettings(profile.AllowedIPs, profile.DNSServers, profile.PersistentKeepalive, profile.MTU); err != nil {
+			return fmt.Errorf("profile %q: %w", profile.Name, err)
+		}
+	}
+	names := make(map[string]bool)
+	for i := range ps.Policies {
+		p := &ps.Policies[i]
+		if p.Name == "" {
+			return errors.New("policy without a name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate policy name %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.AddressPool != "" {
+			if _, _, err := net.ParseCIDR(p.AddressPool); err != nil {
+				return fmt.Errorf("policy %q: invalid address pool %q", p.Name, p.AddressPool)
+			}
+		}
+		if err := validateTunnelSettings(p.AllowedIPs, p.DNSServers, 0, 0); err != nil {
+			return fmt.Errorf("policy %q: %w", p.Name, err)
+		}
+		p.profiles = make(map[string]*Profile)
+		for _, name := range append([]string{p.Profile}, p.Profiles...) {
+			if name == "" {
+				continue
+			}
+			if profiles[name] == nil {
+				return fmt.Errorf("policy %q: unknown profile %q", p.Name, name)
+			}
+			p.profiles[name] = profiles[name]
+		}
+	}
+	return nil
+}
+
+// validateTunnelSettings checks client tunnel settings. Every route must be
+// a CIDR and every DNS server an IP. A keepalive or MTU of 0 is unset
+func validateTunnelSettings(allowedIPs, dnsServers []string, keepalive, mtu int) error {
+	for _, cidr := range allowedIPs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid allowed IP %q", cidr)
+		}
+	}
+	for _, dns := range dnsServers {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("invalid DNS server %q", dns)
+		}
+	}
+	if keepalive < 0 || keepalive > 65535 {
+		return fmt.Errorf("invalid persistent keepalive %d", keepalive)
+	}
+	if mtu != 0 && (mtu < 576 || mtu > 65535) {
+		return fmt.Errorf("invalid MTU %d", mtu)
+	}
+	return nil
+}
+
+// profile returns the profile a user asked for, or the policy's default if
+// they didn't ask. The error wraps errForbidden if the policy doesn't offer
+// the profile. A nil policy offers none
+func (p *Policy) profile(requested string) (*Profile, error) {
+	if p == nil {
+		if requested != "" {
+			return nil, fmt.Errorf("%w: no profiles are configured", errForbidden)
+		}
+		return nil, nil
+	}
+	if requested == "" {
+		return p.profiles[p.Profile], nil
+	}
+	profile, ok := p.profiles[requested]
+	if !ok {
+		return nil, fmt.Errorf("%w: policy %q doesn't offer profile %q", errForbidden, p.Name, requested)
+	}
+	return profile, nil
+}
+
+// profileNames lists the profiles users of the policy can pick from, the
+// default first
+func (p *Policy) profileNames() []string {
+	if p == nil {
+		return nil
+	}
+	var names []string
+	if p.Profile != "" {
+		names = append(names, p.Profile)
+	}
+	for _, name := range p.Profiles {
+		if name != p.Profile {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// match returns the first policy matching the claims. The error wraps
+// errForbidden if no policy matches or the matching policy denies access
+func (ps *PolicySet) match(claims Claims) (*Policy, error) {
+	for i := range ps.Policies {
+		p := &ps.Policies[i]
+		if !p.matches(claims, ps.GroupsClaim, ps.RolesClaim) {
+			continue
+		}
+		if p.Deny {
+			return nil, fmt.Errorf("%w: denied by policy %q", errForbidden, p.Name)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("%w: no matching policy", errForbidden)
+}
+
+// byName returns the policy with the given name, or nil
+func (ps *PolicySet) byName(name string) *Policy {
+	if ps == nil {
+		return nil
+	}
+	for i := range ps.Policies {
+		if ps.Policies[i].Name == name {
+			return &ps.Policies[i]
+		}
+	}
+	return nil
+}
+
+func (p *Policy) matches(claims Claims, groupsClaim, rolesClaim string) bool {
+	if len(p.Groups) > 0 && !claims.hasAny(groupsClaim, p.Groups) {
+		return false
+	}
+	if len(p.Roles) > 0 && !claims.hasAny(rolesClaim, p.Roles) {
+		return false
+	}
+	if len(p.EmailDomains) > 0 {
+		if !emailVerified(claims) {
+			return false
+		}
+		email := strings.ToLower(identityFromClaims(claims).Email)
+		at := strings.LastIndex(email, "@")
+		if at < 0 || !contains(lowerAll(p.EmailDomains), email[at+1:]) {
+			return false
+		}
+	}
+	return true
+}
+
+// emailVerified reports whether the email claim isn't marked unverified.
+// Some IdPs send email_verified as a string
+func emailVerified(claims Claims) bool {
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		return verified
+	case string:
+		return verified != "false"
+	}
+	return true
+}
+
+// hasAny reports whether a (possibly nested) claim has any of values
+func (c Claims) hasAny(path string, values []string) bool {
+	claims := c
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		nested, ok := claims[part].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		claims = nested
+	}
+	for _, value := range values {
+		if claims.has(parts[len(parts)-1], value) {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerAll(list []string) []string {
+	lowered := make([]string, len(list))
+	for i, item := range list {
+		lowered[i] = strings.ToLower(item)
+	}
+	return lowered
+}
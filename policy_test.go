@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestPolicies(t *testing.T) *PolicySet {
+	ps, err := loadPolicies(filepath.Join(".", "test", "policy.json"))
+	if err != nil {
+		t.Fatalf("error loading policies: %s", err)
+	}
+	return ps
+}
+
+func TestPolicyMatch(t *testing.T) {
+	ps := loadTestPolicies(t)
+	cases := []struct {
+		name   string
+		claims Claims
+		policy string
+	}{
+		{"engineer", Claims{"groups": []interface{}{"engineering"}, "email": "bob@Example.com"}, "engineering"},
+		{"engineer wrong domain", Claims{"groups": []interface{}{"engineering"}, "email": "bob@other.com"}, ""},
+		{"engineer verified email", Claims{"groups": []interface{}{"engineering"}, "email": "bob@example.com", "email_verified": true}, "engineering"},
+		{"engineer unverified email", Claims{"groups": []interface{}{"engineering"}, "email": "bob@example.com", "email_verified": false}, ""},
+		{"engineer unverified string", Claims{"groups": []interface{}{"engineering"}, "email": "bob@example.com", "email_verified": "false"}, ""},
+		{"engineer azure upn", Claims{"groups": []interface{}{"engineering"}, "upn": "bob@example.com"}, "engineering"},
+		{"nested role", Claims{"realm_access": map[string]interface{}{"roles": []interface{}{"vpn-admin"}}}, "admins"},
+		{"contractor admin", Claims{"groups": "contractors", "realm_access": map[string]interface{}{"roles": []interface{}{"vpn-admin"}}}, ""},
+		{"nobody", Claims{"sub": "abc"}, ""},
+	}
+	for _, c := range cases {
+		policy, err := ps.match(c.claims)
+		if c.policy == "" {
+			if err == nil {
+				t.Errorf("%s: expected no access, got policy %s", c.name, policy.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected policy %s, got %s", c.name, c.policy, err)
+			continue
+		}
+		if policy.Name != c.policy {
+			t.Errorf("%s: expected policy %s, got %s", c.name, c.policy, policy.Name)
+		}
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+	bad := []PolicySet{
+		{},
+		{Policies: []Policy{{}}},
+		{Policies: []Policy{{Name: "a"}, {Name: "a"}}},
+		{Policies: []Policy{{Name: "a", AddressPool: "10.0.0.0"}}},
+		{Policies: []Policy{{Name: "a", AllowedIPs: []string{"10.0.0.0/33"}}}},
+		{Policies: []Policy{{Name: "a", DNSServers: []string{"dns.example.com"}}}},
+		{Policies: []Policy{{Name: "a", Profile: "missing"}}},
+		{Policies: []Policy{{Name: "a"}}, Profiles: []Profile{{Name: "p"}, {Name: "p"}}},
+		{Policies: []Policy{{Name: "a"}}, Profiles: []Profile{{Name: "p", AllowedIPs: []string{"10.0.0.1"}}}},
+		{Policies: []Policy{{Name: "a"}}, Profiles: []Profile{{Name: "p", PersistentKeepalive: -1}}},
+		{Policies: []Policy{{Name: "a"}}, Profiles: []Profile{{Name: "p", MTU: 100}}},
+	}
+	for i, ps := range bad {
+		if err := ps.validate(); err == nil {
+			t.Errorf("policy set %d should be invalid", i)
+		}
+	}
+}
+
+func TestNewUserWithPolicy(t *testing.T) {
+	c, fb := newTestWGClient(t, "policyuser.db")
+	ps := loadTestPolicies(t)
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	created, err := c.newUser(NewUser{ClientName: "bob", PublicKey: pubkey}, ps.byName("engineering"))
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	if ip := fb.peers["wg0"][pubkey].IP; ip != "10.0.0.128/24" {
+		t.Errorf("IP %s isn't from the policy's pool", ip)
+	}
+	for _, line := range []string{"DNS = 10.0.0.1\n", "AllowedIPs = 10.0.0.0/24, 192.168.10.0/24\n"} {
+		if !strings.Contains(created.WGConf, line) {
+			t.Errorf("client config missing %q:\n%s", line, created.WGConf)
+		}
+	}
+	clients, _ := getClients()
+	if len(clients) != 1 || clients[0].Policy != "engineering" {
+		t.Errorf("policy name wasn't stored with the client")
+	}
+}
+
+func TestNewUserProfiles(t *testing.T) {
+	c, _ := newTestWGClient(t, "policyprofiles.db")
+	c.AllowedIPs = []string{"10.0.0.0/24"}
+	c.MTU = 1420
+	ps := loadTestPolicies(t)
+	cases := []struct {
+		policy  string
+		profile string
+		lines   []string
+	}{
+		// no policy gets the server's settings
+		{"", "", []string{"AllowedIPs = 10.0.0.0/24\n", "MTU = 1420\n"}},
+		// the policy's default profile
+		{"admins", "", []string{"AllowedIPs = 0.0.0.0/0, ::/0\n", "PersistentKeepalive = 25\n"}},
+		{"admins", "corp-only", []string{"AllowedIPs = 10.0.0.0/8\n", "DNS = 10.0.0.1\n", "MTU = 1380\n"}},
+		// a policy without a default keeps its own routes
+		{"engineering", "", []string{"AllowedIPs = 10.0.0.0/24, 192.168.10.0/24\n", "MTU = 1420\n"}},
+		{"engineering", "full-tunnel", []string{"AllowedIPs = 0.0.0.0/0, ::/0\n", "DNS = 10.0.0.1\n"}},
+	}
+	keys := []string{
+		"i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=",
+		"xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+		"cHJpdmF0ZWtleXByaXZhdGVrZXlwcml2YXRla2V5cHI=",
+		"mY0EGaDm2b8V+eHMEzTmEm8S9rXU9XlPkkPjcvm2g2k=",
+		"GKGmrKM2tc0SptUz7Hn9jgmzOV/cNR6hi+TOrvaf9UA=",
+	}
+	for i, tc := range cases {
+		created, err := c.newUser(NewUser{ClientName: "bob", PublicKey: keys[i], Profile: tc.profile}, ps.byName(tc.policy))
+		if err != nil {
+			t.Fatalf("%s/%s: error creating user: %s", tc.policy, tc.profile, err)
+		}
+		for _, line := range tc.lines {
+			if !strings.Contains(created.WGConf, line) {
+				t.Errorf("%s/%s: client config missing %q:\n%s", tc.policy, tc.profile, line, created.WGConf)
+			}
+		}
+	}
+	// profiles the policy doesn't offer are refused
+	for _, tc := range []struct{ policy, profile string }{{"engineering", "corp-only"}, {"", "full-tunnel"}} {
+		_, err := c.newUser(NewUser{ClientName: "bob", PublicKey: keys[0], Profile: tc.profile}, ps.byName(tc.policy))
+		if !errors.Is(err, errForbidden) {
+			t.Errorf("%s/%s: expected errForbidden, got %v", tc.policy, tc.profile, err)
+		}
+	}
+}
+
+func TestWatchdogPolicyTimeouts(t *testing.T) {
+	ps := loadTestPolicies(t)
+	rc := removeClientConfig{ForceTime: -1, IdleTime: 10, FirstHandshakeTime: 5, Policies: ps}
+	cases := map[string][3]int64{
+		"engineering": {480, 30, 60},
+		"admins":      {0, 10, 5},
+		"":            {-1, 10, 5},
+		"deleted":     {-1, 10, 5},
+	}
+	for policy, expected := range cases {
+		force, idle, handshake := rc.timeouts(ClientConfig{Policy: policy})
+		if force != expected[0] || idle != expected[1] || handshake != expected[2] {
+			t.Errorf("policy %q: expected %v, got [%d %d %d]", policy, expected, force, idle, handshake)
+		}
+	}
+}
+
+func TestMigrateClientDb(t *testing.T) {
+	confpath := filepath.Join(".", "test", "migrate.db")
+	defer deleteFile(confpath)
+	// create a table the way older versions did
+	old, err := sql.Open("sqlite3", confpath)
+	if err != nil {
+		t.Fatalf("error opening db: %s", err)
+	}
+	_, err = old.Exec("CREATE TABLE wg_user (public_key text not null primary key, name text, ip text, added text);")
+	if err != nil {
+		t.Fatalf("error creating old table: %s", err)
+	}
+	_, err = old.Exec("INSERT INTO wg_user (public_key, name, ip, added) VALUES ('abc123', 'bob', '10.0.0.2/24', '2021-01-14T00:00:00Z');")
+	if err != nil {
+		t.Fatalf("error inserting into old table: %s", err)
+	}
+	old.Close()
+	if err := checkClientDb(confpath, false); err != nil {
+		t.Fatalf("error migrating db: %s", err)
+	}
+	defer closeClientDb()
+	clients, err := getClients()
+	if err != nil || len(clients) != 1 {
+		t.Fatalf("existing client lost in migration: %v", err)
+	}
+	if _, err := getDevices(); err != nil {
+		t.Errorf("device table wasn't created: %s", err)
+	}
+}
+
+func TestAuthMiddlewarePolicies(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	policies = loadTestPolicies(t)
+	defer func() { policies = nil }()
+	var matched *Policy
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matched = policyFromContext(r.Context())
+	}))
+	// the stub issuer's user is an engineer at example.com
+	r := httptest.NewRequest("POST", "/newuser", nil)
+	r.Header.Set("Authorization", "Bearer "+iss.sign(t, "RS256", "rsa1", iss.claims()))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || matched == nil || matched.Name != "engineering" {
+		t.Errorf("expected the engineering policy, got status %d", w.Code)
+	}
+	// contractors are denied
+	claims := iss.claims()
+	claims["groups"] = []string{"contractors", "engineering"}
+	r = httptest.NewRequest("POST", "/newuser", nil)
+	r.Header.Set("Authorization", "Bearer "+iss.sign(t, "RS256", "rsa1", claims))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a 403 for a denied user, got %d", w.Code)
+	}
+}
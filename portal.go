@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var portalTemplatePath = filepath.Join(".", "text_templates", "portal.html")
+
+const (
+	portalStateCookie   = "wg2fa_login"
+	portalSessionCookie = "wg2fa_session"
+	// portalLoginTimeout is how long a user has to finish logging in at the IdP
+	portalLoginTimeout = 10 * time.Minute
+	// portalSessionTimeout caps a portal session, even if the token lives longer
+	portalSessionTimeout = 15 * time.Minute
+	// maxPublicKeyUpload is plenty for a base64 key and some whitespace
+	maxPublicKeyUpload = 64 << 10
+	// maxPortalLogins caps the logins in progress at the IdP
+	maxPortalLogins = 1000
+	// portalLoginLimit is how many logins a source IP can start a minute
+	portalLoginLimit = 20
+)
+
+var errTooManyLogins = errors.New("too many logins in progress")
+
+// portal is nil when the login portal is disabled
+var portal *loginPortal
+
+// loginPortal serves an HTML page for getting a client config from a browser.
+// Users log in at the IdP with the authorization code flow and PKCE, the
+// portal keeps the resulting claims in a short lived server side session
+type loginPortal struct {
+	clientID              string
+	clientSecret          string
+	scopes                []string
+	authorizationEndpoint string
+	tokenEndpoint         string
+	// redirectURL is the portal's callback as registered with the IdP
+	redirectURL   string
+	secureCookies bool
+	httpClient    *http.Client
+	now           func() time.Time
+	// limiter limits the logins started by each source IP
+	limiter *rateLimiter
+
+	mu sync.Mutex
+	// maxLogins caps len(logins)
+	maxLogins int
+	// logins maps the state parameter to logins in progress at the IdP
+	logins map[string]portalLogin
+	// sessions maps session cookies to logged in users
+	sessions map[string]portalSession
+}
+
+type portalLogin struct {
+	codeVerifier string
+	expires      time.Time
+}
+
+type portalSession struct {
+	claims  Claims
+	policy  *Policy
+	csrf    string
+	expires time.Time
+}
+
+// portalPage is the data for the portal template
+type portalPage struct {
+	Error    string
+	Identity Identity
+	CSRF     string
+	// Profiles are the profiles the user can pick, the default first
+	Profiles []string
+	// the rest are set once a config has been created
+	ClientName   string
+	Config       string
+	DownloadURL  template.URL
+	FileName     string
+	GeneratedKey bool
+	// QRCode is a PNG data URL, only set for complete configs
+	QRCode template.URL
+}
+
+// newLoginPortal creates a portal served at baseURL, e.g. https://vpn.example.com
+func newLoginPortal(baseURL, clientID, clientSecret string, scopes []string, metadata providerMetadata) (*loginPortal, error) {
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" {
+		return nil, errors.New("issuer doesn't support the authorization code grant")
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Host == "" || (base.Scheme != "https" && base.Scheme != "http") {
+		return nil, fmt.Errorf("invalid portal URL %q", baseURL)
+	}
+	return &loginPortal{
+		clientID:              clientID,
+		clientSecret:          clientSecret,
+		scopes:                scopes,
+		authorizationEndpoint: metadata.AuthorizationEndpoint,
+		tokenEndpoint:         metadata.TokenEndpoint,
+		redirectURL:           strings.TrimSuffix(base.String(), "/") + "/portal/callback",
+		secureCookies:         base.Scheme == "https",
+		httpClient:            &http.Client{Timeout: 10 * time.Second},
+		now:                   time.Now,
+		limiter:               newRateLimiter(portalLoginLimit, time.Minute),
+		maxLogins:             maxPortalLogins,
+		logins:                make(map[string]portalLogin),
+		sessions:              make(map[string]portalSession),
+	}, nil
+}
+
+// loginURL starts a login, returning the IdP URL to send the browser to and
+// the state that comes back on the callback. Logins expire after
+// portalLoginTimeout, and errTooManyLogins is returned while maxLogins are
+// in progress
+func (p *loginPortal) loginURL() (string, string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	p.mu.Lock()
+	p.expire()
+	if len(p.logins) >= p.maxLogins {
+		p.mu.Unlock()
+		return "", "", errTooManyLogins
+	}
+	p.logins[state] = portalLogin{codeVerifier: verifier, expires: p.now().Add(portalLoginTimeout)}
+	p.mu.Unlock()
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.redirectURL},
+		"scope":                 {strings.Join(p.scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.authorizationEndpoint + sep + query.Encode(), state, nil
+}
+
+// finishLogin exchanges the callback's code for a token and starts a session
+// for its owner. It returns the session ID. The token is audited as coming
+// from sourceIP
+func (p *loginPortal) finishLogin(state, code, sourceIP string) (string, error) {
+	p.mu.Lock()
+	login, ok := p.logins[state]
+	delete(p.logins, state)
+	p.mu.Unlock()
+	if !ok || p.now().After(login.expires) {
+		return "", errors.New("unknown or expired login")
+	}
+	token, err := p.exchange(code, login.codeVerifier)
+	if err != nil {
+		return "", err
+	}
+	claims, policy, err := authorizeToken(token)
+	if err == nil && claims.String("sub") == "" {
+		err = fmt.Errorf("%w: token has no subject", errForbidden)
+	}
+	auditAuth(claimsActor(claims, sourceIP), err)
+	if err != nil {
+		return "", err
+	}
+	sessionID, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	expires := p.now().Add(portalSessionTimeout)
+	if exp, ok := numericDate(claims["exp"]); ok && exp.Before(expires) {
+		expires = exp
+	}
+	p.mu.Lock()
+	p.sessions[sessionID] = portalSession{claims: claims, policy: policy, csrf: csrf, expires: expires}
+	p.mu.Unlock()
+	return sessionID, nil
+}
+
+// exchange redeems an authorization code at the IdP's token endpoint
+func (p *loginPortal) exchange(code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"client_id":     {p.clientID},
+		"code_verifier": {verifier},
+	}
+	if p.clientSecret != "" {
+		form.Set("client_secret", p.clientSecret)
+	}
+	resp, err := p.httpClient.PostForm(p.tokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	var tokenResp oauthTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("couldn't decode token response (%s): %w", resp.Status, err)
+	}
+	if tokenResp.Error != "" {
+		return "", fmt.Errorf("token endpoint returned %s: %s", tokenResp.Error, tokenResp.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || tokenResp.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint returned %s without a token", resp.Status)
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// session returns the logged in session for a request, if there is one
+func (p *loginPortal) session(r *http.Request) (portalSession, bool) {
+	cookie, err := r.Cookie(portalSessionCookie)
+	if err != nil {
+		return portalSession{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	s, ok := p.sessions[cookie.Value]
+	return s, ok
+}
+
+// expire drops finished logins and sessions. p.mu must be held
+func (p *loginPortal) expire() {
+	now := p.now()
+	for state, login := range p.logins {
+		if now.After(login.expires) {
+			delete(p.logins, state)
+		}
+	}
+	for id, s := range p.sessions {
+		if now.After(s.expires) {
+			delete(p.sessions, id)
+		}
+	}
+}
+
+func (p *loginPortal) setCookie(w http.ResponseWriter, name, value, path string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   int(maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   p.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// PortalHandler shows the new device form to logged in users and sends
+// everyone else to the IdP
+func PortalHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := portal.session(r)
+	if !ok {
+		if !portal.limiter.allow(sourceIP(r)) {
+			log.Warn().Str("ip", r.RemoteAddr).Msg("too many portal logins from one address")
+			w.Header().Set("Retry-After", "60")
+			renderPortal(w, http.StatusTooManyRequests, portalPage{Error: "Too many logins, try again in a minute."})
+			return
+		}
+		loginURL, state, err := portal.loginURL()
+		if errors.Is(err, errTooManyLogins) {
+			log.Warn().Err(err).Msg("portal login refused")
+			w.Header().Set("Retry-After", "60")
+			renderPortal(w, http.StatusServiceUnavailable, portalPage{Error: "Too many logins in progress, try again later."})
+			return
+		} else if err != nil {
+			log.Error().Err(err).Msg("error starting portal login")
+			renderPortal(w, http.StatusInternalServerError, portalPage{Error: "Couldn't start the login, try again later."})
+			return
+		}
+		// the state is tied to this browser so a login can't be finished in
+		// someone else's
+		portal.setCookie(w, portalStateCookie, state, "/portal/callback", portalLoginTimeout)
+		http.Redirect(w, r, loginURL, http.StatusFound)
+		return
+	}
+	renderPortal(w, http.StatusOK, portalPage{Identity: identityFromClaims(s.claims), CSRF: s.csrf, Profiles: s.policy.profileNames()})
+}
+
+// PortalCallbackHandler is where the IdP sends the browser back to after login
+func PortalCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if idpErr := query.Get("error"); idpErr != "" {
+		log.Warn().Str("error", idpErr).Str("description", query.Get("error_description")).Msg("portal login failed at the IdP")
+		renderPortal(w, http.StatusForbidden, portalPage{Error: "Login failed: " + idpErr})
+		return
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie(portalStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		renderPortal(w, http.StatusBadRequest, portalPage{Error: "This login wasn't started in this browser, please start again."})
+		return
+	}
+	portal.setCookie(w, portalStateCookie, "", "/portal/callback", -1)
+	sessionID, err := portal.finishLogin(state, query.Get("code"), sourceIP(r))
+	if errors.Is(err, errForbidden) {
+		log.Warn().Str("ip", r.RemoteAddr).Err(err).Msg("portal login permission denied")
+		renderPortal(w, http.StatusForbidden, portalPage{Error: "You aren't allowed to use this VPN."})
+		return
+	} else if err != nil {
+		log.Warn().Str("ip", r.RemoteAddr).Err(err).Msg("portal login failed")
+		renderPortal(w, http.StatusUnauthorized, portalPage{Error: "Login failed, please start again."})
+		return
+	}
+	portal.setCookie(w, portalSessionCookie, sessionID, "/portal", portalSessionTimeout)
+	http.Redirect(w, r, "/portal", http.StatusSeeOther)
+}
+
+// PortalNewUserHandler creates a peer from the portal form. The public key is
+// pasted, uploaded or generated here
+func PortalNewUserHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := portal.session(r)
+	if !ok {
+		http.Redirect(w, r, "/portal", http.StatusSeeOther)
+		return
+	}
+	page := portalPage{Identity: identityFromClaims(s.claims), CSRF: s.csrf, Profiles: s.policy.profileNames()}
+	r.Body = http.MaxBytesReader(w, r.Body, maxPublicKeyUpload)
+	if err := r.ParseMultipartForm(maxPublicKeyUpload); err != nil && err != http.ErrNotMultipart {
+		page.Error = "The form couldn't be read."
+		renderPortal(w, http.StatusBadRequest, page)
+		return
+	}
+	if r.PostFormValue("csrf") != s.csrf {
+		page.Error = "The form has expired, please try again."
+		renderPortal(w, http.StatusForbidden, page)
+		return
+	}
+	newUser := NewUser{
+		ClientName:  strings.TrimSpace(r.PostFormValue("client_name")),
+		GenerateKey: r.PostFormValue("generate_key") != "",
+		Profile:     r.PostFormValue("profile"),
+	}
+	if !newUser.GenerateKey {
+		newUser.PublicKey = strings.TrimSpace(r.PostFormValue("public_key"))
+		if file, _, err := r.FormFile("public_key_file"); err == nil {
+			uploaded, err := ioutil.ReadAll(file)
+			file.Close()
+			if err == nil && len(bytes.TrimSpace(uploaded)) > 0 {
+				newUser.PublicKey = string(bytes.TrimSpace(uploaded))
+			}
+		}
+		if _, err := wgtypes.ParseKey(newUser.PublicKey); err != nil {
+			page.Error = "That isn't a valid WireGuard public key."
+			renderPortal(w, http.StatusBadRequest, page)
+			return
+		}
+	}
+	if newUser.ClientName == "" {
+		newUser.ClientName = "device"
+	}
+	newUser.actor.SourceIP = sourceIP(r)
+	created, err := createUserFor(newUser, s.claims, s.policy)
+	if errors.Is(err, errForbidden) {
+		log.Warn().Str("ip", r.RemoteAddr).Err(err).Msg("portal request permission denied")
+		page.Error = "You aren't allowed to use this VPN."
+		renderPortal(w, http.StatusForbidden, page)
+		return
+	} else if errors.Is(err, errStaleLogin) {
+		page.Error = "This device is already connected. Log in again to restart its time."
+		renderPortal(w, http.StatusUnauthorized, page)
+		return
+	} else if errors.Is(err, errInvalidUser) {
+		page.Error = "The device name can only have letters, digits, '.', '@', '_' and '-'."
+		renderPortal(w, http.StatusBadRequest, page)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("error creating portal user")
+		page.Error = "Couldn't create your config, try again later."
+		renderPortal(w, http.StatusInternalServerError, page)
+		return
+	}
+	log.Info().Str("new user", created.ClientName).Str("sub", created.Subject).
+		Str("email", created.Email).Str("public key", created.PublicKey).Msg("created new user via portal")
+	page.ClientName = created.ClientName
+	page.Config = created.WGConf
+	page.GeneratedKey = created.GenerateKey
+	if page.GeneratedKey {
+		if png, err := configQRPNG(page.Config); err == nil {
+			page.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+		} else {
+			log.Error().AnErr("error rendering QR code", err)
+		}
+	}
+	page.FileName = "wg2fa.conf"
+	page.DownloadURL = template.URL("data:text/plain;base64," + base64.StdEncoding.EncodeToString([]byte(page.Config)))
+	// pages with a private key in them shouldn't be cached anywhere
+	w.Header().Set("Cache-Control", "no-store")
+	renderPortal(w, http.StatusOK, page)
+}
+
+// renderPortal executes the portal template
+func renderPortal(w http.ResponseWriter, status int, page portalPage) {
+	tmpl := loadedTemplates().portal
+	if tmpl == nil {
+		var err error
+		if tmpl, err = template.ParseFiles(portalTemplatePath); err != nil {
+			log.Error().AnErr("couldn't template portal page", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		log.Error().AnErr("couldn't execute portal template", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// pkceChallenge is the RFC 7636 S256 code challenge for a verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockCodeIdP adds an authorization code token endpoint to a stub issuer. It
+// checks the PKCE verifier against the challenge the code was issued for
+type mockCodeIdP struct {
+	iss *stubIssuer
+	mu  sync.Mutex
+	// challenges maps issued codes to their PKCE challenge
+	challenges map[string]string
+	claims     map[string]interface{}
+	forms      []url.Values
+}
+
+func newMockCodeIdP(t *testing.T) *mockCodeIdP {
+	m := &mockCodeIdP{iss: newStubIssuer(t), challenges: make(map[string]string)}
+	m.claims = m.iss.claims()
+	m.iss.mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.forms = append(m.forms, r.PostForm)
+		challenge, ok := m.challenges[r.PostForm.Get("code")]
+		delete(m.challenges, r.PostForm.Get("code"))
+		if r.PostForm.Get("grant_type") != "authorization_code" || !ok ||
+			pkceChallenge(r.PostForm.Get("code_verifier")) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": m.iss.sign(t, "RS256", "rsa1", m.claims),
+			"token_type":   "Bearer",
+		})
+	})
+	return m
+}
+
+// approve plays the user logging in at the IdP, returning the callback query
+func (m *mockCodeIdP) approve(t *testing.T, authURL string) url.Values {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("bad authorization URL %s", authURL)
+	}
+	q := u.Query()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code := "code-" + q.Get("state")[:8]
+	m.challenges[code] = q.Get("code_challenge")
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+// useTestPortal wires up the verifier, wireguard client and portal globals
+// against a mock IdP
+func useTestPortal(t *testing.T, dbName string) (*mockCodeIdP, *fakeBackend) {
+	m := newMockCodeIdP(t)
+	useTestVerifier(t, m.iss.config())
+	fb := useTestWGClient(t, dbName)
+	p, err := newLoginPortal("https://vpn.example.com/", "client123", "", []string{"openid", "email"}, tokenVerifier.metadata)
+	if err != nil {
+		t.Fatalf("error creating portal: %s", err)
+	}
+	old := portal
+	portal = p
+	t.Cleanup(func() { portal = old })
+	return m, fb
+}
+
+// browser carries cookies between requests to the router
+type browser struct {
+	router  http.Handler
+	cookies map[string]*http.Cookie
+}
+
+func (b *browser) do(r *http.Request) *httptest.ResponseRecorder {
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	b.router.ServeHTTP(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b.cookies, c.Name)
+		} else {
+			b.cookies[c.Name] = c
+		}
+	}
+	return w
+}
+
+// login goes through the portal's login and returns the form's CSRF token
+func (b *browser) login(t *testing.T, m *mockCodeIdP) string {
+	w := b.do(httptest.NewRequest("GET", "/portal", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the IdP, got %d", w.Code)
+	}
+	callback := m.approve(t, w.Header().Get("Location"))
+	w = b.do(httptest.NewRequest("GET", "/portal/callback?"+callback.Encode(), nil))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("callback returned %d: %s", w.Code, w.Body.String())
+	}
+	w = b.do(httptest.NewRequest("GET", "/portal", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the portal form, got %d", w.Code)
+	}
+	match := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if match == nil {
+		t.Fatalf("no CSRF token in the form:\n%s", w.Body.String())
+	}
+	return match[1]
+}
+
+func portalForm(t *testing.T, fields map[string]string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/portal/newuser", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestPortalLoginRedirect(t *testing.T) {
+	m, _ := useTestPortal(t, "portalredirect.db")
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/portal", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d", w.Code)
+	}
+	u, _ := url.Parse(w.Header().Get("Location"))
+	q := u.Query()
+	if !strings.HasPrefix(u.String(), m.iss.server.URL+"/authorize?") {
+		t.Errorf("redirected to %s, not the IdP", u)
+	}
+	expected := map[string]string{
+		"response_type":         "code",
+		"client_id":             "client123",
+		"redirect_uri":          "https://vpn.example.com/portal/callback",
+		"scope":                 "openid email",
+		"code_challenge_method": "S256",
+	}
+	for k, v := range expected {
+		if q.Get(k) != v {
+			t.Errorf("%s: expected %q, got %q", k, v, q.Get(k))
+		}
+	}
+	if q.Get("state") == "" || len(q.Get("code_challenge")) != 43 {
+		t.Errorf("missing state or PKCE challenge in %s", u)
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != portalStateCookie || cookie.Value != q.Get("state") || !cookie.Secure || !cookie.HttpOnly {
+		t.Errorf("wrong state cookie %+v", cookie)
+	}
+}
+
+func TestPortalPastedKey(t *testing.T) {
+	m, fb := useTestPortal(t, "portalpasted.db")
+	b := &browser{router: newRouter(), cookies: make(map[string]*http.Cookie)}
+	csrf := b.login(t, m)
+	if m.forms[0].Get("redirect_uri") != "https://vpn.example.com/portal/callback" {
+		t.Errorf("wrong token request %v", m.forms[0])
+	}
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	w := b.do(portalForm(t, map[string]string{"csrf": csrf, "client_name": "laptop", "public_key": pubkey + "\n"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a config, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "PrivateKey = CLIENT_PRIVATE_KEY") ||
+		!strings.Contains(w.Body.String(), `href="data:text/plain;base64,`) {
+		t.Errorf("config or download link missing:\n%s", w.Body.String())
+	}
+	clients, _ := getClients()
+	if len(clients) != 1 || clients[0].Subject != "00u1abcd" || clients[0].Name != "laptop" {
+		t.Errorf("peer wasn't stored for the logged in user: %+v", clients)
+	}
+	if _, ok := fb.peers["wg0"][pubkey]; !ok {
+		t.Errorf("peer wasn't added to the backend")
+	}
+}
+
+func TestPortalGeneratedKey(t *testing.T) {
+	m, fb := useTestPortal(t, "portalgenerated.db")
+	b := &browser{router: newRouter(), cookies: make(map[string]*http.Cookie)}
+	csrf := b.login(t, m)
+	w := b.do(portalForm(t, map[string]string{"csrf": csrf, "client_name": "phone", "generate_key": "true"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a config, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "CLIENT_PRIVATE_KEY") {
+		t.Errorf("private key wasn't filled in")
+	}
+	if !strings.Contains(w.Body.String(), `<img src="data:image/png;base64,`) {
+		t.Errorf("no QR code for the generated config")
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("a page with a private key shouldn't be cached")
+	}
+	if len(fb.peers["wg0"]) != 1 {
+		t.Errorf("peer wasn't added to the backend")
+	}
+}
+
+func TestPortalRejects(t *testing.T) {
+	m, fb := useTestPortal(t, "portalrejects.db")
+	router := newRouter()
+	// a callback without the browser's state cookie
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/portal", nil))
+	callback := m.approve(t, w.Header().Get("Location"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/portal/callback?"+callback.Encode(), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 without the state cookie, got %d", w.Code)
+	}
+	// a form post without the CSRF token
+	b := &browser{router: router, cookies: make(map[string]*http.Cookie)}
+	b.login(t, m)
+	w = b.do(portalForm(t, map[string]string{"client_name": "laptop", "generate_key": "true"}))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a 403 without the CSRF token, got %d", w.Code)
+	}
+	// a form post without a session goes back to the login
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, portalForm(t, map[string]string{"generate_key": "true"}))
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("expected a redirect without a session, got %d", w.Code)
+	}
+	if len(fb.peers["wg0"]) != 0 {
+		t.Errorf("no peer should have been added")
+	}
+}
+
+func TestPortalPolicyDenied(t *testing.T) {
+	m, _ := useTestPortal(t, "portalpolicy.db")
+	policies = loadTestPolicies(t)
+	defer func() { policies = nil }()
+	m.claims["groups"] = []string{"contractors"}
+	b := &browser{router: newRouter(), cookies: make(map[string]*http.Cookie)}
+	w := b.do(httptest.NewRequest("GET", "/portal", nil))
+	callback := m.approve(t, w.Header().Get("Location"))
+	w = b.do(httptest.NewRequest("GET", "/portal/callback?"+callback.Encode(), nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a 403 for a denied user, got %d", w.Code)
+	}
+	if _, ok := b.cookies[portalSessionCookie]; ok {
+		t.Errorf("denied users shouldn't get a session")
+	}
+}
+
+func TestPortalLoginLimits(t *testing.T) {
+	useTestPortal(t, "portallimits.db")
+	router := newRouter()
+	now := time.Now()
+	portal.now = func() time.Time { return now }
+	portal.maxLogins = 2
+	get := func(ip string) int {
+		r := httptest.NewRequest("GET", "/portal", nil)
+		r.RemoteAddr = ip + ":40000"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	if get("192.0.2.1") != http.StatusFound || get("192.0.2.2") != http.StatusFound {
+		t.Fatalf("logins under the cap were refused")
+	}
+	if code := get("192.0.2.3"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 once the pending logins are capped, got %d", code)
+	}
+	// pending logins expire and make room
+	now = now.Add(portalLoginTimeout + time.Second)
+	if code := get("192.0.2.3"); code != http.StatusFound {
+		t.Errorf("expected expired logins to be dropped, got %d", code)
+	}
+	if len(portal.logins) != 1 {
+		t.Errorf("expected 1 pending login, got %d", len(portal.logins))
+	}
+
+	portal.maxLogins = maxPortalLogins
+	for i := 0; i < portalLoginLimit; i++ {
+		get("198.51.100.1")
+	}
+	if code := get("198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Errorf("expected a 429 past the per address limit, got %d", code)
+	}
+}
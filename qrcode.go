@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// QR code output formats for client configs
+const (
+	formatQRPNG = "qr-png"
+	formatQRSVG = "qr-svg"
+)
+
+// qrModulePixels is the size of one QR code module in PNGs
+const qrModulePixels = 6
+
+var errIncompleteConfig = errors.New("config has no private key, only configs with server generated keys can be shown as a QR code")
+
+// newConfigQR encodes a complete client config, for the WireGuard mobile
+// apps' QR scanner. Configs still holding the private key placeholder are
+// refused, a phone can't fill it in
+func newConfigQR(conf string) (*qrcode.QRCode, error) {
+	if strings.Contains(conf, clientPrivateKeyPlaceholder) {
+		return nil, errIncompleteConfig
+	}
+	return qrcode.New(conf, qrcode.Medium)
+}
+
+// configQRPNG renders a client config as a PNG QR code
+func configQRPNG(conf string) ([]byte, error) {
+	q, err := newConfigQR(conf)
+	if err != nil {
+		return nil, err
+	}
+	return q.PNG(-qrModulePixels)
+}
+
+// configQRSVG renders a client config as an SVG QR code
+func configQRSVG(conf string) ([]byte, error) {
+	q, err := newConfigQR(conf)
+	if err != nil {
+		return nil, err
+	}
+	bits := q.Bitmap()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, len(bits), len(bits))
+	buf.WriteString(`<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="`)
+	for y, row := range bits {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes(), nil
+}
+
+// configQRTerminal renders a client config as UTF-8 block characters, for
+// terminals with a dark background
+func configQRTerminal(conf string) (string, error) {
+	q, err := newConfigQR(conf)
+	if err != nil {
+		return "", err
+	}
+	return q.ToSmallString(false), nil
+}
+
+// writeConfigQR writes a client config as a QR code image in format
+func writeConfigQR(w http.ResponseWriter, format, conf string) error {
+	var img []byte
+	var err error
+	contentType := "image/png"
+	if format == formatQRSVG {
+		img, err = configQRSVG(conf)
+		contentType = "image/svg+xml"
+	} else {
+		img, err = configQRPNG(conf)
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	// the image holds a private key
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(img)
+	return nil
+}
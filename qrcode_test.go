@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const completeTestConfig = `[Interface]
+PrivateKey = cHJpdmF0ZWtleXByaXZhdGVrZXlwcml2YXRla2V5cHI=
+Address = 10.0.0.2/24
+DNS = 8.8.8.8
+
+[Peer]
+PublicKey = i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=
+PresharedKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+Endpoint = example.com:51820
+`
+
+func TestConfigQR(t *testing.T) {
+	png, err := configQRPNG(completeTestConfig)
+	if err != nil || !bytes.HasPrefix(png, []byte("\x89PNG")) {
+		t.Errorf("expected a PNG, got %v", err)
+	}
+	svg, err := configQRSVG(completeTestConfig)
+	if err != nil || !bytes.HasPrefix(svg, []byte("<svg")) || !bytes.Contains(svg, []byte("h1v1h-1z")) {
+		t.Errorf("expected an SVG, got %v", err)
+	}
+	term, err := configQRTerminal(completeTestConfig)
+	if err != nil || !strings.ContainsAny(term, "█▀▄") {
+		t.Errorf("expected block characters, got %v", err)
+	}
+	incomplete := strings.Replace(completeTestConfig, "cHJpdmF0ZWtleXByaXZhdGVrZXlwcml2YXRla2V5cHI=", clientPrivateKeyPlaceholder, 1)
+	if _, err := configQRPNG(incomplete); err != errIncompleteConfig {
+		t.Errorf("expected errIncompleteConfig, got %v", err)
+	}
+}
+
+func TestNewUserHandlerQR(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	fb := useTestWGClient(t, "handlerqr.db")
+	token := "Bearer " + iss.sign(t, "RS256", "rsa1", iss.claims())
+	cases := []struct {
+		target      string
+		body        string
+		status      int
+		contentType string
+	}{
+		{"/newuser?format=qr-png", `{"client_name": "phone", "generate_key": true}`, http.StatusOK, "image/png"},
+		{"/newuser?format=qr-svg", `{"client_name": "tablet", "generate_key": true}`, http.StatusOK, "image/svg+xml"},
+		{"/newuser?format=qr-png", `{"client_name": "laptop", "public_key": "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="}`, http.StatusBadRequest, ""},
+		{"/newuser?format=gif", `{"client_name": "phone", "generate_key": true}`, http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", c.target, strings.NewReader(c.body))
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.target, c.status, w.Code)
+		}
+		if c.contentType != "" && w.Header().Get("Content-Type") != c.contentType {
+			t.Errorf("%s: wrong content type %s", c.target, w.Header().Get("Content-Type"))
+		}
+	}
+	// rejected requests don't create peers
+	if len(fb.peers["wg0"]) != 2 {
+		t.Errorf("expected 2 peers, got %d", len(fb.peers["wg0"]))
+	}
+}
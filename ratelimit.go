@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiterMaxKeys bounds how many keys a rateLimiter tracks in a window.
+// Keys past it share one count, so a flood from many addresses is still
+// limited
+const rateLimiterMaxKeys = 10000
+
+// rateLimiter allows limit events per key, usually a source IP, in each
+// window
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	// now is time.Now, swapped out in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	started time.Time
+	counts  map[string]int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, now: time.Now, counts: make(map[string]int)}
+}
+
+// allow counts an event for key and reports whether it's within the limit
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.started) >= l.window {
+		l.started = now
+		l.counts = make(map[string]int)
+	}
+	if _, ok := l.counts[key]; !ok && len(l.counts) >= rateLimiterMaxKeys {
+		key = ""
+	}
+	if l.counts[key] >= l.limit {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadMu guards the settings a reload swaps in: wgclient's client config
+// settings, watchdogConfig, policies and adminClaims. Readers copy what they
+// need so a request or watchdog sweep sees either the old or the new config,
+// never a mix
+var reloadMu sync.RWMutex
+
+// configSource is where the running config was read from, to read it again
+// on reload
+var configSource struct {
+	path  string
+	flags *flag.FlagSet
+}
+
+// startupConfig is the config wg2fa was started with. Settings a reload can't
+// change are compared against it
+var startupConfig Config
+
+// templateSet holds the parsed templates
+type templateSet struct {
+	// text are the client config templates by path
+	text   map[string]*template.Template
+	portal *htmltemplate.Template
+}
+
+var templates atomic.Value
+
+// loadedTemplates returns the templates parsed at the last (re)load. Before
+// the first load it's empty and templates are read from disk as they're used
+func loadedTemplates() *templateSet {
+	set, _ := templates.Load().(*templateSet)
+	if set == nil {
+		return &templateSet{}
+	}
+	return set
+}
+
+// parseTemplates parses every template in the template directory
+func parseTemplates() (*templateSet, error) {
+	set := &templateSet{text: make(map[string]*template.Template)}
+	for _, path := range []string{clientTemplatePath, nmConnectionTemplatePath, netdevTemplatePath, networkTemplatePath} {
+		tmpl, err := parseClientTemplate(path)
+		if err != nil {
+			return nil, err
+		}
+		set.text[path] = tmpl
+	}
+	portal, err := htmltemplate.ParseFiles(portalTemplatePath)
+	if err != nil {
+		return nil, err
+	}
+	set.portal = portal
+	return set, nil
+}
+
+// currentClient returns a copy of the wireguard client with the current
+// settings
+func currentClient() WGClient {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return wgclient
+}
+
+// currentPolicies returns the current access policies, nil if there are none
+func currentPolicies() *PolicySet {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return policies
+}
+
+// currentWatchdogConfig returns a copy of the watchdog's current timeouts,
+// nil if the watchdog isn't running
+func currentWatchdogConfig() *removeClientConfig {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	if watchdogConfig == nil {
+		return nil
+	}
+	rc := *watchdogConfig
+	return &rc
+}
+
+// restartSettings are the config keys a reload can't change
+var restartSettings = []struct {
+	key   string
+	value func(c Config) interface{}
+}{
+	{"listen", func(c Config) interface{} { return c.Listen }},
+	{"wireguard.config_path", func(c Config) interface{} { return c.WireGuard.ConfigPath }},
+	{"wireguard.client_list_path", func(c Config) interface{} { return c.WireGuard.ClientListPath }},
+	{"wireguard.interface", func(c Config) interface{} { return c.WireGuard.Interface }},
+	{"auth.issuer", func(c Config) interface{} { return c.Auth.Issuer }},
+	{"auth.client_id", func(c Config) interface{} { return c.Auth.ClientID }},
+	{"auth.client_secret", func(c Config) interface{} { return c.Auth.ClientSecret }},
+	{"auth.audiences", func(c Config) interface{} { return c.Auth.Audiences }},
+	{"auth.algorithms", func(c Config) interface{} { return c.Auth.Algorithms }},
+	{"auth.scopes", func(c Config) interface{} { return c.Auth.Scopes }},
+	{"auth.client_id_claim", func(c Config) interface{} { return c.Auth.ClientIDClaim }},
+	{"auth.required_claims", func(c Config) interface{} { return c.Auth.RequiredClaims }},
+	{"auth.portal_url", func(c Config) interface{} { return c.Auth.PortalURL }},
+	{"templates.dir", func(c Config) interface{} { return c.Templates.Dir }},
+	{"webhooks", func(c Config) interface{} { return c.Webhooks }},
+	{"audit.key_file", func(c Config) interface{} { return c.Audit.KeyFile }},
+}
+
+// reloadConfig reads the config file, policy file and templates again and
+// swaps them in. The watchdog keeps running and requests already being
+// handled finish with the settings they started with. If anything fails to
+// load the running config is kept
+func reloadConfig() error {
+	config, err := loadConfig(configSource.path, os.Environ(), configSource.flags)
+	if err != nil {
+		return err
+	}
+	var ps *PolicySet
+	if config.Auth.PolicyFile != "" {
+		if ps, err = loadPolicies(config.Auth.PolicyFile); err != nil {
+			return err
+		}
+	}
+	set, err := parseTemplates()
+	if err != nil {
+		return err
+	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	for _, setting := range restartSettings {
+		if !reflect.DeepEqual(setting.value(startupConfig), setting.value(config)) {
+			log.Warn().Str("setting", setting.key).Msg("setting changed, it needs a restart to take effect")
+		}
+	}
+	wgclient.DNSServers = config.WireGuard.DNSServers
+	wgclient.ServerHostname = config.WireGuard.ServerHostname
+	wgclient.AllowedIPs = config.WireGuard.AllowedIPs
+	wgclient.PersistentKeepalive = config.WireGuard.PersistentKeepalive
+	wgclient.MTU = config.WireGuard.MTU
+	policies = ps
+	adminClaims = config.Auth.AdminClaims
+	if watchdogConfig != nil {
+		watchdogConfig.ForceTime = config.Watchdog.ForceTime
+		watchdogConfig.IdleTime = config.Watchdog.IdleTime
+		watchdogConfig.FirstHandshakeTime = config.Watchdog.FirstHandshakeTime
+		watchdogConfig.ExpiryWarning = config.Watchdog.ExpiryWarning
+		watchdogConfig.Policies = ps
+	}
+	templates.Store(set)
+	// the deadlines depend on the timeouts
+	wakeWatchdog()
+	setLogLevel(config.Debug)
+	return nil
+}
+
+// setLogLevel logs at debug level if debug is set, and info level otherwise
+func setLogLevel(debug bool) {
+	level := zerolog.InfoLevel
+	if debug {
+		level = zerolog.DebugLevel
+	}
+	zerolog.SetGlobalLevel(level)
+}
+
+// reloadOnSIGHUP reloads the config every time the process gets a SIGHUP
+func reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Info().Msg("SIGHUP received, reloading config")
+		if err := reloadConfig(); err != nil {
+			log.Error().Str("error", err.Error()).Msg("config reload failed, keeping the running config")
+			continue
+		}
+		log.Info().Msg("config reloaded")
+	}
+}
+
+// ReloadHandler reloads the config, like a SIGHUP
+func ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+	log.Info().Str("sub", claims.String("sub")).Msg("config reload requested")
+	if err := reloadConfig(); err != nil {
+		log.Error().Str("error", err.Error()).Msg("config reload failed, keeping the running config")
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Info().Msg("config reloaded")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// useTestReload points the reload at a config file and copies of the client
+// and portal templates in a temporary directory, returning both directories'
+// paths
+func useTestReload(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	templateDir := filepath.Join(dir, "templates")
+	oldPaths := []string{clientTemplatePath, serverTemplatePath, portalTemplatePath, nmConnectionTemplatePath, netdevTemplatePath, networkTemplatePath}
+	oldSource, oldStartup, oldPolicies := configSource, startupConfig, policies
+	if err := copyDir(filepath.Join(".", "text_templates"), templateDir); err != nil {
+		t.Fatalf("error copying templates: %s", err)
+	}
+	useTemplateDir(templateDir)
+	configSource.path, configSource.flags = filepath.Join(dir, "config.yaml"), nil
+	t.Cleanup(func() {
+		clientTemplatePath, serverTemplatePath, portalTemplatePath = oldPaths[0], oldPaths[1], oldPaths[2]
+		nmConnectionTemplatePath, netdevTemplatePath, networkTemplatePath = oldPaths[3], oldPaths[4], oldPaths[5]
+		configSource, startupConfig, policies = oldSource, oldStartup, oldPolicies
+		templates.Store((*templateSet)(nil))
+	})
+	return dir, templateDir
+}
+
+func copyDir(from, to string) error {
+	files, err := ioutil.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(to, 0700); err != nil {
+		return err
+	}
+	for _, f := range files {
+		raw, err := ioutil.ReadFile(filepath.Join(from, f.Name()))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(to, f.Name()), raw, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTestConfig(t *testing.T, dir, templateDir, extra string) {
+	conf := "auth:\n  issuer: https://idp.example.com\n  client_id: client123\n  admin_claims: {groups: vpn-admins}\n" +
+		"templates:\n  dir: " + templateDir + "\n" + extra
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.yaml"), []byte(conf), 0600); err != nil {
+		t.Fatalf("error writing config: %s", err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	fb := useTestWGClient(t, "reload.db")
+	useTestAdmin(t)
+	dir, templateDir := useTestReload(t)
+	writeTestConfig(t, dir, templateDir, "wireguard:\n  dns_servers: [10.0.0.1]\n  mtu: 1380\nwatchdog:\n  idle_time: 30\n  force_time: 480\n  first_handshake_time: 5\n")
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("error reloading: %s", err)
+	}
+	rc := currentWatchdogConfig()
+	if rc.IdleTime != 30 || rc.ForceTime != 480 || rc.FirstHandshakeTime != 5 {
+		t.Errorf("watchdog timeouts weren't reloaded: %+v", rc)
+	}
+	// the client template is swapped in with the settings
+	tmpl := filepath.Join(templateDir, "client_config.txt")
+	raw, _ := ioutil.ReadFile(tmpl)
+	ioutil.WriteFile(tmpl, append([]byte("# managed by wg2fa\n"), raw...), 0600)
+	writeTestConfig(t, dir, templateDir, "wireguard:\n  dns_servers: [10.0.0.2]\n")
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("error reloading: %s", err)
+	}
+	created, err := currentClient().newUser(NewUser{ClientName: "laptop", PublicKey: "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="}, nil)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	if !strings.HasPrefix(created.WGConf, "# managed by wg2fa\n") || !strings.Contains(created.WGConf, "DNS = 10.0.0.2\n") ||
+		strings.Contains(created.WGConf, "MTU") {
+		t.Errorf("reloaded settings and template weren't used:\n%s", created.WGConf)
+	}
+	// a broken config or template keeps everything as it was
+	writeTestConfig(t, dir, templateDir, "wireguard:\n  dns_servers: [10.0.0.3]\n  mtu: 1\n")
+	if err := reloadConfig(); err == nil {
+		t.Errorf("expected an invalid config to be refused")
+	}
+	writeTestConfig(t, dir, templateDir, "wireguard:\n  dns_servers: [10.0.0.3]\n")
+	ioutil.WriteFile(tmpl, []byte("{{.Broken"), 0600)
+	if err := reloadConfig(); err == nil {
+		t.Errorf("expected a broken template to be refused")
+	}
+	if dns := currentClient().DNSServers; len(dns) != 1 || dns[0] != "10.0.0.2" {
+		t.Errorf("failed reload changed the DNS servers to %v", dns)
+	}
+	if _, ok := loadedTemplates().text[clientTemplatePath]; !ok {
+		t.Errorf("failed reload dropped the templates")
+	}
+	if len(fb.peers["wg0"]) != 1 {
+		t.Errorf("expected the peer to be added")
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	useTestWGClient(t, "reloadhandler.db")
+	useTestAdmin(t)
+	dir, templateDir := useTestReload(t)
+	writeTestConfig(t, dir, templateDir, "watchdog:\n  idle_time: 45\n")
+	claims := iss.claims()
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, authedRequest("POST", "/admin/reload", iss.sign(t, "RS256", "rsa1", claims)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a 403 for a non-admin, got %d", w.Code)
+	}
+	claims["groups"] = []string{"vpn-admins"}
+	token := iss.sign(t, "RS256", "rsa1", claims)
+	w = httptest.NewRecorder()
+	newRouter().ServeHTTP(w, authedRequest("POST", "/admin/reload", token))
+	if w.Code != http.StatusOK || currentWatchdogConfig().IdleTime != 45 {
+		t.Errorf("expected the config to be reloaded, got %d: %s", w.Code, w.Body.String())
+	}
+	writeTestConfig(t, dir, templateDir, "watchdog:\n  idle_time: soon\n")
+	w = httptest.NewRecorder()
+	newRouter().ServeHTTP(w, authedRequest("POST", "/admin/reload", token))
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "soon") {
+		t.Errorf("expected the invalid config to be reported, got %d: %s", w.Code, w.Body.String())
+	}
+	if currentWatchdogConfig().IdleTime != 45 {
+		t.Errorf("failed reload changed the idle time")
+	}
+}
+
+func TestReloadLogLevel(t *testing.T) {
+	useTestWGClient(t, "reloadloglevel.db")
+	useTestAdmin(t)
+	dir, templateDir := useTestReload(t)
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	writeTestConfig(t, dir, templateDir, "debug: true\n")
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("error reloading: %s", err)
+	}
+	if zerolog.GlobalLevel() != zerolog.DebugLevel {
+		t.Errorf("expected debug logging, got %s", zerolog.GlobalLevel())
+	}
+	// and back again
+	writeTestConfig(t, dir, templateDir, "debug: false\n")
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("error reloading: %s", err)
+	}
+	if zerolog.GlobalLevel() != zerolog.InfoLevel {
+		t.Errorf("expected info logging, got %s", zerolog.GlobalLevel())
+	}
+}
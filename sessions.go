@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// session end reasons, besides the watchdog's removeReason timeouts
+const (
+	// sessionEndAdmin is an admin revoking the device
+	sessionEndAdmin = "admin"
+	// sessionEndUser is the owner ending their own session
+	sessionEndUser = "user"
+	// sessionEndReconcile is a session replaced because it no longer matched
+	// its device's enrollment, e.g. after a policy change moved its IP
+	sessionEndReconcile = "reconcile"
+)
+
+// Session is a period a device was active, from being added to the interface
+// until it was removed. Sessions are kept after their wg_user row is deleted
+type Session struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	PublicKey string    `json:"public_key"`
+	IP        string    `json:"ip"`
+	Policy    string    `json:"policy,omitempty"`
+	Started   time.Time `json:"started"`
+	// Ended is unset while the session is active
+	Ended     *time.Time `json:"ended,omitempty"`
+	EndReason string     `json:"end_reason,omitempty"`
+	// Endpoint and the transfer totals are read from the interface when the
+	// session ends
+	Endpoint      string `json:"last_endpoint,omitempty"`
+	ReceiveBytes  int64  `json:"rx_bytes"`
+	TransmitBytes int64  `json:"tx_bytes"`
+	// Identity is the user the session belonged to
+	Identity
+}
+
+const sessionColumns = "id, name, public_key, ip, policy, started, ended, end_reason, endpoint, rx_bytes, tx_bytes, sub, email, display_name"
+
+// startSession records the start of cc's session
+func startSession(tx *sql.Tx, cc ClientConfig, started string) error {
+	_, err := tx.Exec(`INSERT INTO wg_session (public_key, name, ip, policy, started, sub, email, display_name)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`, cc.PublicKey, cc.Name, cc.IP, cc.Policy, started,
+		cc.Subject, cc.Email, cc.DisplayName)
+	return err
+}
+
+// endSession records the end of pubkey's active session. Sessions that
+// started before wg_session existed are recorded from their wg_user row
+func endSession(tx *sql.Tx, pubKey, reason string, status PeerStatus) error {
+	ended := dbTime(time.Now())
+	res, err := tx.Exec(`UPDATE wg_session SET ended = $1, end_reason = $2, endpoint = $3, rx_bytes = $4, tx_bytes = $5
+		WHERE public_key = $6 AND ended = '';`, ended, reason, status.Endpoint, status.ReceiveBytes, status.TransmitBytes, pubKey)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO wg_session (public_key, name, ip, policy, started, sub, email, display_name,
+		ended, end_reason, endpoint, rx_bytes, tx_bytes)
+		SELECT public_key, name, ip, policy, added, sub, email, display_name, $1, $2, $3, $4, $5
+		FROM wg_user WHERE public_key = $6;`, ended, reason, status.Endpoint, status.ReceiveBytes, status.TransmitBytes, pubKey)
+	return err
+}
+
+// sessionFilter selects sessions for a report. Zero fields match everything
+type sessionFilter struct {
+	// User matches the session owner's sub or email
+	User string
+	// From and To select the sessions that were active at any time between
+	// them
+	From time.Time
+	To   time.Time
+}
+
+// sessionBound formats a filter time for comparing with the times in
+// wg_session, which are whole seconds. It's rounded up so the comparisons
+// match the exact time's, and the zero time is ""
+func sessionBound(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	if t.Truncate(time.Second).Before(t) {
+		t = t.Truncate(time.Second).Add(time.Second)
+	}
+	return dbTime(t)
+}
+
+// getSessions returns the sessions matching f, oldest first. The times are
+// compared as strings in SQL, which works as they're all UTC. A row with an
+// invalid time fails the whole report rather than going missing from it
+func getSessions(f sessionFilter) ([]Session, error) {
+	sessions := make([]Session, 0)
+	rows, err := db.Query("SELECT "+sessionColumns+` FROM wg_session WHERE ($1 = '' OR sub = $1 OR email = $1)
+		AND ($2 = '' OR started < $2) AND ($3 = '' OR ended = '' OR ended >= $3) ORDER BY started, id;`,
+		f.User, sessionBound(f.To), sessionBound(f.From))
+	if err != nil {
+		log.Error().Err(err).Msg("error selecting sessions")
+		return sessions, errors.New("error selecting from sqlite")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s Session
+		var started, ended string
+		err := rows.Scan(&s.ID, &s.Name, &s.PublicKey, &s.IP, &s.Policy, &started, &ended, &s.EndReason,
+			&s.Endpoint, &s.ReceiveBytes, &s.TransmitBytes, &s.Subject, &s.Email, &s.DisplayName)
+		if err != nil {
+			log.Error().Err(err).Msg("error scanning session row")
+			return sessions, errors.New("error selecting from sqlite")
+		}
+		if s.Started, err = time.Parse(time.RFC3339, started); err != nil {
+			log.Error().Err(err).Int64("id", s.ID).Msg("error parsing session start")
+			return sessions, fmt.Errorf("session %d has an invalid start time %q", s.ID, started)
+		}
+		if ended != "" {
+			end, err := time.Parse(time.RFC3339, ended)
+			if err != nil {
+				log.Error().Err(err).Int64("id", s.ID).Msg("error parsing session end")
+				return sessions, fmt.Errorf("session %d has an invalid end time %q", s.ID, ended)
+			}
+			s.Ended = &end
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Msg("error reading sessions")
+		return sessions, errors.New("error selecting from sqlite")
+	}
+	return sessions, nil
+}
+
+// sessionFilterFromRequest reads the user, from and to parameters. Times are
+// RFC 3339
+func sessionFilterFromRequest(r *http.Request) (sessionFilter, error) {
+	q := r.URL.Query()
+	f := sessionFilter{User: q.Get("user")}
+	for _, t := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		if q.Get(t.name) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, q.Get(t.name))
+		if err != nil {
+			return f, errors.New(t.name + " isn't an RFC 3339 time")
+		}
+		*t.value = parsed
+	}
+	return f, nil
+}
+
+// wantsCSV reports whether a report was asked for as CSV, with format=csv or
+// an Accept header preferring text/csv to JSON
+func wantsCSV(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "csv"
+	}
+	for _, mediaType := range acceptedMediaTypes(r.Header.Get("Accept")) {
+		switch mediaType {
+		case "text/csv":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+// SessionsReportHandler returns the session history as JSON or CSV
+func SessionsReportHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := sessionFilterFromRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	sessions, err := getSessions(f)
+	if err != nil {
+		log.Error().Err(err).Msg("error getting sessions from DB")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !wantsCSV(r) {
+		writeJSON(w, http.StatusOK, sessions)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="sessions.csv"`)
+	if err := writeSessionsCSV(w, sessions); err != nil {
+		log.Error().Err(err).Msg("error writing sessions CSV")
+	}
+}
+
+// csvText escapes a cell that came from a token or a client, so a spreadsheet
+// doesn't run it as a formula
+func csvText(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return "'" + s
+	}
+	return s
+}
+
+func writeSessionsCSV(w http.ResponseWriter, sessions []Session) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "sub", "email", "display_name", "name", "public_key", "ip", "policy",
+		"started", "ended", "end_reason", "last_endpoint", "rx_bytes", "tx_bytes"})
+	for _, s := range sessions {
+		ended := ""
+		if s.Ended != nil {
+			ended = s.Ended.Format(time.RFC3339)
+		}
+		cw.Write([]string{strconv.FormatInt(s.ID, 10), csvText(s.Subject), csvText(s.Email),
+			csvText(s.DisplayName), csvText(s.Name),
+			s.PublicKey, s.IP, s.Policy, s.Started.Format(time.RFC3339), ended, s.EndReason, s.Endpoint,
+			strconv.FormatInt(s.ReceiveBytes, 10), strconv.FormatInt(s.TransmitBytes, 10)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
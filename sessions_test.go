@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTransfer sets the endpoint and transfer totals reported for a peer
+func (b *fakeBackend) setTransfer(iface, pubkey, endpoint string, rx, tx int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.peers[iface][pubkey]
+	p.Endpoint, p.ReceiveBytes, p.TransmitBytes = endpoint, rx, tx
+	b.peers[iface][pubkey] = p
+}
+
+func TestSessionHistory(t *testing.T) {
+	c, fb := newTestWGClient(t, "sessions.db")
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	alice := Identity{Subject: "alice", Email: "alice@example.com"}
+	login := func() {
+		if _, err := c.newUser(NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: alice}, nil); err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+	login()
+	// logging in again while active continues the session
+	login()
+	fb.setTransfer("wg0", pubkey, "203.0.113.7:51820", 1000, 2000)
+	if err := c.removeUser(pubkey, removeReasonIdle, watchdogActor); err != nil {
+		t.Fatalf("error removing user: %s", err)
+	}
+	login()
+	if _, err := c.newUser(NewUser{ClientName: "phone", PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+		Identity: Identity{Subject: "bob"}}, nil); err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	if err := c.revokeDevice(pubkey, auditActor{Subject: "admin"}); err != nil {
+		t.Fatalf("error revoking device: %s", err)
+	}
+	sessions, err := getSessions(sessionFilter{User: "alice@example.com"})
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("expected 2 of alice's sessions, got %d (%v)", len(sessions), err)
+	}
+	first, second := sessions[0], sessions[1]
+	if first.Ended == nil || first.EndReason != removeReasonIdle || first.Endpoint != "203.0.113.7:51820" ||
+		first.ReceiveBytes != 1000 || first.TransmitBytes != 2000 || first.IP != "10.0.0.2/24" || first.Subject != "alice" {
+		t.Errorf("wrong first session %+v", first)
+	}
+	if second.Ended == nil || second.EndReason != sessionEndAdmin || second.ReceiveBytes != 0 {
+		t.Errorf("wrong second session %+v", second)
+	}
+	// bob's session is still active
+	sessions, _ = getSessions(sessionFilter{User: "bob"})
+	if len(sessions) != 1 || sessions[0].Ended != nil || sessions[0].EndReason != "" {
+		t.Errorf("expected bob's active session, got %+v", sessions)
+	}
+	all, _ := getSessions(sessionFilter{})
+	if len(all) != 3 {
+		t.Errorf("expected 3 sessions, got %d", len(all))
+	}
+	// active sessions overlap any range after they started
+	sessions, _ = getSessions(sessionFilter{From: time.Now().Add(time.Hour)})
+	if len(sessions) != 1 || sessions[0].Subject != "bob" {
+		t.Errorf("expected only the active session later on, got %+v", sessions)
+	}
+	sessions, _ = getSessions(sessionFilter{To: time.Now().Add(-time.Hour)})
+	if len(sessions) != 0 {
+		t.Errorf("expected no sessions before they started, got %+v", sessions)
+	}
+}
+
+func TestSessionFromBeforeHistory(t *testing.T) {
+	c, _ := newTestWGClient(t, "sessionsmigrated.db")
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	if _, err := c.newUser(NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: Identity{Subject: "alice"}}, nil); err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	// the client was added before wg_session existed
+	if _, err := db.Exec("DELETE FROM wg_session;"); err != nil {
+		t.Fatalf("error deleting sessions: %s", err)
+	}
+	client, _, _ := findClient(pubkey)
+	if err := c.removeUser(pubkey, removeReasonForce, watchdogActor); err != nil {
+		t.Fatalf("error removing user: %s", err)
+	}
+	sessions, _ := getSessions(sessionFilter{})
+	if len(sessions) != 1 || !sessions[0].Started.Equal(client.Added) || sessions[0].EndReason != removeReasonForce ||
+		sessions[0].Subject != "alice" || sessions[0].Name != "laptop" {
+		t.Errorf("session wasn't recorded from the client: %+v", sessions)
+	}
+}
+
+func TestSessionsReportHandler(t *testing.T) {
+	iss := newStubIssuer(t)
+	useTestVerifier(t, iss.config())
+	fb := useTestWGClient(t, "sessionsreport.db")
+	useTestAdmin(t)
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	addTestPeer(t, "laptop", pubkey, "alice")
+	addTestPeer(t, "phone", "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", "bob")
+	fb.setTransfer("wg0", pubkey, "203.0.113.7:51820", 1000, 2000)
+	wgclient.removeUser(pubkey, removeReasonIdle, watchdogActor)
+
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, authedRequest("GET", "/reports/sessions", iss.sign(t, "RS256", "rsa1", iss.claims())))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a 403 for a non-admin, got %d", w.Code)
+	}
+	claims := iss.claims()
+	claims["groups"] = []string{"vpn-admins"}
+	token := iss.sign(t, "RS256", "rsa1", claims)
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		r := authedRequest("GET", target, token)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, r)
+		return w
+	}
+
+	w = get("/reports/sessions?user=alice", "")
+	var sessions []Session
+	if err := json.Unmarshal(w.Body.Bytes(), &sessions); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("report returned %d: %s", w.Code, w.Body.String())
+	}
+	if len(sessions) != 1 || sessions[0].EndReason != removeReasonIdle || sessions[0].TransmitBytes != 2000 {
+		t.Errorf("wrong sessions %+v", sessions)
+	}
+
+	for _, w := range []*httptest.ResponseRecorder{get("/reports/sessions?format=csv", ""), get("/reports/sessions", "text/csv")} {
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+			t.Fatalf("expected CSV, got %s", w.Header().Get("Content-Type"))
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil || len(records) != 3 {
+			t.Fatalf("expected a header and 2 sessions, got %v (%v)", records, err)
+		}
+		if records[0][1] != "sub" || records[1][1] != "alice" || records[1][10] != removeReasonIdle ||
+			records[1][11] != "203.0.113.7:51820" || records[1][12] != "1000" || records[2][9] != "" {
+			t.Errorf("wrong CSV %v", records)
+		}
+	}
+
+	from := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	w = get("/reports/sessions?from="+from, "")
+	sessions = nil
+	json.Unmarshal(w.Body.Bytes(), &sessions)
+	if len(sessions) != 1 || sessions[0].Subject != "bob" {
+		t.Errorf("expected only the active session, got %s", w.Body.String())
+	}
+	if w = get("/reports/sessions?to=yesterday", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 for an invalid time, got %d", w.Code)
+	}
+}
+
+func TestSessionTimes(t *testing.T) {
+	newTestWGClient(t, "sessiontimes.db")
+	// sessions used to be recorded in local time
+	_, err := db.Exec(`INSERT INTO wg_session (public_key, ip, started, ended, sub) VALUES
+		('a', '10.0.0.2/24', '2021-01-14T12:00:00+02:00', '2021-01-14T13:30:00+02:00', 'alice'),
+		('b', '10.0.0.3/24', '2021-01-14T10:30:00Z', '', 'bob');`)
+	if err != nil {
+		t.Fatalf("error adding sessions: %s", err)
+	}
+	if err := migrateClientDb(); err != nil {
+		t.Fatalf("error migrating: %s", err)
+	}
+	var started, ended string
+	db.QueryRow("SELECT started, ended FROM wg_session WHERE public_key = 'a';").Scan(&started, &ended)
+	if started != "2021-01-14T10:00:00Z" || ended != "2021-01-14T11:30:00Z" {
+		t.Errorf("times weren't stored in UTC: %s %s", started, ended)
+	}
+	at := func(s string) time.Time {
+		parsed, _ := time.Parse(time.RFC3339Nano, s)
+		return parsed
+	}
+	cases := []struct {
+		f        sessionFilter
+		expected []string
+	}{
+		{sessionFilter{}, []string{"a", "b"}},
+		{sessionFilter{To: at("2021-01-14T12:30:01+02:00")}, []string{"a", "b"}},
+		{sessionFilter{To: at("2021-01-14T10:30:00Z")}, []string{"a"}},
+		{sessionFilter{From: at("2021-01-14T11:30:00Z")}, []string{"a", "b"}},
+		{sessionFilter{From: at("2021-01-14T11:30:00.5Z")}, []string{"b"}},
+		{sessionFilter{From: at("2021-01-14T08:00:00-05:00"), To: at("2021-01-14T14:00:00Z")}, []string{"b"}},
+	}
+	for _, c := range cases {
+		sessions, err := getSessions(c.f)
+		var keys []string
+		for _, s := range sessions {
+			keys = append(keys, s.PublicKey)
+		}
+		if err != nil || strings.Join(keys, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("%+v: expected %v, got %v (%v)", c.f, c.expected, keys, err)
+		}
+	}
+	// a broken row fails the report instead of going missing from it
+	db.Exec("UPDATE wg_session SET ended = 'yesterday' WHERE public_key = 'a';")
+	if _, err := getSessions(sessionFilter{}); err == nil || !strings.Contains(err.Error(), "invalid end time") {
+		t.Errorf("expected an error for an invalid end time, got %v", err)
+	}
+}
+
+func TestSessionsCSVEscapesFormulas(t *testing.T) {
+	started := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	w := httptest.NewRecorder()
+	err := writeSessionsCSV(w, []Session{{ID: 1, Identity: Identity{Subject: "00u1abcd",
+		Email: "=HYPERLINK(\"http://example.com\")", DisplayName: "+1 555"}, Name: "-laptop",
+		PublicKey: "+7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=", Started: started}})
+	if err != nil {
+		t.Fatalf("error writing CSV: %s", err)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("wrong CSV %v (%v)", records, err)
+	}
+	row := records[1]
+	expected := []string{"1", "00u1abcd", "'=HYPERLINK(\"http://example.com\")", "'+1 555", "'-laptop",
+		"+7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="}
+	for i, cell := range expected {
+		if row[i] != cell {
+			t.Errorf("column %s is %q, expected %q", records[0][i], row[i], cell)
+		}
+	}
+}
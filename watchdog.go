@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// reasons the watchdog removes a client
+const (
+	removeReasonForce     = "force_time"
+	removeReasonIdle      = "idle_time"
+	removeReasonHandshake = "first_handshake_time"
+)
+
 type removeClientConfig struct {
 	// ForceTime is the number of minutes since authentication to force
 	// reauthentication. If <= 0 this is ignored
@@ -13,40 +21,198 @@ type removeClientConfig struct {
 	// The number of minutes for a user to be idle before forcing a new auth. If
 	// <= this is ignored
 	IdleTime int64
+	// FirstHandshakeTime is the number of minutes a new client has to make
+	// its first handshake. Until it does the idle time doesn't apply. If <= 0
+	// the idle time counts from when it was added instead
+	FirstHandshakeTime int64
+	// ExpiryWarning is how many minutes before a client's force time runs
+	// out the peer_expiring event is sent. If <= 0 it isn't
+	ExpiryWarning int64
+	// Policies can override ForceTime and IdleTime for the clients created
+	// under them. May be nil
+	Policies *PolicySet
+}
+
+// timeouts returns the force, idle and first handshake time for a client,
+// taken from the policy it was created under when that policy sets them
+func (rc *removeClientConfig) timeouts(client ClientConfig) (int64, int64, int64) {
+	forceTime, idleTime, handshakeTime := rc.ForceTime, rc.IdleTime, rc.FirstHandshakeTime
+	if policy := rc.Policies.byName(client.Policy); policy != nil {
+		if policy.ForceTime != nil {
+			forceTime = *policy.ForceTime
+		}
+		if policy.IdleTime != nil {
+			idleTime = *policy.IdleTime
+		}
+		if policy.FirstHandshakeTime != nil {
+			handshakeTime = *policy.FirstHandshakeTime
+		}
+	}
+	return forceTime, idleTime, handshakeTime
+}
+
+// neverHandshook reports whether a last handshake time means the peer hasn't
+// made one yet. Backends report that as the zero time or the Unix epoch
+func neverHandshook(lastHandshake time.Time) bool {
+	return lastHandshake.IsZero() || lastHandshake.Unix() <= 0
 }
 
-func watchdog(wgc *WGClient, rc *removeClientConfig) {
+// expiry returns when the watchdog removes a client and why, or the zero time
+// if neither timeout applies to it
+func (rc *removeClientConfig) expiry(client ClientConfig, lastHandshake time.Time) (time.Time, string) {
+	forceTime, idleTime, handshakeTime := rc.timeouts(client)
+	var deadline time.Time
+	reason := ""
+	earliest := func(d time.Time, r string) {
+		if deadline.IsZero() || d.Before(deadline) {
+			deadline, reason = d, r
+		}
+	}
+	if forceTime > 0 {
+		earliest(client.Added.Add(time.Duration(forceTime)*time.Minute), removeReasonForce)
+	}
+	switch {
+	case !neverHandshook(lastHandshake):
+		if idleTime > 0 {
+			earliest(lastHandshake.Add(time.Duration(idleTime)*time.Minute), removeReasonIdle)
+		}
+	case handshakeTime > 0:
+		// the user may not have imported the config yet
+		earliest(client.Added.Add(time.Duration(handshakeTime)*time.Minute), removeReasonHandshake)
+	case idleTime > 0:
+		earliest(client.Added.Add(time.Duration(idleTime)*time.Minute), removeReasonIdle)
+	}
+	return deadline, reason
+}
+
+// expiryWarning returns when to warn that a client's force time is running
+// out and when it does, or false if there's no warning to give
+func (rc *removeClientConfig) expiryWarning(client ClientConfig) (time.Time, time.Time, bool) {
+	forceTime, _, _ := rc.timeouts(client)
+	if forceTime <= 0 || rc.ExpiryWarning <= 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	forceAt := client.Added.Add(time.Duration(forceTime) * time.Minute)
+	return forceAt.Add(-time.Duration(rc.ExpiryWarning) * time.Minute), forceAt, true
+}
+
+// clock tells the time and waits, so tests can control both
+type clock interface {
+	Now() time.Time
+	// After waits for d like time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// watchdogRetry is how long the watchdog waits after failing to read the
+// clients or their handshakes, or to remove a client
+const watchdogRetry = 30 * time.Second
+
+// watchdogWake asks a running watchdog to look at the clients again, e.g.
+// after a client was added or the timeouts changed
+var watchdogWake = make(chan struct{}, 1)
+
+// wakeWatchdog wakes the watchdog without waiting for it
+func wakeWatchdog() {
+	select {
+	case watchdogWake <- struct{}{}:
+	default:
+	}
+}
+
+// watchdog removes clients when their deadline passes
+type watchdog struct {
+	// client and config are read at every sweep, so reloaded settings apply
+	// without restarting the watchdog
+	client *WGClient
+	config *removeClientConfig
+	clock  clock
+	// warned is the force deadline each client was last warned about
+	warned map[string]time.Time
+}
+
+// run removes clients until ctx is done. It sleeps until the earliest
+// deadline, or until it's woken by wakeWatchdog
+func (wd *watchdog) run(ctx context.Context) {
 	for {
-		time.Sleep(30 * time.Second)
-		// get all the users
-		clients, err := getClients()
+		var wait <-chan time.Time
+		next, err := wd.sweep()
 		if err != nil {
-			log.Error().AnErr("error getting clients from DB", err)
-			continue
+			wait = wd.clock.After(watchdogRetry)
+		} else if !next.IsZero() {
+			wait = wd.clock.After(next.Sub(wd.clock.Now()))
 		}
-		// get last handshakes
-		lastHandshakes, err := wgc.getLastHandshakes()
-		if err != nil {
-			log.Error().AnErr("Error getting last handshakes", err)
-			continue
+		// with no deadlines wait stays nil and only a wake up or ctx ends this
+		select {
+		case <-ctx.Done():
+			log.Debug().Msg("watchdog stopped")
+			return
+		case <-watchdogWake:
+		case <-wait:
 		}
-		for _, client := range clients {
-			if rc.ForceTime > 0 {
-				minAgo := time.Now().Add(-1 * time.Duration(rc.ForceTime))
-				if client.Added.Before(minAgo) {
-					log.Info().Str("pubkey", client.PublicKey).Msg("Removing client due to Force Time")
-					wgc.removeUser(client.PublicKey)
-					continue
-				}
+	}
+}
+
+// sweep removes the clients whose deadline has passed, warns the ones whose
+// force time is about to run out and returns the earliest deadline or warning
+// left, or the zero time if there are none
+func (wd *watchdog) sweep() (time.Time, error) {
+	reloadMu.RLock()
+	wgc, rc := *wd.client, *wd.config
+	reloadMu.RUnlock()
+	// get all the users
+	clients, err := getClients()
+	if err != nil {
+		log.Error().AnErr("error getting clients from DB", err)
+		return time.Time{}, err
+	}
+	// get last handshakes
+	lastHandshakes, err := wgc.getLastHandshakes()
+	if err != nil {
+		log.Error().AnErr("Error getting last handshakes", err)
+		return time.Time{}, err
+	}
+	now := wd.clock.Now()
+	var next time.Time
+	earliest := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	warned := make(map[string]time.Time)
+	for _, client := range clients {
+		if warnAt, forceAt, ok := rc.expiryWarning(client); ok && forceAt.After(now) {
+			switch {
+			case warnAt.After(now):
+				earliest(warnAt)
+			case !wd.warned[client.PublicKey].Equal(forceAt):
+				// renewing moves the force time, which is warned about again
+				notify(WebhookEvent{Event: eventPeerExpiring, Identity: client.Identity, ClientName: client.Name,
+					PublicKey: client.PublicKey, IP: client.IP, ExpiresAt: &forceAt, Reason: removeReasonForce})
+				fallthrough
+			default:
+				warned[client.PublicKey] = forceAt
 			}
-			if rc.IdleTime > 0 {
-				lastHandshake := lastHandshakes[client.PublicKey]
-				minAgo := time.Now().Add(-1 * time.Duration(rc.IdleTime))
-				if lastHandshake.Before(minAgo) {
-					log.Info().Str("pubkey", client.PublicKey).Msg("Removing client due to Idle Time")
-					wgc.removeUser(client.PublicKey)
-				}
+		}
+		deadline, reason := rc.expiry(client, lastHandshakes[client.PublicKey])
+		if deadline.IsZero() {
+			continue
+		}
+		if !deadline.After(now) {
+			log.Info().Str("pubkey", client.PublicKey).Str("reason", reason).Msg("Removing client")
+			if err := wgc.removeUser(client.PublicKey, reason, watchdogActor); err != nil {
+				log.Error().Err(err).Str("pubkey", client.PublicKey).Msg("error removing client, retrying")
+				earliest(now.Add(watchdogRetry))
 			}
+			continue
 		}
+		earliest(deadline)
 	}
+	// clients that are gone are forgotten
+	wd.warned = warned
+	return next, nil
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchdogExpiry(t *testing.T) {
+	added := time.Date(2021, 1, 14, 12, 0, 0, 0, time.UTC)
+	client := ClientConfig{Added: added}
+	cases := []struct {
+		name      string
+		rc        removeClientConfig
+		handshake time.Time
+		deadline  time.Time
+		reason    string
+	}{
+		{"force only", removeClientConfig{ForceTime: 60}, added, added.Add(time.Hour), removeReasonForce},
+		{"idle first", removeClientConfig{ForceTime: 60, IdleTime: 10}, added.Add(5 * time.Minute), added.Add(15 * time.Minute), removeReasonIdle},
+		{"force first", removeClientConfig{ForceTime: 60, IdleTime: 10}, added.Add(55 * time.Minute), added.Add(time.Hour), removeReasonForce},
+		{"never", removeClientConfig{ForceTime: -1, IdleTime: 0}, added, time.Time{}, ""},
+		{"no handshake yet", removeClientConfig{IdleTime: 10, FirstHandshakeTime: 30}, time.Time{}, added.Add(30 * time.Minute), removeReasonHandshake},
+		{"epoch handshake", removeClientConfig{IdleTime: 10, FirstHandshakeTime: 30}, time.Unix(0, 0), added.Add(30 * time.Minute), removeReasonHandshake},
+		{"no grace period", removeClientConfig{IdleTime: 10}, time.Time{}, added.Add(10 * time.Minute), removeReasonIdle},
+		{"handshake made", removeClientConfig{IdleTime: 10, FirstHandshakeTime: 30}, added.Add(time.Minute), added.Add(11 * time.Minute), removeReasonIdle},
+		{"force before handshake", removeClientConfig{ForceTime: 20, FirstHandshakeTime: 30}, time.Time{}, added.Add(20 * time.Minute), removeReasonForce},
+	}
+	for _, c := range cases {
+		deadline, reason := c.rc.expiry(client, c.handshake)
+		if !deadline.Equal(c.deadline) || reason != c.reason {
+			t.Errorf("%s: expected %s %s, got %s %s", c.name, c.reason, c.deadline, reason, deadline)
+		}
+	}
+}
+
+// fakeWatchdogClock is a clock whose time only moves when a test sets it.
+// Every After is sent to waits for the test to fire
+type fakeWatchdogClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits chan fakeWait
+}
+
+type fakeWait struct {
+	d    time.Duration
+	fire chan time.Time
+}
+
+func newFakeWatchdogClock(now time.Time) *fakeWatchdogClock {
+	return &fakeWatchdogClock{now: now, waits: make(chan fakeWait)}
+}
+
+func (c *fakeWatchdogClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeWatchdogClock) set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *fakeWatchdogClock) After(d time.Duration) <-chan time.Time {
+	fire := make(chan time.Time)
+	c.waits <- fakeWait{d, fire}
+	return fire
+}
+
+// drainWatchdogWake drops wake ups left by peers created outside a watchdog
+func drainWatchdogWake() {
+	select {
+	case <-watchdogWake:
+	default:
+	}
+}
+
+// addedAt returns when pubkey was added to the DB
+func addedAt(t *testing.T, pubkey string) time.Time {
+	client, ok, err := findClient(pubkey)
+	if err != nil || !ok {
+		t.Fatalf("client %s not found: %v", pubkey, err)
+	}
+	return client.Added
+}
+
+func TestWatchdogSweep(t *testing.T) {
+	c, fb := newTestWGClient(t, "watchdogsweep.db")
+	idle := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	active := "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	for _, pubkey := range []string{idle, active} {
+		if _, err := c.newUser(NewUser{ClientName: "bob", PublicKey: pubkey}, nil); err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+	added := addedAt(t, idle)
+	fb.setHandshake("wg0", idle, added.Add(5*time.Minute))
+	fb.setHandshake("wg0", active, added.Add(15*time.Minute))
+	clk := newFakeWatchdogClock(added.Add(20 * time.Minute))
+	wd := &watchdog{client: &c, config: &removeClientConfig{ForceTime: 60, IdleTime: 10}, clock: clk}
+	next, err := wd.sweep()
+	if err != nil {
+		t.Fatalf("error sweeping: %s", err)
+	}
+	if _, ok := fb.peers["wg0"][idle]; ok {
+		t.Errorf("idle peer wasn't removed")
+	}
+	if _, ok := fb.peers["wg0"][active]; !ok {
+		t.Errorf("active peer was removed")
+	}
+	if sessions, _ := getSessions(sessionFilter{}); len(sessions) != 2 || sessions[0].EndReason != removeReasonIdle {
+		t.Errorf("idle peer's session wasn't ended: %+v", sessions)
+	}
+	// the timeouts are in minutes
+	if expected := added.Add(25 * time.Minute); !next.Equal(expected) {
+		t.Errorf("expected the next deadline at %s, got %s", expected, next)
+	}
+}
+
+func TestWatchdogRun(t *testing.T) {
+	c, fb := newTestWGClient(t, "watchdogrun.db")
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	if _, err := c.newUser(NewUser{ClientName: "bob", PublicKey: pubkey}, nil); err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	drainWatchdogWake()
+	added := addedAt(t, pubkey)
+	fb.setHandshake("wg0", pubkey, added)
+	clk := newFakeWatchdogClock(added)
+	wd := &watchdog{client: &c, config: &removeClientConfig{ForceTime: 60}, clock: clk}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		wd.run(ctx)
+		close(done)
+	}()
+	// it sleeps until the peer's force deadline
+	wait := <-clk.waits
+	if wait.d != time.Hour {
+		t.Errorf("expected to sleep for an hour, slept for %s", wait.d)
+	}
+	// and works it out again when woken
+	clk.set(added.Add(10 * time.Minute))
+	wakeWatchdog()
+	wait = <-clk.waits
+	if wait.d != 50*time.Minute {
+		t.Errorf("expected to sleep for 50 minutes after waking, slept for %s", wait.d)
+	}
+	clk.set(added.Add(time.Hour))
+	wait.fire <- clk.Now()
+	// with no deadlines left it waits for ctx or a wake up
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watchdog didn't stop")
+	}
+	if fb.hasPeer("wg0", pubkey) {
+		t.Errorf("peer wasn't removed at its deadline")
+	}
+}
+
+func TestWatchdogRetriesFailedRemoval(t *testing.T) {
+	c, fb := newTestWGClient(t, "watchdogretry.db")
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	if _, err := c.newUser(NewUser{ClientName: "bob", PublicKey: pubkey}, nil); err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	added := addedAt(t, pubkey)
+	clk := newFakeWatchdogClock(added.Add(time.Hour))
+	wd := &watchdog{client: &c, config: &removeClientConfig{ForceTime: 60}, clock: clk}
+	fb.mu.Lock()
+	fb.removeErr = errors.New("netlink: operation not permitted")
+	fb.mu.Unlock()
+	// the only deadline has passed, so the retry is all there is to wake for
+	next, err := wd.sweep()
+	if err != nil || !next.Equal(clk.Now().Add(watchdogRetry)) {
+		t.Fatalf("expected a retry at %s, got %s (%v)", clk.Now().Add(watchdogRetry), next, err)
+	}
+	if _, active, _ := findClient(pubkey); !active || !fb.hasPeer("wg0", pubkey) {
+		t.Fatalf("client was dropped without its peer being removed")
+	}
+	fb.mu.Lock()
+	fb.removeErr = nil
+	fb.mu.Unlock()
+	clk.set(next)
+	if next, _ = wd.sweep(); !next.IsZero() || fb.hasPeer("wg0", pubkey) {
+		t.Errorf("removal wasn't retried")
+	}
+}
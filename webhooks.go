@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// eventPeerExpiring is sent ExpiryWarning minutes before a peer's force time
+// runs out. The other webhook events are the audit events of the same name
+const eventPeerExpiring = "peer_expiring"
+
+// webhookEvents are the events endpoints can subscribe to
+var webhookEvents = map[string]bool{
+	auditAuthSuccess:   true,
+	auditAuthFailure:   true,
+	auditPeerCreated:   true,
+	auditPeerRenewed:   true,
+	auditPeerRemoved:   true,
+	auditDeviceRevoked: true,
+	eventPeerExpiring:  true,
+}
+
+// defaultWebhookEvents are sent to endpoints that don't list their events
+var defaultWebhookEvents = []string{auditPeerCreated, eventPeerExpiring, auditPeerRemoved, auditAuthFailure}
+
+// webhookBackoff is the wait before the first retry, it doubles every retry
+const webhookBackoff = time.Second
+
+// webhookDrainTime is how long the events left at shutdown get to be
+// delivered before the rest are dead lettered
+const webhookDrainTime = 10 * time.Second
+
+// webhookWorkers deliver the queued events, and at most webhookQueueSize
+// deliveries wait for them. Deliveries past that are dead lettered
+const (
+	webhookWorkers   = 4
+	webhookQueueSize = 1000
+)
+
+var errWebhookQueueFull = errors.New("the webhook queue is full")
+
+// WebhookEvent is the JSON body POSTed to webhook endpoints
+type WebhookEvent struct {
+	// ID is the same for every delivery attempt of an event
+	ID    string    `json:"id"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// Identity is the peer's owner, or the token's for auth events
+	Identity
+	ClientName string `json:"client_name,omitempty"`
+	PublicKey  string `json:"public_key,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	// ExpiresAt is when the watchdog removes the peer, for peer_expiring
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Reason is the removal reason or the auth error
+	Reason   string `json:"reason,omitempty"`
+	SourceIP string `json:"source_ip,omitempty"`
+}
+
+// notifier delivers events to webhook endpoints in the background, so
+// sending never blocks the caller
+type notifier struct {
+	ctx        context.Context
+	endpoints  []WebhookEndpoint
+	attempts   int
+	backoff    time.Duration
+	deadLetter string
+	httpClient *http.Client
+	queue      chan queuedDelivery
+	// deliveries are the deliveries queued or in progress
+	deliveries sync.WaitGroup
+	// queueMu guards stopped, which is set once ctx is done so nothing is
+	// queued after the workers have gone
+	queueMu sync.Mutex
+	stopped bool
+	// deadLetterMu serializes appends to the dead letter file
+	deadLetterMu sync.Mutex
+}
+
+// queuedDelivery is an event waiting to be delivered to an endpoint
+type queuedDelivery struct {
+	endpoint WebhookEndpoint
+	event    WebhookEvent
+	body     []byte
+}
+
+// webhooks sends events to the configured endpoints, nil if there are none
+var webhooks *notifier
+
+// newNotifier returns a notifier for the endpoints in c and starts its
+// workers. Retries stop, and the delivery is dead lettered, once ctx is done
+func newNotifier(ctx context.Context, c WebhooksConfig) *notifier {
+	n := &notifier{
+		ctx:        ctx,
+		endpoints:  c.Endpoints,
+		attempts:   c.Attempts,
+		backoff:    webhookBackoff,
+		deadLetter: c.DeadLetterPath,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		queue:      make(chan queuedDelivery, webhookQueueSize),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go n.work()
+	}
+	return n
+}
+
+// subscribed reports whether an endpoint gets an event
+func (e WebhookEndpoint) subscribed(event string) bool {
+	events := e.Events
+	if len(events) == 0 {
+		events = defaultWebhookEvents
+	}
+	for _, subscribed := range events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notify sends e to every endpoint subscribed to it, if webhooks are
+// configured. It returns straight away
+func notify(e WebhookEvent) {
+	if webhooks != nil {
+		webhooks.send(e)
+	}
+}
+
+func (n *notifier) send(e WebhookEvent) {
+	id, err := randomToken()
+	if err != nil {
+		log.Error().Err(err).Str("event", e.Event).Msg("webhook event not sent")
+		return
+	}
+	e.ID, e.Time = id, time.Now().UTC()
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Err(err).Str("event", e.Event).Msg("webhook event not sent")
+		return
+	}
+	for _, endpoint := range n.endpoints {
+		if endpoint.subscribed(e.Event) {
+			n.enqueue(queuedDelivery{endpoint: endpoint, event: e, body: body})
+		}
+	}
+}
+
+// enqueue queues d for the workers. It's dead lettered instead if the queue
+// is full or the workers have stopped
+func (n *notifier) enqueue(d queuedDelivery) {
+	n.queueMu.Lock()
+	err := errWebhookQueueFull
+	if n.stopped {
+		err = fmt.Errorf("shutting down: %w", n.ctx.Err())
+	} else {
+		n.deliveries.Add(1)
+		select {
+		case n.queue <- d:
+			err = nil
+		default:
+			n.deliveries.Done()
+		}
+	}
+	n.queueMu.Unlock()
+	if err != nil {
+		n.deadLetterDelivery(d.endpoint, d.event, d.body, 0, err)
+	}
+}
+
+// work delivers queued events until ctx is done, then gives up the ones
+// still queued
+func (n *notifier) work() {
+	for {
+		select {
+		case d := <-n.queue:
+			n.deliver(d.endpoint, d.event, d.body)
+			n.deliveries.Done()
+		case <-n.ctx.Done():
+			n.queueMu.Lock()
+			n.stopped = true
+			n.queueMu.Unlock()
+			for {
+				select {
+				case d := <-n.queue:
+					n.deliver(d.endpoint, d.event, d.body)
+					n.deliveries.Done()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// wait waits for the queued deliveries to finish or be dead lettered
+func (n *notifier) wait() {
+	n.deliveries.Wait()
+}
+
+// deliver POSTs body to endpoint, retrying with exponential backoff on
+// network errors, 5xx, 408 and 429 responses. Deliveries that fail for good
+// are dead lettered
+func (n *notifier) deliver(endpoint WebhookEndpoint, e WebhookEvent, body []byte) {
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(endpoint, e, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= n.attempts {
+			n.deadLetterDelivery(endpoint, e, body, attempt, err)
+			return
+		}
+		log.Warn().Err(err).Str("url", endpoint.URL).Str("event", e.Event).Int("attempt", attempt).Msg("webhook delivery failed, retrying")
+		select {
+		case <-n.ctx.Done():
+			n.deadLetterDelivery(endpoint, e, body, attempt, fmt.Errorf("shutting down: %w", err))
+			return
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+// post makes one delivery attempt, reporting whether a failure can be retried
+func (n *notifier) post(endpoint WebhookEndpoint, e WebhookEvent, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(n.ctx, "POST", endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Wg2fa-Event", e.Event)
+	req.Header.Set("X-Wg2fa-Delivery", e.ID)
+	req.Header.Set("X-Wg2fa-Timestamp", timestamp)
+	req.Header.Set("X-Wg2fa-Signature", "sha256="+signWebhook(endpoint.Secret, timestamp, body))
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("endpoint returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of the timestamp and body. The
+// timestamp is signed too so a captured delivery can't be replayed later
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter is a delivery that was given up
+type deadLetter struct {
+	Time     time.Time       `json:"time"`
+	URL      string          `json:"url"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Event    json.RawMessage `json:"event"`
+}
+
+// deadLetterDelivery appends a delivery that was given up to the dead letter
+// file, so it can be looked into and sent again
+func (n *notifier) deadLetterDelivery(endpoint WebhookEndpoint, e WebhookEvent, body []byte, attempts int, err error) {
+	log.Error().Err(err).Str("url", endpoint.URL).Str("event", e.Event).Str("id", e.ID).
+		Int("attempts", attempts).Msg("webhook delivery given up")
+	if n.deadLetter == "" {
+		return
+	}
+	line, _ := json.Marshal(deadLetter{Time: time.Now().UTC(), URL: endpoint.URL, Attempts: attempts, Error: err.Error(), Event: body})
+	n.deadLetterMu.Lock()
+	defer n.deadLetterMu.Unlock()
+	f, ferr := os.OpenFile(n.deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if ferr != nil {
+		log.Error().Err(ferr).Str("path", n.deadLetter).Msg("couldn't open the webhook dead letter file")
+		return
+	}
+	defer f.Close()
+	if _, ferr := f.Write(append(line, '\n')); ferr != nil {
+		log.Error().Err(ferr).Str("path", n.deadLetter).Msg("couldn't write to the webhook dead letter file")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookDelivery is a request received by a test webhook endpoint
+type webhookDelivery struct {
+	header http.Header
+	body   []byte
+	event  WebhookEvent
+}
+
+// newWebhookReceiver starts an endpoint that answers with status(attempt)
+// and sends every request it gets to the returned channel
+func newWebhookReceiver(t *testing.T, status func(attempt int32) int) (*httptest.Server, chan webhookDelivery) {
+	received := make(chan webhookDelivery, 100)
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		d := webhookDelivery{header: r.Header, body: body}
+		json.Unmarshal(body, &d.event)
+		received <- d
+		w.WriteHeader(status(atomic.AddInt32(&attempts, 1)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+// useTestWebhooks sends events to endpoints for one test, retrying without
+// waiting long
+func useTestWebhooks(t *testing.T, c WebhooksConfig) *notifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	if c.Attempts == 0 {
+		c.Attempts = 3
+	}
+	n := newNotifier(ctx, c)
+	n.backoff = time.Millisecond
+	old := webhooks
+	webhooks = n
+	t.Cleanup(func() {
+		cancel()
+		n.wait()
+		webhooks = old
+	})
+	return n
+}
+
+func receive(t *testing.T, received chan webhookDelivery) webhookDelivery {
+	select {
+	case d := <-received:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no webhook delivery received")
+		return webhookDelivery{}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	// the endpoint is down for the first two attempts
+	srv, received := newWebhookReceiver(t, func(attempt int32) int {
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusNoContent
+	})
+	n := useTestWebhooks(t, WebhooksConfig{Endpoints: []WebhookEndpoint{{URL: srv.URL, Secret: "s3cret"}}})
+	notify(WebhookEvent{Event: auditPeerRemoved, Identity: Identity{Subject: "alice", Email: "alice@example.com"},
+		PublicKey: "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=", Reason: removeReasonForce})
+	var deliveries []webhookDelivery
+	for i := 0; i < 3; i++ {
+		deliveries = append(deliveries, receive(t, received))
+	}
+	n.wait()
+	d := deliveries[2]
+	if d.event.Event != auditPeerRemoved || d.event.Email != "alice@example.com" || d.event.Reason != removeReasonForce ||
+		d.event.ID == "" || d.event.Time.IsZero() {
+		t.Errorf("wrong event %+v", d.event)
+	}
+	if d.header.Get("X-Wg2fa-Event") != auditPeerRemoved || d.header.Get("X-Wg2fa-Delivery") != d.event.ID {
+		t.Errorf("wrong headers %v", d.header)
+	}
+	expected := "sha256=" + signWebhook("s3cret", d.header.Get("X-Wg2fa-Timestamp"), d.body)
+	if d.header.Get("X-Wg2fa-Signature") != expected {
+		t.Errorf("wrong signature %s, expected %s", d.header.Get("X-Wg2fa-Signature"), expected)
+	}
+	// retries are the same event
+	if deliveries[0].event.ID != d.event.ID {
+		t.Errorf("retry has a different ID")
+	}
+	select {
+	case extra := <-received:
+		t.Errorf("unexpected delivery %+v", extra.event)
+	default:
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	down, _ := newWebhookReceiver(t, func(int32) int { return http.StatusInternalServerError })
+	rejecting, rejected := newWebhookReceiver(t, func(int32) int { return http.StatusBadRequest })
+	path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	n := useTestWebhooks(t, WebhooksConfig{DeadLetterPath: path, Endpoints: []WebhookEndpoint{
+		{URL: down.URL, Secret: "a"},
+		{URL: rejecting.URL, Secret: "b"},
+	}})
+	notify(WebhookEvent{Event: auditAuthFailure, Reason: "token is expired"})
+	n.wait()
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("no dead letter file: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 dead letters, got:\n%s", raw)
+	}
+	attempts := make(map[string]int)
+	for _, line := range lines {
+		var dl deadLetter
+		var e WebhookEvent
+		if err := json.Unmarshal([]byte(line), &dl); err != nil || json.Unmarshal(dl.Event, &e) != nil {
+			t.Fatalf("invalid dead letter %s", line)
+		}
+		if e.Event != auditAuthFailure || dl.Error == "" {
+			t.Errorf("wrong dead letter %s", line)
+		}
+		attempts[dl.URL] = dl.Attempts
+	}
+	// client errors aren't retried
+	if attempts[down.URL] != 3 || attempts[rejecting.URL] != 1 || len(rejected) != 1 {
+		t.Errorf("wrong attempts %v", attempts)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	// the endpoint holds every delivery until the test ends, so the workers
+	// stay busy and the queue fills up
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	useTestWebhooks(t, WebhooksConfig{DeadLetterPath: path, Endpoints: []WebhookEndpoint{{URL: srv.URL, Secret: "a"}}})
+	defer close(release)
+	overflow := 5
+	for i := 0; i < webhookWorkers+webhookQueueSize+overflow; i++ {
+		notify(WebhookEvent{Event: auditPeerCreated})
+	}
+	// the deliveries past the queue are dead lettered straight away instead
+	// of waiting
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("no dead letter file: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) < overflow || len(lines) > webhookWorkers+overflow {
+		t.Fatalf("expected %d to %d dead letters, got %d", overflow, webhookWorkers+overflow, len(lines))
+	}
+	var dl deadLetter
+	if err := json.Unmarshal([]byte(lines[0]), &dl); err != nil || dl.Error != errWebhookQueueFull.Error() || dl.Attempts != 0 {
+		t.Errorf("wrong dead letter %s", lines[0])
+	}
+}
+
+func TestWebhookAuthFailures(t *testing.T) {
+	srv, received := newWebhookReceiver(t, func(int32) int { return http.StatusOK })
+	n := useTestWebhooks(t, WebhooksConfig{Endpoints: []WebhookEndpoint{{URL: srv.URL, Secret: "a"}}})
+	useTestVerifier(t, newStubIssuer(t).config())
+	useTestWGClient(t, "webhookfailures.db")
+	for i := 0; i < 5; i++ {
+		r := authedRequest("GET", "/me/peers", "not-a-token")
+		r.RemoteAddr = "203.0.113.7:40000"
+		newRouter().ServeHTTP(httptest.NewRecorder(), r)
+	}
+	flushAuthFailures()
+	n.wait()
+	// the first failure is sent, and the rest as one summary
+	if len(received) != 2 {
+		t.Fatalf("expected 2 deliveries, got %d", len(received))
+	}
+	first, summary := (<-received).event, (<-received).event
+	if strings.HasPrefix(first.Reason, "4 more") {
+		first, summary = summary, first
+	}
+	if first.Event != auditAuthFailure || first.SourceIP != "203.0.113.7" {
+		t.Errorf("wrong first failure %+v", first)
+	}
+	if summary.Event != auditAuthFailure || summary.SourceIP != "203.0.113.7" ||
+		!strings.HasPrefix(summary.Reason, "4 more failures, the last: ") {
+		t.Errorf("wrong summary %+v", summary)
+	}
+}
+
+func TestWebhookSubscriptions(t *testing.T) {
+	all, received := newWebhookReceiver(t, func(int32) int { return http.StatusOK })
+	renewals, renewed := newWebhookReceiver(t, func(int32) int { return http.StatusOK })
+	n := useTestWebhooks(t, WebhooksConfig{Endpoints: []WebhookEndpoint{
+		{URL: all.URL, Secret: "a"},
+		{URL: renewals.URL, Secret: "b", Events: []string{auditPeerRenewed}},
+	}})
+	c, _ := newTestWGClient(t, "webhooks.db")
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	newUser := NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: Identity{Subject: "alice", Email: "alice@example.com"}}
+	for i := 0; i < 2; i++ {
+		if _, err := c.newUser(newUser, nil); err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+	if err := c.removeUser(pubkey, removeReasonIdle, watchdogActor); err != nil {
+		t.Fatalf("error removing user: %s", err)
+	}
+	n.wait()
+	// the default events don't include renewals
+	if len(received) != 2 || len(renewed) != 1 {
+		t.Fatalf("expected 2 and 1 deliveries, got %d and %d", len(received), len(renewed))
+	}
+	events := map[string]WebhookEvent{}
+	for i := 0; i < 2; i++ {
+		d := <-received
+		events[d.event.Event] = d.event
+	}
+	created, removed := events[auditPeerCreated], events[auditPeerRemoved]
+	if created.Email != "alice@example.com" || created.ClientName != "laptop" || created.IP != "10.0.0.2/24" {
+		t.Errorf("wrong peer_created event %+v", created)
+	}
+	if removed.Reason != removeReasonIdle || removed.PublicKey != pubkey {
+		t.Errorf("wrong peer_removed event %+v", removed)
+	}
+	if d := <-renewed; d.event.Event != auditPeerRenewed {
+		t.Errorf("expected only the renewal, got %s", d.event.Event)
+	}
+}
+
+func TestWatchdogExpiryWarning(t *testing.T) {
+	srv, received := newWebhookReceiver(t, func(int32) int { return http.StatusOK })
+	n := useTestWebhooks(t, WebhooksConfig{Endpoints: []WebhookEndpoint{{URL: srv.URL, Secret: "a", Events: []string{eventPeerExpiring}}}})
+	c, _ := newTestWGClient(t, "expirywarning.db")
+	pubkey := "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE="
+	if _, err := c.newUser(NewUser{ClientName: "laptop", PublicKey: pubkey, Identity: Identity{Subject: "alice"}}, nil); err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+	added := addedAt(t, pubkey)
+	clk := newFakeWatchdogClock(added.Add(50 * time.Minute))
+	wd := &watchdog{client: &c, config: &removeClientConfig{ForceTime: 60, ExpiryWarning: 5}, clock: clk}
+	// the watchdog wakes up for the warning
+	next, err := wd.sweep()
+	if err != nil || !next.Equal(added.Add(55*time.Minute)) {
+		t.Fatalf("expected to wake up for the warning at %s, got %s (%v)", added.Add(55*time.Minute), next, err)
+	}
+	clk.set(added.Add(55 * time.Minute))
+	next, _ = wd.sweep()
+	if !next.Equal(added.Add(time.Hour)) {
+		t.Errorf("expected the force deadline next, got %s", next)
+	}
+	// the warning is only sent once
+	clk.set(added.Add(57 * time.Minute))
+	wd.sweep()
+	n.wait()
+	if len(received) != 1 {
+		t.Fatalf("expected one warning, got %d", len(received))
+	}
+	e := (<-received).event
+	if e.Event != eventPeerExpiring || e.PublicKey != pubkey || e.ExpiresAt == nil || !e.ExpiresAt.Equal(added.Add(time.Hour)) {
+		t.Errorf("wrong warning %+v", e)
+	}
+}
@@ -3,24 +3,46 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net"
-	"os"
-	"os/exec"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-const usernameRegex = "^[a-zAZ0-9\\.@_-]+$"
+const usernameRegex = "^[a-zA-Z0-9\\.@_-]+$"
 const sectionRegex = "^\\[[a-zA-Z0-9]+\\]$"
 
+// errInvalidUser is wrapped by errors for new user requests that can't be
+// valid, as opposed to ones that failed
+var errInvalidUser = errors.New("invalid new user")
+
+var clientNameRegex = regexp.MustCompile(usernameRegex)
+
+// checkNewUser checks the client name and, unless the server generates the
+// key, the public key of a new user request
+func checkNewUser(newuser NewUser) error {
+	if !clientNameRegex.MatchString(newuser.ClientName) {
+		return fmt.Errorf("%w: client_name can only have letters, digits, '.', '@', '_' and '-'", errInvalidUser)
+	}
+	if newuser.GenerateKey {
+		return nil
+	}
+	if _, err := wgtypes.ParseKey(newuser.PublicKey); err != nil {
+		return fmt.Errorf("%w: invalid public_key", errInvalidUser)
+	}
+	return nil
+}
+
 var serverPubKey string
 
+// activateMu serializes logins from picking a free IP until the device and
+// its session are saved, so two logins can't be given the same IP
+var activateMu sync.Mutex
+
 // WGClient is a struct defining the config of wireguard
 type WGClient struct {
 	// WGConfigPath is the path to the wireguard config to manage
@@ -33,14 +55,42 @@ type WGClient struct {
 	DNSServers []string
 	// ServerHostname is the hostname or IP of the server in host:port format
 	ServerHostname string
+	// AllowedIPs are the routes put in client configs unless a policy or
+	// profile sets its own
+	AllowedIPs []string
+	// PersistentKeepalive is the client keepalive interval in seconds, 0
+	// leaves it out
+	PersistentKeepalive int
+	// MTU is the client interface MTU, 0 leaves it out
+	MTU int
+	// Backend performs the wireguard operations (peer and key management)
+	Backend Backend
 }
 
 // NewUser is the struct for a new wireguard user
 // right now this only accepts ClientName and builds everything else
 type NewUser struct {
+	// ClientName is a label for the device, chosen by the caller
 	ClientName string `json:"client_name"`
 	PublicKey  string `json:"public_key"`
-	WGConf     string `json:"wg_conf"`
+	// GenerateKey asks the server to generate the key pair instead of the
+	// caller sending a public key. The private key is only ever put in the
+	// returned config, never stored
+	GenerateKey bool   `json:"generate_key,omitempty"`
+	WGConf      string `json:"wg_conf"`
+	// Profile names the client tunnel settings to use. Empty uses the
+	// policy's default
+	Profile string `json:"profile,omitempty"`
+	// Identity is the owner of the peer. It is always taken from the verified
+	// token, never from the request body
+	Identity
+	// conf is what WGConf was rendered from, for the other config formats
+	conf *clientConfData
+	// actor is who asked for the peer, for the audit log
+	actor auditActor
+	// claims are the requester's token claims. If they're set an active peer
+	// is only renewed by a login after its last renewal
+	claims Claims
 }
 
 // Init initializes a WGClient
@@ -60,6 +110,12 @@ func (c WGClient) init() error {
 		// TODO: more robust check of interface name here
 		return errors.New("invalid interface name")
 	}
+	if err := validateTunnelSettings(c.AllowedIPs, nil, c.PersistentKeepalive, c.MTU); err != nil {
+		return err
+	}
+	if c.Backend == nil {
+		return errNoBackend
+	}
 	// get and set the server public key
 	wgConfig, err := parseConfig(c.WGConfigPath)
 	if err != nil {
@@ -75,192 +131,310 @@ func (c WGClient) init() error {
 	if serverPrivkey == "" {
 		return errors.New("No server private key found")
 	}
-	serverPubKey, err = getPubKey(serverPrivkey)
+	serverPubKey, err = c.Backend.PublicKey(serverPrivkey)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// NewUser creates a new user
-func (c WGClient) newUser(newuser NewUser) (NewUser, error) {
-	// check the username for regex
-	match, err := regexp.MatchString(usernameRegex, newuser.ClientName)
-	if err != nil {
-		log.Error().Msg("Error in new user regex")
-		return NewUser{}, errors.New("Error in new user regex")
+// NewUser logs a device in, enrolling it the first time its public key is
+// seen. Enrolled devices keep their IP and PSK, so logging in again only adds
+// the peer back to the interface and returns the same config. If policy isn't
+// nil its address pool, routes, DNS servers and timeouts apply to the peer,
+// and the profile the user asked for, or else the policy's default, is
+// applied on top
+func (c WGClient) newUser(newuser NewUser, policy *Policy) (NewUser, error) {
+	if err := checkNewUser(newuser); err != nil {
+		return NewUser{}, err
 	}
-	if !match {
-		return NewUser{}, errors.New("invalid username")
+	// apply the policy and profile, if any
+	pool, policyName := "", ""
+	dnsServers, allowedIPs := c.DNSServers, c.AllowedIPs
+	keepalive, mtu := c.PersistentKeepalive, c.MTU
+	if policy != nil {
+		pool, policyName = policy.AddressPool, policy.Name
+		if len(policy.AllowedIPs) > 0 {
+			allowedIPs = policy.AllowedIPs
+		}
+		if len(policy.DNSServers) > 0 {
+			dnsServers = policy.DNSServers
+		}
 	}
-	// get a PSK
-	psk, err := createPSK()
+	profile, err := policy.profile(newuser.Profile)
 	if err != nil {
 		return NewUser{}, err
 	}
-	// find an unused IP
-	ip, err := getOpenIP(c.WGConfigPath)
+	if profile != nil {
+		newuser.Profile = profile.Name
+		if len(profile.AllowedIPs) > 0 {
+			allowedIPs = profile.AllowedIPs
+		}
+		if len(profile.DNSServers) > 0 {
+			dnsServers = profile.DNSServers
+		}
+		if profile.PersistentKeepalive > 0 {
+			keepalive = profile.PersistentKeepalive
+		}
+		if profile.MTU > 0 {
+			mtu = profile.MTU
+		}
+	}
+	privkey := ""
+	if newuser.GenerateKey {
+		privkey, newuser.PublicKey, err = c.Backend.GenerateKey()
+		if err != nil {
+			return NewUser{}, err
+		}
+	}
+	activateMu.Lock()
+	defer activateMu.Unlock()
+	device, enrolled, err := getDevice(newuser.PublicKey)
 	if err != nil {
 		return NewUser{}, err
 	}
+	if enrolled && device.Subject != newuser.Subject {
+		return NewUser{}, fmt.Errorf("%w: device is enrolled to another user", errForbidden)
+	}
+	device.PublicKey = newuser.PublicKey
+	device.Name = newuser.ClientName
+	device.Identity = newuser.Identity
+	if newuser.GenerateKey {
+		device.ServerKey = true
+	}
+	if device.PSK == "" {
+		device.PSK, err = c.Backend.GeneratePSK()
+		if err != nil {
+			return NewUser{}, err
+		}
+	}
+	// the IP reservation comes from the policy's pool, so it's only kept while
+	// the device is under the same policy
+	if !enrolled || device.Policy != policyName {
+		device.IP, err = getOpenIPInPool(c.WGConfigPath, pool)
+		if err != nil {
+			return NewUser{}, err
+		}
+		device.Policy = policyName
+	}
 	// now build the config string:
 	ccd := clientConfData{
-		ClientIP:       ip,
-		DNS:            strings.Join(c.DNSServers[:], ", "),
+		ClientIP:       device.IP,
+		DNS:            strings.Join(dnsServers[:], ", "),
 		ServerPubKey:   serverPubKey,
-		PSK:            psk,
+		PSK:            device.PSK,
 		ServerHostname: c.ServerHostname,
+		AllowedIPs:     strings.Join(allowedIPs, ", "),
+		PrivateKey:     privkey,
+		Keepalive:      keepalive,
+		MTU:            mtu,
 	}
 	ccf, err := buildClientConfigFile(&ccd)
 	if err != nil {
 		return NewUser{}, err
 	}
-	// build the new users server config block and add it to the file
-	sccd := serverCConfData{
-		PublicKey: newuser.PublicKey,
-		PSK:       psk,
-		IP:        ip,
-		Interface: c.InterfaceName,
+	session, active, err := findClient(newuser.PublicKey)
+	if err != nil {
+		return NewUser{}, err
 	}
-	// add user to config file
-	err = addUserToSConf(&sccd)
+	if active && newuser.claims != nil && !freshLogin(newuser.claims, session.Added) {
+		return NewUser{}, errStaleLogin
+	}
+	if active && session.IP != device.IP {
+		// the session predates the enrollment or the policy changed
+		if err := c.removeUser(newuser.PublicKey, sessionEndReconcile, newuser.actor); err != nil {
+			return NewUser{}, err
+		}
+		active = false
+	}
+	if active {
+		// already active, just restart its force time
+		if err := renewClientInDb(newuser.PublicKey); err != nil {
+			return NewUser{}, err
+		}
+		if err := saveDevice(device); err != nil {
+			return NewUser{}, err
+		}
+		newuser.audit(auditPeerRenewed, device.IP, "")
+		newuser.WGConf = ccf
+		newuser.conf = &ccd
+		return newuser, nil
+	}
+	// activate the device by adding it to the interface
+	err = c.Backend.AddPeer(&serverCConfData{
+		PublicKey: device.PublicKey,
+		PSK:       device.PSK,
+		IP:        device.IP,
+		Interface: c.InterfaceName,
+	})
 	if err != nil {
+		log.Error().Err(err).Str("pubkey", newuser.PublicKey).Msg("error adding peer to wg config")
 		return NewUser{}, errors.New("Couldn't write to client to wg config")
 	}
+	if err := saveDevice(device); err != nil {
+		return NewUser{}, err
+	}
 	// return the completed new user
-	err = addClientToDb(newuser.ClientName, newuser.PublicKey, ip)
+	err = insertClient(ClientConfig{
+		Name:      newuser.ClientName,
+		PublicKey: newuser.PublicKey,
+		IP:        device.IP,
+		Policy:    policyName,
+		Identity:  newuser.Identity,
+	})
 	if err != nil {
 		return NewUser{}, err
 	}
+	// the device's enrollment is deleted when it's revoked, the audit log keeps
+	// whether its private key was ever known to the server
+	detail := ""
+	if device.ServerKey {
+		detail = auditServerKey
+	}
+	newuser.audit(auditPeerCreated, device.IP, detail)
 	newuser.WGConf = ccf
+	newuser.conf = &ccd
 	return newuser, nil
 }
 
-// RemoveUser deletes a user
-func (c WGClient) removeUser(pubkey string) error {
+// audit records an event for the new user's peer and sends it to the
+// webhooks
+func (newuser NewUser) audit(event, ip, detail string) {
+	e := newuser.actor.entry(event)
+	e.Subject, e.PublicKey, e.IP, e.Detail = newuser.Subject, newuser.PublicKey, ip, detail
+	audit(e)
+	notify(WebhookEvent{Event: event, Identity: newuser.Identity, ClientName: newuser.ClientName,
+		PublicKey: newuser.PublicKey, IP: ip, SourceIP: newuser.actor.SourceIP})
+}
+
+// RemoveUser deactivates a device, removing its peer from the interface and
+// ending its session for reason. Its enrollment is kept so it can log in again.
+// If the peer can't be removed from the interface the client is kept, so the
+// removal can be tried again
+func (c WGClient) removeUser(pubkey, reason string, by auditActor) error {
+	client, active, err := findClient(pubkey)
+	if err != nil {
+		return err
+	}
+	// the peer's endpoint and transfer totals go with it
+	status, _, _ := c.peerStatus(pubkey)
 	//remove from the wgconfig
-	commandArgs := []string{"set", c.InterfaceName, "peer", pubkey, "remove"}
-	obytes, err := exec.Command("wg", commandArgs...).Output()
-	log.Debug().Str("wg remove output", string(obytes)).Msg("output from wg peer remove")
+	err = c.Backend.RemovePeer(c.InterfaceName, pubkey)
 	if err != nil {
-		log.Error().AnErr("error removing peer from wg config", err)
+		// a peer that's already gone doesn't need removing
+		if _, present, perr := c.peerStatus(pubkey); perr != nil || present {
+			log.Error().Err(err).Str("pubkey", pubkey).Msg("error removing peer from wg config")
+			return fmt.Errorf("couldn't remove the peer from %s: %w", c.InterfaceName, err)
+		}
+		log.Warn().Err(err).Str("pubkey", pubkey).Msg("peer was already gone from the wg config")
 	}
 	//remove from the clientlist
-	if err = removeClientFromDb(pubkey); err != nil {
+	if err = removeClientFromDb(pubkey, reason, status); err != nil {
 		log.Error().AnErr("error removing client from DB", err)
+		return err
+	}
+	if active {
+		e := by.entry(auditPeerRemoved)
+		e.Subject, e.PublicKey, e.IP, e.Detail = client.Subject, pubkey, client.IP, reason
+		audit(e)
+		notify(WebhookEvent{Event: auditPeerRemoved, Identity: client.Identity, ClientName: client.Name,
+			PublicKey: pubkey, IP: client.IP, Reason: reason, SourceIP: by.SourceIP})
+	}
+	return nil
+}
+
+// revokeDevice deactivates a device and drops its enrollment, so it has to be
+// enrolled again with a new config
+func (c WGClient) revokeDevice(pubkey string, by auditActor) error {
+	device, enrolled, err := getDevice(pubkey)
+	if err != nil {
+		return err
+	}
+	if err := c.removeUser(pubkey, sessionEndAdmin, by); err != nil {
+		return err
+	}
+	if err := removeDeviceFromDb(pubkey); err != nil {
+		return err
+	}
+	if enrolled {
+		e := by.entry(auditDeviceRevoked)
+		e.Subject, e.PublicKey, e.IP = device.Subject, pubkey, device.IP
+		audit(e)
+		notify(WebhookEvent{Event: auditDeviceRevoked, Identity: device.Identity, ClientName: device.Name,
+			PublicKey: pubkey, IP: device.IP, SourceIP: by.SourceIP})
+	}
+	return nil
+}
+
+// peerStatus returns a peer's state on the interface and whether it's on it.
+// If it isn't, or the interface can't be read, just its public key is returned
+func (c WGClient) peerStatus(pubkey string) (PeerStatus, bool, error) {
+	peers, err := c.Backend.Peers(c.InterfaceName)
+	if err != nil {
+		log.Error().Err(err).Str("pubkey", pubkey).Msg("error getting peer status")
+		return PeerStatus{PublicKey: pubkey}, false, err
+	}
+	for _, peer := range peers {
+		if peer.PublicKey == pubkey {
+			return peer, true, nil
+		}
 	}
-	return err
+	return PeerStatus{PublicKey: pubkey}, false, nil
 }
 
 // GetLastHandshakes returns a map of public keys to last handshake times
 func (c WGClient) getLastHandshakes() (map[string]time.Time, error) {
 	handshakes := make(map[string]time.Time)
-	args := []string{"show", c.InterfaceName, "latest-handshakes"}
-	hsbytes, err := exec.Command("wg", args...).Output()
+	peers, err := c.Backend.Peers(c.InterfaceName)
 	if err != nil {
-		log.Error().AnErr("error calling latest handshakes", err)
+		log.Error().Err(err).Msg("error getting latest handshakes")
 		return handshakes, err
 	}
-	hsOut := string(hsbytes)
-	log.Debug().Str("latest-handshakes output", hsOut).Msg("output from latest handshakes command")
-	lines := strings.Split(hsOut, "\n")
-	for _, line := range lines {
-		if len(line) == 0 {
-			continue
-		}
-		splitline := strings.Split(line, " ")
-		pubkey := splitline[0]
-		if len(pubkey) < 5 {
-			log.Warn().Str("public key", pubkey).Msg("invalid public key")
-		}
-		timeint, err := strconv.ParseInt(splitline[len(splitline)-1], 10, 64)
-		if err != nil {
-			log.Error().AnErr("error converting last handshake to int", err).Str("pubkey", pubkey)
-			continue
-		}
-		tm := time.Unix(timeint, 0)
-		handshakes[pubkey] = tm
+	for _, peer := range peers {
+		handshakes[peer.PublicKey] = peer.LastHandshake
 	}
 	return handshakes, nil
 }
 
+// createWGKey returns a new base64 encoded curve25519 private key and its
+// public key
 func createWGKey() (string, string, error) {
-	// create a new private key
-	privkeyBytes, err := exec.Command("wg", "genkey").Output()
-	if err != nil {
-		return "", "", err
-	}
-	privkey := string(privkeyBytes)
-	// generate a public key using privkey as input on stdin
-	pubkey, err := getPubKey(privkey)
+	privkey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
 		return "", "", err
 	}
-	return privkey, pubkey, nil
+	return privkey.String(), privkey.PublicKey().String(), nil
 }
 
+// getPubKey derives the base64 encoded public key of a private key
 func getPubKey(privkey string) (string, error) {
-	// generate a public key using privkey as input on stdin
-	cmd := exec.Command("wg", "pubkey")
-	stdin, err := cmd.StdinPipe()
+	key, err := wgtypes.ParseKey(strings.TrimSpace(privkey))
 	if err != nil {
-		return "", err
-	}
-	go func() {
-		defer stdin.Close()
-		io.WriteString(stdin, privkey)
-	}()
-	pubkeyBytes, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", err
+		return "", fmt.Errorf("invalid private key: %w", err)
 	}
-	pubkey := string(pubkeyBytes)
-	return pubkey, nil
+	return key.PublicKey().String(), nil
 }
 
+// createPSK returns a new base64 encoded preshared key
 func createPSK() (string, error) {
-	pskBytes, err := exec.Command("wg", "genpsk").Output()
+	psk, err := wgtypes.GenerateKey()
 	if err != nil {
 		return "", err
 	}
-	psk := string(pskBytes)
-	return psk, nil
+	return psk.String(), nil
 }
 
-func addUserToSConf(scd *serverCConfData) error {
-	// we need to write PSK to a temp file
-	tmpFile, err := ioutil.TempFile(os.TempDir(), "wg2fa-")
-	if err != nil {
-		log.Error().AnErr("Cannot create temporary file", err)
-		return err
-	}
-	// Remember to clean up the file afterwards
-	defer os.Remove(tmpFile.Name())
-	if _, err = tmpFile.Write([]byte(scd.PSK)); err != nil {
-		log.Error().AnErr("Failed to write to temporary file", err)
-		return err
-	}
-	// close it
-	if err := tmpFile.Close(); err != nil {
-		log.Error().AnErr("error closing temp file", err)
-		return err
-	}
-	commandArgs := []string{"set", scd.Interface, "peer", scd.PublicKey, "preshared-key", tmpFile.Name(), "allowed-ips", scd.IP}
-	// for some reason .Wait caused a crash here, so changing to output and logging it works :shrug:
-	obytes, err := exec.Command("/usr/bin/wg", commandArgs...).Output()
-	log.Debug().Str("command out", string(obytes))
-	if err != nil {
-		log.Error().AnErr("error adding peer to wg config", err).Msg("Error calling wg set")
-		return err
-	}
-	return nil
+func getOpenIP(confPath string) (string, error) {
+	return getOpenIPInPool(confPath, "")
 }
 
-func getOpenIP(confPath string) (string, error) {
+// getOpenIPInPool returns an unused IP from pool, in the interface's CIDR
+// notation. If pool is empty the interface's whole address range is used
+func getOpenIPInPool(confPath, pool string) (string, error) {
 	// get the current config and the server IP range:
 	wgConfig, err := parseConfig(confPath)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	ipRangeString := ""
 	for _, section := range wgConfig {
@@ -273,15 +447,47 @@ func getOpenIP(confPath string) (string, error) {
 		return "", errors.New("No IP Range string found")
 	}
 	ip, ipNet, err := net.ParseCIDR(ipRangeString)
+	if err != nil {
+		return "", err
+	}
+	start, poolNet := ip, ipNet
+	if pool != "" {
+		var poolIP net.IP
+		poolIP, poolNet, err = net.ParseCIDR(pool)
+		if err != nil {
+			return "", err
+		}
+		if !ipNet.Contains(poolIP) {
+			return "", fmt.Errorf("address pool %s is outside of %s", pool, ipRangeString)
+		}
+		start = poolNet.IP
+	}
 	currentClients, err := getClients()
+	if err != nil {
+		return "", err
+	}
+	devices, err := getDevices()
+	if err != nil {
+		return "", err
+	}
 	currentIPs := make(map[string]bool)
 	for _, client := range currentClients {
-		currentIPs[client.IP] = true
+		// client IPs are stored in CIDR notation
+		currentIPs[strings.Split(client.IP, "/")[0]] = true
+	}
+	// inactive devices keep their reservation
+	for _, device := range devices {
+		currentIPs[strings.Split(device.IP, "/")[0]] = true
 	}
 	//add the server IP, too
 	currentIPs[ip.String()] = true
-	// for nip := ip.Mask(ipNet.Mask); ipNet.Contains(nip); inc(nip) {
-	for nip := ip; ipNet.Contains(nip); inc(nip) {
+	// and never hand out the network or broadcast address
+	currentIPs[ipNet.IP.String()] = true
+	currentIPs[broadcast(ipNet).String()] = true
+	// copy start so inc doesn't modify the parsed networks
+	nip := make(net.IP, len(start))
+	copy(nip, start)
+	for ; poolNet.Contains(nip) && ipNet.Contains(nip); inc(nip) {
 		if currentIPs[nip.String()] == false {
 			cidr := strings.Split(ipRangeString, "/")[1]
 			return fmt.Sprintf("%s/%s", nip.String(), cidr), nil
@@ -290,6 +496,15 @@ func getOpenIP(confPath string) (string, error) {
 	return "", errors.New("IP Space exhausted")
 }
 
+// broadcast returns the last address of a network
+func broadcast(n *net.IPNet) net.IP {
+	last := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		last[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return last
+}
+
 func inc(ip net.IP) {
 	for j := len(ip) - 1; j >= 0; j-- {
 		ip[j]++
@@ -5,12 +5,13 @@ import (
 	"bytes"
 	"database/sql"
 	"errors"
-	"html/template"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"text/template"
 	"time"
 
 	//the following is the go-sqlite driver
@@ -22,6 +23,10 @@ var db *sql.DB
 var clientTemplatePath = filepath.Join(".", "text_templates", "client_config.txt")
 var serverTemplatePath = filepath.Join(".", "text_templates", "cserver_client_entry.txt")
 
+// clientPrivateKeyPlaceholder is left in client configs for the private key,
+// which the server never sees
+const clientPrivateKeyPlaceholder = "CLIENT_PRIVATE_KEY"
+
 // configSection is a configuration file ini section
 type configSection struct {
 	SectionName  string
@@ -29,11 +34,19 @@ type configSection struct {
 }
 
 type clientConfData struct {
+	// PrivateKey is only set for server generated keys, otherwise the config
+	// has a placeholder for the caller to fill in
+	PrivateKey     string
 	ClientIP       string
 	DNS            string
 	ServerPubKey   string
 	PSK            string
 	ServerHostname string
+	AllowedIPs     string
+	// Keepalive is the PersistentKeepalive in seconds and MTU the interface
+	// MTU, both are left out when 0
+	Keepalive int
+	MTU       int
 }
 
 type serverCConfData struct {
@@ -45,10 +58,31 @@ type serverCConfData struct {
 
 // ClientConfig is an entry in the list of clients
 type ClientConfig struct {
+	// Name is the device label given when the client was created
 	Name      string    `json:"name"`
 	PublicKey string    `json:"public_key"`
 	IP        string    `json:"ip"`
 	Added     time.Time `json:"added"`
+	// Policy is the name of the access policy the client was created under
+	Policy string `json:"policy,omitempty"`
+	// Identity is the authenticated user who created the client
+	Identity
+}
+
+// DeviceConfig is an enrolled device. It keeps its IP and PSK across logins,
+// while its wg_user row and interface peer only exist while it's active
+type DeviceConfig struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+	IP        string `json:"ip"`
+	// PSK is needed to add the peer back to the interface, it's never returned
+	PSK      string    `json:"-"`
+	Policy   string    `json:"policy,omitempty"`
+	Enrolled time.Time `json:"enrolled"`
+	// ServerKey records that the server generated the device's key pair
+	ServerKey bool `json:"server_generated_key"`
+	// Identity is the user the device is enrolled to
+	Identity
 }
 
 // newconfigSection returns a new configSection with the name initialized
@@ -101,7 +135,7 @@ func parseConfig(confPath string) ([]configSection, error) {
 // getClients returns a list of all users currently in the DB
 func getClients() ([]ClientConfig, error) {
 	clients := make([]ClientConfig, 0)
-	rows, err := db.Query("select name, public_key, ip, added from wg_user")
+	rows, err := db.Query("select name, public_key, ip, added, policy, sub, email, display_name from wg_user")
 	if err != nil {
 		log.Error().AnErr("error selecting from sqlite", err)
 		return clients, errors.New("error selecting from sqlite")
@@ -110,7 +144,8 @@ func getClients() ([]ClientConfig, error) {
 	for rows.Next() {
 		var cf ClientConfig
 		var timeString string
-		err = rows.Scan(&cf.Name, &cf.PublicKey, &cf.IP, &timeString)
+		err = rows.Scan(&cf.Name, &cf.PublicKey, &cf.IP, &timeString, &cf.Policy,
+			&cf.Subject, &cf.Email, &cf.DisplayName)
 		if err != nil {
 			log.Error().AnErr("error scanning row", err)
 			return clients, errors.New("error selecting from sqlite")
@@ -132,28 +167,179 @@ func getClients() ([]ClientConfig, error) {
 	return clients, nil
 }
 
-func removeClientFromDb(pubKey string) error {
-	delStmt := "DELETE FROM wg_user WHERE public_key = $1;"
-	_, err := db.Exec(delStmt, pubKey)
+// findClient returns the client with a public key
+func findClient(pubkey string) (ClientConfig, bool, error) {
+	clients, err := getClients()
+	if err != nil {
+		return ClientConfig{}, false, err
+	}
+	for _, client := range clients {
+		if client.PublicKey == pubkey {
+			return client, true, nil
+		}
+	}
+	return ClientConfig{}, false, nil
+}
+
+const deviceColumns = "public_key, name, ip, psk, policy, enrolled, sub, email, display_name, server_key"
+
+// getDevices returns every enrolled device
+func getDevices() ([]DeviceConfig, error) {
+	devices := make([]DeviceConfig, 0)
+	rows, err := db.Query("SELECT " + deviceColumns + " FROM wg_device")
 	if err != nil {
+		log.Error().AnErr("error selecting from sqlite", err)
+		return devices, errors.New("error selecting from sqlite")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return devices, err
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().AnErr("rows err", err)
+		return devices, errors.New("error selecting from sqlite")
+	}
+	return devices, nil
+}
+
+// getDevice returns the device enrolled with a public key
+func getDevice(pubKey string) (DeviceConfig, bool, error) {
+	d, err := scanDevice(db.QueryRow("SELECT "+deviceColumns+" FROM wg_device WHERE public_key = $1;", pubKey))
+	if err == sql.ErrNoRows {
+		return DeviceConfig{}, false, nil
+	}
+	return d, err == nil, err
+}
+
+func scanDevice(row interface{ Scan(...interface{}) error }) (DeviceConfig, error) {
+	var d DeviceConfig
+	var timeString string
+	err := row.Scan(&d.PublicKey, &d.Name, &d.IP, &d.PSK, &d.Policy, &timeString,
+		&d.Subject, &d.Email, &d.DisplayName, &d.ServerKey)
+	if err == sql.ErrNoRows {
+		return d, err
+	} else if err != nil {
+		log.Error().AnErr("error scanning row", err)
+		return d, errors.New("error selecting from sqlite")
+	}
+	d.Enrolled, err = time.Parse(time.RFC3339, timeString)
+	if err != nil {
+		log.Error().AnErr("error parsing enrolled time", err).Str("pubkey", d.PublicKey)
+		return d, errors.New("invalid enrolled time")
+	}
+	return d, nil
+}
+
+// saveDevice enrolls a device or updates its enrollment
+func saveDevice(d DeviceConfig) error {
+	if d.Enrolled.IsZero() {
+		d.Enrolled = time.Now()
+	}
+	upsertStmt := `INSERT INTO wg_device (` + deviceColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT(public_key) DO UPDATE SET name = excluded.name, ip = excluded.ip,
+		psk = excluded.psk, policy = excluded.policy, sub = excluded.sub,
+		email = excluded.email, display_name = excluded.display_name,
+		server_key = excluded.server_key;`
+	_, err := db.Exec(upsertStmt, d.PublicKey, d.Name, d.IP, d.PSK, d.Policy,
+		d.Enrolled.Format(time.RFC3339), d.Subject, d.Email, d.DisplayName, d.ServerKey)
+	if err != nil {
+		log.Error().AnErr("error", err).Msg("error saving device")
+		return errors.New("couldn't save device")
+	}
+	return nil
+}
+
+func removeDeviceFromDb(pubKey string) error {
+	_, err := db.Exec("DELETE FROM wg_device WHERE public_key = $1;", pubKey)
+	if err != nil {
+		log.Error().AnErr("error deleting device", err)
+		return errors.New("couldn't delete device")
+	}
+	return nil
+}
+
+// removeClientFromDb deletes a client and ends its session for reason, with
+// the peer's last status on the interface
+func removeClientFromDb(pubKey, reason string, status PeerStatus) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error().AnErr("error deleting client", err)
+		return errors.New("couldn't delete client")
+	}
+	defer tx.Rollback()
+	if err := endSession(tx, pubKey, reason, status); err != nil {
+		log.Error().AnErr("error ending session", err)
+		return errors.New("couldn't end session")
+	}
+	delStmt := "DELETE FROM wg_user WHERE public_key = $1;"
+	if _, err := tx.Exec(delStmt, pubKey); err != nil {
+		log.Error().AnErr("error deleting client", err)
+		return errors.New("couldn't delete client")
+	}
+	if err := tx.Commit(); err != nil {
 		log.Error().AnErr("error deleting client", err)
 		return errors.New("couldn't delete client")
 	}
 	return nil
 }
 
+// renewClientInDb sets a client's added time to now, restarting its force time
+func renewClientInDb(pubKey string) error {
+	updateStmt := "UPDATE wg_user SET added = $1 WHERE public_key = $2;"
+	res, err := db.Exec(updateStmt, dbTime(time.Now()), pubKey)
+	if err != nil {
+		log.Error().AnErr("error renewing client", err)
+		return errors.New("couldn't renew client")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errors.New("client not found")
+	}
+	// the client's force deadline moved
+	wakeWatchdog()
+	return nil
+}
+
 func addClientToDb(name, pubkey, ip string) error {
-	cTime := time.Now().Format(time.RFC3339)
-	insertStmt := "INSERT INTO wg_user (public_key, name, ip, added) VALUES ($1, $2, $3, $4);"
-	_, err := db.Exec(insertStmt, pubkey, name, ip, cTime)
+	return insertClient(ClientConfig{Name: name, PublicKey: pubkey, IP: ip})
+}
+
+// insertClient adds a client to the DB and starts its session, the added
+// time is set to now
+func insertClient(cc ClientConfig) error {
+	cTime := dbTime(time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error().AnErr("error", err).Msg("error inserting into client table")
+		return err
+	}
+	defer tx.Rollback()
+	insertStmt := `INSERT INTO wg_user (public_key, name, ip, added, policy, sub, email, display_name)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
+	_, err = tx.Exec(insertStmt, cc.PublicKey, cc.Name, cc.IP, cTime, cc.Policy,
+		cc.Subject, cc.Email, cc.DisplayName)
 	if err != nil {
 		if strings.HasPrefix(err.Error(), "UNIQUE constraint failed") {
-			log.Warn().Str("pubkey", pubkey).Msg("user already exists in the database")
+			log.Warn().Str("pubkey", cc.PublicKey).Msg("user already exists in the database")
 			return errors.New("User already exists")
 		}
 		log.Error().AnErr("error", err).Msg("error inserting into client table")
 		return err
 	}
+	if err := startSession(tx, cc, cTime); err != nil {
+		log.Error().AnErr("error", err).Msg("error inserting into session table")
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error().AnErr("error", err).Msg("error inserting into client table")
+		return err
+	}
+	// the client has deadlines the watchdog doesn't know about yet
+	wakeWatchdog()
 	return nil
 }
 
@@ -178,9 +364,142 @@ func checkClientDb(confPath string, create bool) error {
 			return err
 		}
 	}
+	// add columns that are newer than the table
+	return migrateClientDb()
+}
+
+// clientDbTables are the tables added after wg_user's first release
+var clientDbTables = []struct{ name, def string }{
+	{"wg_device", `(public_key text not null primary key, name text not null default '',
+		ip text not null, psk text not null, policy text not null default '', enrolled text not null,
+		sub text not null default '', email text not null default '', display_name text not null default '')`},
+	{"wg_session", `(id integer primary key autoincrement, public_key text not null, name text not null default '',
+		ip text not null, policy text not null default '', started text not null, ended text not null default '',
+		end_reason text not null default '', endpoint text not null default '',
+		rx_bytes integer not null default 0, tx_bytes integer not null default 0,
+		sub text not null default '', email text not null default '', display_name text not null default '')`},
+	{"wg_audit", `(seq integer not null primary key, time text not null, event text not null,
+		actor text not null, source_ip text not null, jti text not null, sub text not null,
+		public_key text not null, ip text not null, detail text not null, prev_hash text not null, hash text not null)`},
+}
+
+// clientDbColumns are the columns added to wg_user after its first release
+var clientDbColumns = []struct{ table, name, def string }{
+	{"wg_user", "policy", "text not null default ''"},
+	{"wg_user", "sub", "text not null default ''"},
+	{"wg_user", "email", "text not null default ''"},
+	{"wg_user", "display_name", "text not null default ''"},
+	{"wg_device", "server_key", "integer not null default 0"},
+}
+
+// clientDbIndexes are created along with the tables
+var clientDbIndexes = []string{
+	"wg_session_started ON wg_session (started)",
+}
+
+// clientDbTriggers are created along with the tables. They keep the audit
+// log append-only
+var clientDbTriggers = []string{
+	"wg_audit_no_update BEFORE UPDATE ON wg_audit BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END",
+	"wg_audit_no_delete BEFORE DELETE ON wg_audit BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END",
+}
+
+// dbTime formats t for the client DB. Times are stored in UTC so they sort and
+// compare as strings
+func dbTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// migrateClientDb adds any missing tables, columns, indexes and triggers and stores
+// the times written before they were UTC in UTC
+func migrateClientDb() error {
+	for _, table := range clientDbTables {
+		if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + table.name + " " + table.def + ";"); err != nil {
+			return err
+		}
+	}
+	for _, col := range clientDbColumns {
+		exists, err := columnExists(col.table, col.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		log.Info().Str("table", col.table).Str("column", col.name).Msg("adding column to client DB")
+		if _, err := db.Exec("ALTER TABLE " + col.table + " ADD COLUMN " + col.name + " " + col.def + ";"); err != nil {
+			return err
+		}
+	}
+	for _, index := range clientDbIndexes {
+		if _, err := db.Exec("CREATE INDEX IF NOT EXISTS " + index + ";"); err != nil {
+			return err
+		}
+	}
+	for _, trigger := range clientDbTriggers {
+		if _, err := db.Exec("CREATE TRIGGER IF NOT EXISTS " + trigger + ";"); err != nil {
+			return err
+		}
+	}
+	if err := utcTimes("wg_user", "public_key", "added"); err != nil {
+		return err
+	}
+	return utcTimes("wg_session", "id", "started", "ended")
+}
+
+// utcTimes rewrites the times in a table's columns that aren't UTC. Times
+// that can't be parsed are left for the reports to fail on
+func utcTimes(table, key string, columns ...string) error {
+	for _, col := range columns {
+		rows, err := db.Query("SELECT " + key + ", " + col + " FROM " + table + " WHERE " + col + " <> '' AND " + col + " NOT LIKE '%Z';")
+		if err != nil {
+			return err
+		}
+		updates := make(map[string]string)
+		for rows.Next() {
+			var k, value string
+			if err := rows.Scan(&k, &value); err != nil {
+				rows.Close()
+				return err
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				log.Error().Err(err).Str("table", table).Str(key, k).Msg("invalid time in client DB")
+				continue
+			}
+			updates[k] = dbTime(t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for k, value := range updates {
+			if _, err := db.Exec("UPDATE "+table+" SET "+col+" = $1 WHERE "+key+" = $2;", value, k); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+func columnExists(table, column string) (bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info($1);", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 func closeClientDb() {
 	err := db.Close()
 	if err != nil {
@@ -189,25 +508,102 @@ func closeClientDb() {
 }
 
 func buildClientConfigFile(ccd *clientConfData) (string, error) {
-	//read the template into a file
-	path := clientTemplatePath
-	templText, err := ioutil.ReadFile(path)
+	return buildClientConfigFromTemplate(clientTemplatePath, ccd)
+}
+
+// clientTemplateFuncs are available to every client config template
+var clientTemplateFuncs = template.FuncMap{
+	// list splits a comma separated clientConfData field
+	"list": splitList,
+	// defaultRoute reports whether a route is 0.0.0.0/0 or ::/0, and
+	// defaultRoutes which families a comma separated list has default routes for
+	"defaultRoute":  isDefaultRoute,
+	"defaultRoutes": defaultRouteFamily,
+	// ipv6 reports whether a comma separated list has IPv6 routes
+	"ipv6": hasIPv6Route,
+}
+
+// isDefaultRoute reports whether route is a default route of either family
+func isDefaultRoute(route string) bool {
+	_, ipNet, err := net.ParseCIDR(route)
 	if err != nil {
-		log.Error().AnErr("couldn't read client config", err)
-		return "", err
+		return false
 	}
-	// create a template
-	tmpl, err := template.New("clientTempl").Parse(string(templText))
-	if err != nil {
-		log.Error().AnErr("couldn't template client config", err)
-		return "", err
+	ones, _ := ipNet.Mask.Size()
+	return ones == 0
+}
+
+// defaultRouteFamily returns the systemd-networkd Family, "ipv4", "ipv6" or
+// "both", of the default routes in a comma separated list of routes, or ""
+// if it has none. A full tunnel needs policy routing so the tunnel's own
+// packets aren't routed back into it
+func defaultRouteFamily(routes string) string {
+	ipv4, ipv6 := false, false
+	for _, route := range splitList(routes) {
+		if isDefaultRoute(route) {
+			if strings.Contains(route, ":") {
+				ipv6 = true
+			} else {
+				ipv4 = true
+			}
+		}
+	}
+	switch {
+	case ipv4 && ipv6:
+		return "both"
+	case ipv4:
+		return "ipv4"
+	case ipv6:
+		return "ipv6"
+	}
+	return ""
+}
+
+// hasIPv6Route reports whether a comma separated list of routes has any IPv6
+// ones
+func hasIPv6Route(routes string) bool {
+	for _, route := range splitList(routes) {
+		if ip, _, err := net.ParseCIDR(route); err == nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// buildClientConfigFromTemplate renders ccd with the template at path. The
+// template parsed at the last (re)load is used, the file is only read if
+// it wasn't loaded
+func buildClientConfigFromTemplate(path string, ccd *clientConfData) (string, error) {
+	tmpl, ok := loadedTemplates().text[path]
+	if !ok {
+		var err error
+		if tmpl, err = parseClientTemplate(path); err != nil {
+			return "", err
+		}
 	}
 	// execute it and read it into a string
 	var tbuffer bytes.Buffer
-	err = tmpl.Execute(&tbuffer, ccd)
+	err := tmpl.Execute(&tbuffer, ccd)
 	if err != nil {
 		log.Error().AnErr("couldn't execute client template", err)
 		return "", err
 	}
 	return tbuffer.String(), nil
 }
+
+// parseClientTemplate reads and parses the client config template at path
+func parseClientTemplate(path string) (*template.Template, error) {
+	//read the template into a file
+	templText, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Error().AnErr("couldn't read client config", err)
+		return nil, err
+	}
+	// create a template
+	tmpl, err := template.New("clientTempl").Funcs(clientTemplateFuncs).Parse(string(templText))
+	if err != nil {
+		log.Error().AnErr("couldn't template client config", err)
+		return nil, err
+	}
+	return tmpl, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"os"
 	"path/filepath"
 	"strings"
@@ -114,6 +115,12 @@ func TestOpenIP(t *testing.T) {
 	deleteFile(confpath)
 }
 
+func TestOpenIPMissingConfig(t *testing.T) {
+	if ip, err := getOpenIP(filepath.Join(".", "test", "missing.conf")); err == nil {
+		t.Errorf("expected an error without a server config, got %q", ip)
+	}
+}
+
 func TestBuildClientConfig(t *testing.T) {
 	goodBlock := `[Interface]
 PrivateKey = CLIENT_PRIVATE_KEY
@@ -147,6 +154,83 @@ Endpoint = example.com:12345
 
 }
 
+func TestBuildClientConfigKeysNotEscaped(t *testing.T) {
+	clientTemplatePath = filepath.Join(".", "text_templates", "client_config.txt")
+	ccd := clientConfData{
+		ClientIP:       "10.0.0.5/24",
+		DNS:            "8.8.8.8",
+		ServerPubKey:   "i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=",
+		PSK:            "a+b/c=",
+		ServerHostname: "example.com:12345",
+	}
+	ccf, err := buildClientConfigFile(&ccd)
+	if err != nil {
+		t.Fatalf("failed to exec template: %s", err)
+	}
+	if !strings.Contains(ccf, "PublicKey = i7oVNZPEX8HSiRWCZEW28+s1/l5sSzvtPDd+sRClABE=\n") ||
+		!strings.Contains(ccf, "PresharedKey = a+b/c=\n") {
+		t.Errorf("keys were escaped:\n%s", ccf)
+	}
+	if strings.Contains(ccf, "AllowedIPs") {
+		t.Errorf("AllowedIPs shouldn't be set without routes")
+	}
+}
+
+func TestGetPubKey(t *testing.T) {
+	// RFC 7748 section 6.1 test vector
+	privkey := "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo="
+	expected := "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="
+	// a trailing newline (like wg genkey output) should be tolerated
+	for _, input := range []string{privkey, privkey + "\n"} {
+		pubkey, err := getPubKey(input)
+		if err != nil {
+			t.Fatalf("error deriving public key: %s", err)
+		}
+		if pubkey != expected {
+			t.Errorf("wrong public key.\nGot %s\nexpected %s", pubkey, expected)
+		}
+	}
+	if _, err := getPubKey("not a key"); err == nil {
+		t.Errorf("expected an error for an invalid private key")
+	}
+}
+
+func TestCreateWGKey(t *testing.T) {
+	privkey, pubkey, err := createWGKey()
+	if err != nil {
+		t.Fatalf("error creating key: %s", err)
+	}
+	for _, key := range []string{privkey, pubkey} {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(raw) != 32 {
+			t.Errorf("key %q isn't 32 bytes of canonical base64", key)
+		}
+	}
+	raw, _ := base64.StdEncoding.DecodeString(privkey)
+	if raw[0]&7 != 0 || raw[31]&128 != 0 || raw[31]&64 == 0 {
+		t.Errorf("private key isn't clamped")
+	}
+	derived, err := getPubKey(privkey)
+	if err != nil || derived != pubkey {
+		t.Errorf("public key doesn't match the private key")
+	}
+}
+
+func TestCreatePSK(t *testing.T) {
+	psk, err := createPSK()
+	if err != nil {
+		t.Fatalf("error creating psk: %s", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(psk)
+	if err != nil || len(raw) != 32 {
+		t.Errorf("psk %q isn't 32 bytes of canonical base64", psk)
+	}
+	other, _ := createPSK()
+	if psk == other {
+		t.Errorf("two psks were the same")
+	}
+}
+
 func deleteFile(path string) {
 	err := os.Remove(path)
 	if err != nil {